@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/server"
+	"l7/pkg/spec"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backend is where the rules live, a policy file or a running l7policyd.
+type backend interface {
+	Add(r *spec.Rule) (uint64, error)
+	Del(id uint64) error
+	List() ([]spec.Rule, error)
+	Apply() error
+	Explain(req *spec.Request) ([]spec.Explanation, error)
+	Stats() ([]spec.Stats, error)
+	Chains() ([]spec.Chain, error)
+	Groups() ([]spec.NamedGroup, error)
+	SetGroup(g *spec.NamedGroup) error
+	DelGroup(kind, name string) error
+	Import(f *spec.File) error
+	Export() (*spec.File, error)
+}
+
+// fileBackend edits a policy file in place, rule ids are kept in the file
+// so they don't move when an earlier rule is deleted.
+type fileBackend struct {
+	path string
+}
+
+func (b *fileBackend) load() (*spec.File, error) {
+	f, err := spec.Load(b.path)
+	if os.IsNotExist(err) {
+		return &spec.File{Rules: []spec.Rule{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f, number(f.Rules)
+}
+
+// number gives the rules without an id the ones after the highest, in
+// file order.
+func number(rs []spec.Rule) error {
+	var max uint64
+	seen := map[uint64]bool{}
+	for _, r := range rs {
+		if r.Id == 0 {
+			continue
+		}
+		if seen[r.Id] {
+			return fmt.Errorf("rule id %d used twice", r.Id)
+		}
+		seen[r.Id] = true
+		if r.Id > max {
+			max = r.Id
+		}
+	}
+
+	for i := range rs {
+		if rs[i].Id == 0 {
+			max++
+			rs[i].Id = max
+		}
+	}
+
+	return nil
+}
+
+func (b *fileBackend) Add(r *spec.Rule) (uint64, error) {
+	if _, _, err := r.Policy(); err != nil {
+		return 0, err
+	}
+
+	f, err := b.load()
+	if err != nil {
+		return 0, err
+	}
+
+	v := *r
+	v.Id = 0
+	f.Rules = append(f.Rules, v)
+	number(f.Rules)
+
+	return f.Rules[len(f.Rules)-1].Id, f.Save(b.path)
+}
+
+func (b *fileBackend) Del(id uint64) error {
+	f, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range f.Rules {
+		if f.Rules[i].Id == id {
+			f.Rules = append(f.Rules[:i], f.Rules[i+1:]...)
+			return f.Save(b.path)
+		}
+	}
+
+	return fmt.Errorf("rule %d not found", id)
+}
+
+func (b *fileBackend) List() ([]spec.Rule, error) {
+	f, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Rules, nil
+}
+
+// install loads the file into the in-process policy, which is how a file
+// gets compiled and queried.
+func (b *fileBackend) install() error {
+	f, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	policy.PolicyDeleteAll()
+	return f.Install()
+}
+
+func (b *fileBackend) Apply() error {
+	return b.install()
+}
+
+func (b *fileBackend) Explain(req *spec.Request) ([]spec.Explanation, error) {
+	if err := b.install(); err != nil {
+		return nil, err
+	}
+
+	return req.Explain()
+}
+
+func (b *fileBackend) Stats() ([]spec.Stats, error) {
+	return nil, fmt.Errorf("a policy file has no stats, use --server")
+}
+
+// Chains lists the chains of the file, without hits.
+func (b *fileBackend) Chains() ([]spec.Chain, error) {
+	if err := b.install(); err != nil {
+		return nil, err
+	}
+
+	cs := []spec.Chain{}
+	for _, v := range policy.PolicyChains() {
+		cs = append(cs, spec.FromChain(&v))
+	}
+
+	return cs, nil
+}
+
+func (b *fileBackend) Groups() ([]spec.NamedGroup, error) {
+	f, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Groups, nil
+}
+
+// SetGroup adds or replaces a group of the file.
+func (b *fileBackend) SetGroup(g *spec.NamedGroup) error {
+	if _, err := g.Policy(); err != nil {
+		return err
+	}
+
+	f, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range f.Groups {
+		if f.Groups[i].Kind == g.Kind && f.Groups[i].Name == g.Name {
+			f.Groups[i] = *g
+			return f.Save(b.path)
+		}
+	}
+	f.Groups = append(f.Groups, *g)
+
+	return f.Save(b.path)
+}
+
+func (b *fileBackend) DelGroup(kind, name string) error {
+	f, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range f.Groups {
+		if f.Groups[i].Kind == kind && f.Groups[i].Name == name {
+			f.Groups = append(f.Groups[:i], f.Groups[i+1:]...)
+			// the rules naming it fail to install
+			if err := f.InstallTo(policy.NewEngine()); err != nil {
+				return err
+			}
+			return f.Save(b.path)
+		}
+	}
+
+	return fmt.Errorf("%s group %q not found", kind, name)
+}
+
+func (b *fileBackend) Import(f *spec.File) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	cur, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	cur.Groups = append(cur.Groups, f.Groups...)
+	cur.Defaults = append(cur.Defaults, f.Defaults...)
+	for _, r := range f.Rules {
+		r.Id = 0
+		cur.Rules = append(cur.Rules, r)
+	}
+	number(cur.Rules)
+
+	return cur.Save(b.path)
+}
+
+func (b *fileBackend) Export() (*spec.File, error) {
+	return b.load()
+}
+
+// apiBackend talks to the management api of l7policyd.
+type apiBackend struct {
+	url string
+	gen string // If-Match sent with every change, empty for none
+	hc  http.Client
+}
+
+func newApiBackend(url, gen string) *apiBackend {
+	return &apiBackend{
+		url: strings.TrimSuffix(url, "/"),
+		gen: gen,
+		hc:  http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (b *apiBackend) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, b.url+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.gen != "" && method != http.MethodGet {
+		req.Header.Set("If-Match", b.gen)
+	}
+
+	resp, err := b.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// later changes of the same command go on from this one
+	if b.gen != "" {
+		if g := resp.Header.Get(server.HEADER_GENERATION); g != "" {
+			b.gen = g
+		}
+	}
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *apiBackend) Add(r *spec.Rule) (uint64, error) {
+	var v struct {
+		Id uint64 `json:"id"`
+	}
+
+	err := b.do(http.MethodPost, "/v1/rules", r, &v)
+	return v.Id, err
+}
+
+func (b *apiBackend) Del(id uint64) error {
+	return b.do(http.MethodDelete, "/v1/rules/"+strconv.FormatUint(id, 10), nil, nil)
+}
+
+func (b *apiBackend) List() ([]spec.Rule, error) {
+	var v []spec.Rule
+
+	err := b.do(http.MethodGet, "/v1/rules", nil, &v)
+	return v, err
+}
+
+func (b *apiBackend) Apply() error {
+	return b.do(http.MethodPost, "/v1/apply", nil, nil)
+}
+
+func (b *apiBackend) Explain(req *spec.Request) ([]spec.Explanation, error) {
+	var v []spec.Explanation
+
+	err := b.do(http.MethodPost, "/v1/explain", req, &v)
+	return v, err
+}
+
+func (b *apiBackend) Stats() ([]spec.Stats, error) {
+	var v []spec.Stats
+
+	err := b.do(http.MethodGet, "/v1/stats", nil, &v)
+	return v, err
+}
+
+func (b *apiBackend) Chains() ([]spec.Chain, error) {
+	var v []spec.Chain
+
+	err := b.do(http.MethodGet, "/v1/chains", nil, &v)
+	return v, err
+}
+
+func (b *apiBackend) Groups() ([]spec.NamedGroup, error) {
+	var v []spec.NamedGroup
+
+	err := b.do(http.MethodGet, "/v1/groups", nil, &v)
+	return v, err
+}
+
+func (b *apiBackend) SetGroup(g *spec.NamedGroup) error {
+	return b.do(http.MethodPost, "/v1/groups", g, nil)
+}
+
+func (b *apiBackend) DelGroup(kind, name string) error {
+	return b.do(http.MethodDelete, "/v1/groups", &spec.NamedGroup{Kind: kind, Name: name}, nil)
+}
+
+func (b *apiBackend) Import(f *spec.File) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	for i := range f.Groups {
+		if err := b.SetGroup(&f.Groups[i]); err != nil {
+			return fmt.Errorf("group %d: %v", i, err)
+		}
+	}
+
+	for i := range f.Defaults {
+		if err := b.do(http.MethodPost, "/v1/defaults", &f.Defaults[i], nil); err != nil {
+			return err
+		}
+	}
+	for i := range f.Rules {
+		r := f.Rules[i]
+		r.Id = 0
+		if err := b.do(http.MethodPost, "/v1/rules", &r, nil); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+
+	return b.Apply()
+}
+
+func (b *apiBackend) Export() (*spec.File, error) {
+	var v spec.File
+
+	err := b.do(http.MethodGet, "/v1/dump", nil, &v)
+	return &v, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"l7/pkg/policy"
+	"l7/pkg/server"
+	"l7/pkg/spec"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// addPaths adds paths as drop rules to be and returns their ids.
+func addPaths(t *testing.T, be backend, paths ...string) []uint64 {
+	t.Helper()
+
+	var ids []uint64
+	for _, p := range paths {
+		id, err := be.Add(&spec.Rule{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: p, Action: "drop"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// listed returns the path of every rule of be by id.
+func listed(t *testing.T, be backend) map[uint64]string {
+	t.Helper()
+
+	rs, err := be.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[uint64]string{}
+	for _, r := range rs {
+		m[r.Id] = r.Path
+	}
+
+	return m
+}
+
+// testIds checks a rule keeps its id when an earlier one is deleted, and a
+// deleted id is gone.
+func testIds(t *testing.T, be backend) {
+	ids := addPaths(t, be, "/a", "/b", "/c")
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatalf("ids %v", ids)
+	}
+
+	if err := be.Del(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	m := listed(t, be)
+	if len(m) != 2 || m[ids[1]] != "/b" || m[ids[2]] != "/c" {
+		t.Fatalf("rules %v after deleting %d", m, ids[0])
+	}
+	if err := be.Del(ids[0]); err == nil {
+		t.Fatalf("deleted %d twice", ids[0])
+	}
+
+	d := addPaths(t, be, "/d")[0]
+	if d == ids[1] || d == ids[2] {
+		t.Fatalf("id %d taken again", d)
+	}
+	if err := be.Del(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if m := listed(t, be); len(m) != 2 || m[ids[1]] != "/b" || m[d] != "/d" {
+		t.Fatalf("rules %v", m)
+	}
+}
+
+func TestFileIds(t *testing.T) {
+	testIds(t, &fileBackend{path: filepath.Join(t.TempDir(), "policy.json")})
+}
+
+func TestApiIds(t *testing.T) {
+	policy.PolicyDeleteAll()
+	defer policy.PolicyDeleteAll()
+
+	ts := httptest.NewServer(server.New(nil))
+	defer ts.Close()
+
+	testIds(t, newApiBackend(ts.URL, ""))
+}
+
+func TestFileNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	f := &spec.File{Rules: []spec.Rule{
+		{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: "/a", Action: "drop"},
+		{Id: 5, Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: "/b", Action: "drop"},
+		{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: "/c", Action: "drop"},
+	}}
+	if err := f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	be := &fileBackend{path: path}
+	if m := listed(t, be); len(m) != 3 || m[5] != "/b" || m[6] != "/a" || m[7] != "/c" {
+		t.Fatalf("rules %v", m)
+	}
+
+	// imported rules get fresh ids, not the ones of their file
+	in := &spec.File{Rules: []spec.Rule{{Id: 5, Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: "/d", Action: "drop"}}}
+	if err := be.Import(in); err != nil {
+		t.Fatal(err)
+	}
+	if m := listed(t, be); len(m) != 4 || m[5] != "/b" || m[8] != "/d" {
+		t.Fatalf("rules %v after import", m)
+	}
+
+	f.Rules[0].Id = 5
+	if err := f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.List(); err == nil {
+		t.Fatal("listed a file with an id used twice")
+	}
+}
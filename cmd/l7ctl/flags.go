@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"l7/pkg/spec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ";")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type uintsFlag []uint64
+
+func (l *uintsFlag) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *uintsFlag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, v)
+
+	return nil
+}
+
+type timeFlag struct {
+	t *time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.t == nil {
+		return ""
+	}
+
+	return f.t.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	f.t = &t
+
+	return nil
+}
+
+// ruleFlags binds a rule to the flags of add and del.
+type ruleFlags struct {
+	rule     spec.Rule
+	dst      spec.Dst
+	except   spec.Except
+	status   uint
+	body     string
+	location string
+	rate     uint
+	burst    uint
+	key      string
+	windows  listFlag
+	tz       string
+	from, to timeFlag
+}
+
+func (r *ruleFlags) bind(fs *flag.FlagSet) {
+	var prio uint
+	fs.Func("prio", "priority chain 0-65535, 0 is the highest", func(s string) error {
+		err := parseUint(s, &prio, 16)
+		r.rule.Prio = uint16(prio)
+		return err
+	})
+	fs.StringVar(&r.rule.Cidr, "cidr", "0.0.0.0/0", "client address, x.x.x.x/x")
+	fs.Uint64Var(&r.rule.Workload, "workload", 0, "client workload id")
+	fs.Uint64Var(&r.rule.Role, "role", 0, "client role id")
+	fs.Uint64Var(&r.rule.Group.App, "app", 0, "client group app")
+	fs.Uint64Var(&r.rule.Group.Loc, "loc", 0, "client group location")
+	fs.Uint64Var(&r.rule.Group.Env, "env", 0, "client group environment")
+	fs.StringVar(&r.rule.Dir, "dir", "any", "any, ingress or egress")
+	fs.StringVar(&r.rule.Method, "method", "", "http method, empty for any")
+	fs.StringVar(&r.rule.Type, "type", "http", "service type")
+	fs.StringVar(&r.rule.Proto, "proto", "tcp", "tcp, udp or any")
+	fs.Func("port", "service port", func(s string) error {
+		var v uint
+		err := parseUint(s, &v, 16)
+		r.rule.Port = uint16(v)
+		return err
+	})
+	fs.StringVar(&r.rule.Ports, "ports", "", "port range lo-hi or any, instead of port")
+	fs.StringVar(&r.dst.Cidr, "dst-cidr", "", "destination address, empty for any")
+	fs.Uint64Var(&r.dst.Workload, "dst-workload", 0, "destination workload id")
+	fs.Uint64Var(&r.dst.Role, "dst-role", 0, "destination role id")
+	fs.Uint64Var(&r.dst.Group.App, "dst-app", 0, "destination group app")
+	fs.Uint64Var(&r.dst.Group.Loc, "dst-loc", 0, "destination group location")
+	fs.Uint64Var(&r.dst.Group.Env, "dst-env", 0, "destination group environment")
+	fs.StringVar(&r.rule.Path, "path", "", "uri regex")
+	fs.Var((*listFlag)(&r.rule.Cidrs), "cidrs", "client address of a set rule, repeatable, instead of cidr")
+	fs.Var((*listFlag)(&r.rule.Methods), "methods", "http method of a set rule, repeatable, instead of method")
+	fs.Var((*listFlag)(&r.rule.Paths), "paths", "uri regex of a set rule, repeatable, instead of path")
+	fs.StringVar(&r.rule.AddrGroup, "addr-group", "", "address group, instead of cidr")
+	fs.StringVar(&r.rule.UriGroup, "uri-group", "", "uri group, instead of path")
+	fs.StringVar(&r.rule.ServiceGroup, "service-group", "", "service group, instead of type, proto and port")
+	fs.StringVar(&r.rule.Action, "action", "pass", "pass, drop, audit, reject, ratelimit, redirect or mtls")
+
+	fs.UintVar(&r.status, "status", 0, "reject or redirect http status")
+	fs.StringVar(&r.body, "body", "", "reject body")
+	fs.StringVar(&r.location, "location", "", "redirect location")
+	fs.UintVar(&r.rate, "rate", 0, "ratelimit requests per second")
+	fs.UintVar(&r.burst, "burst", 0, "ratelimit burst")
+	fs.StringVar(&r.key, "key", "", "ratelimit bucket key, ip, workload or role")
+	fs.Var((*listFlag)(&r.except.Cidrs), "except-cidr", "client cidr the rule doesn't match, repeatable")
+	fs.Var((*listFlag)(&r.except.Methods), "except-method", "http method the rule doesn't match, repeatable")
+	fs.Var((*listFlag)(&r.except.Paths), "except-path", "uri regex the rule doesn't match, repeatable")
+	fs.Var((*uintsFlag)(&r.except.Workloads), "except-workload", "client workload the rule doesn't match, repeatable")
+	fs.Var((*uintsFlag)(&r.except.Roles), "except-role", "client role the rule doesn't match, repeatable")
+	fs.Var(&r.windows, "window", "active window like 'sun 02:00-04:00', repeatable")
+	fs.StringVar(&r.tz, "tz", "", "time zone of the windows")
+	fs.Var(&r.from, "not-before", "rfc3339 start time")
+	fs.Var(&r.to, "not-after", "rfc3339 end time")
+}
+
+// build fills the action parameters in, given the action needs them.
+func (r *ruleFlags) build() *spec.Rule {
+	v := r.rule
+	if len(v.Cidrs) != 0 || v.AddrGroup != "" {
+		v.Cidr = ""
+	}
+	if v.ServiceGroup != "" {
+		v.Type, v.Proto = "", ""
+	}
+
+	switch v.Action {
+	case "reject":
+		v.Reject = &spec.Reject{Status: uint16(r.status), Body: r.body}
+	case "redirect":
+		v.Redirect = &spec.Redirect{Status: uint16(r.status), Location: r.location}
+	case "ratelimit":
+		v.RateLimit = &spec.RateLimit{Rate: uint32(r.rate), Burst: uint32(r.burst), Key: r.key}
+	}
+
+	if r.dst != (spec.Dst{}) {
+		d := r.dst
+		v.Dst = &d
+	}
+
+	if e := r.except; len(e.Cidrs)+len(e.Methods)+len(e.Paths)+len(e.Workloads)+len(e.Roles) != 0 {
+		v.Except = &e
+	}
+
+	if len(r.windows) != 0 || r.from.t != nil || r.to.t != nil {
+		v.Schedule = &spec.Schedule{
+			NotBefore: r.from.t,
+			NotAfter:  r.to.t,
+			Tz:        r.tz,
+			Windows:   r.windows,
+		}
+	}
+
+	return &v
+}
+
+// groupFlags binds a named group to the flags of group.
+type groupFlags struct {
+	group spec.NamedGroup
+	del   bool
+}
+
+func (g *groupFlags) bind(fs *flag.FlagSet) {
+	fs.StringVar(&g.group.Kind, "kind", "addr", "addr, uri or service")
+	fs.StringVar(&g.group.Name, "name", "", "group name")
+	fs.Var((*listFlag)(&g.group.Cidrs), "cidr", "member of an addr group, repeatable")
+	fs.Var((*listFlag)(&g.group.Paths), "path", "member of an uri group, repeatable")
+	fs.Func("service", "member of a service group like tcp:80 or any:8000-8100, repeatable", func(s string) error {
+		proto, ports, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("invalid service %q", s)
+		}
+		g.group.Services = append(g.group.Services, spec.Service{Proto: proto, Ports: ports})
+		return nil
+	})
+	fs.BoolVar(&g.del, "del", false, "delete the group instead")
+}
+
+// requestFlags binds a request to the flags of lookup and explain.
+type requestFlags struct {
+	req spec.Request
+	dst spec.Peer
+}
+
+func (r *requestFlags) bind(fs *flag.FlagSet) {
+	fs.StringVar(&r.req.Ip, "ip", "", "client address")
+	fs.Uint64Var(&r.req.Workload, "workload", 0, "client workload id")
+	fs.Uint64Var(&r.req.Role, "role", 0, "client role id")
+	fs.Uint64Var(&r.req.Group.App, "app", 0, "client group app")
+	fs.Uint64Var(&r.req.Group.Loc, "loc", 0, "client group location")
+	fs.Uint64Var(&r.req.Group.Env, "env", 0, "client group environment")
+	fs.StringVar(&r.dst.Ip, "dst-ip", "", "destination address")
+	fs.Uint64Var(&r.dst.Workload, "dst-workload", 0, "destination workload id")
+	fs.Uint64Var(&r.dst.Role, "dst-role", 0, "destination role id")
+	fs.Uint64Var(&r.dst.Group.App, "dst-app", 0, "destination group app")
+	fs.Uint64Var(&r.dst.Group.Loc, "dst-loc", 0, "destination group location")
+	fs.Uint64Var(&r.dst.Group.Env, "dst-env", 0, "destination group environment")
+	fs.StringVar(&r.req.Dir, "dir", "ingress", "ingress or egress")
+	fs.StringVar(&r.req.Method, "method", "GET", "http method")
+	fs.StringVar(&r.req.Type, "type", "http", "service type")
+	fs.StringVar(&r.req.Proto, "proto", "tcp", "tcp or udp")
+	fs.Func("port", "service port", func(s string) error {
+		var v uint
+		err := parseUint(s, &v, 16)
+		r.req.Port = uint16(v)
+		return err
+	})
+	fs.StringVar(&r.req.Path, "path", "/", "request path")
+}
+
+// request returns the request, with its destination if one was given.
+func (r *requestFlags) request() *spec.Request {
+	v := r.req
+	if r.dst != (spec.Peer{}) {
+		d := r.dst
+		v.Dst = &d
+	}
+
+	return &v
+}
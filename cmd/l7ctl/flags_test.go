@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"l7/pkg/spec"
+	"reflect"
+	"testing"
+)
+
+func parseRule(t *testing.T, args ...string) *spec.Rule {
+	t.Helper()
+
+	var rf ruleFlags
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	rf.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return rf.build()
+}
+
+func TestRuleFlags(t *testing.T) {
+	r := parseRule(t, "-prio", "3", "-cidr", "10.0.0.0/8", "-dir", "ingress", "-port", "8080",
+		"-path", "/a", "-action", "ratelimit", "-rate", "5", "-burst", "10", "-key", "ip")
+	want := &spec.Rule{
+		Prio: 3, Cidr: "10.0.0.0/8", Dir: "ingress", Type: "http", Proto: "tcp", Port: 8080,
+		Path: "/a", Action: "ratelimit", RateLimit: &spec.RateLimit{Rate: 5, Burst: 10, Key: "ip"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Fatalf("rule %+v, want %+v", r, want)
+	}
+
+	r = parseRule(t, "-cidrs", "10.0.0.0/8", "-cidrs", "10.1.0.0/16", "-service-group", "web",
+		"-except-workload", "7", "-dst-role", "2", "-window", "sun 02:00-04:00", "-tz", "UTC")
+	if r.Cidr != "" || !reflect.DeepEqual(r.Cidrs, []string{"10.0.0.0/8", "10.1.0.0/16"}) {
+		t.Fatalf("cidr %q cidrs %v", r.Cidr, r.Cidrs)
+	}
+	if r.Action != "pass" {
+		t.Fatalf("default action %q", r.Action)
+	}
+	if r.Type != "" || r.Proto != "" || r.ServiceGroup != "web" {
+		t.Fatalf("service %q %q %q", r.Type, r.Proto, r.ServiceGroup)
+	}
+	if r.Except == nil || !reflect.DeepEqual(r.Except.Workloads, []uint64{7}) {
+		t.Fatalf("except %+v", r.Except)
+	}
+	if r.Dst == nil || r.Dst.Role != 2 {
+		t.Fatalf("dst %+v", r.Dst)
+	}
+	if s := r.Schedule; s == nil || s.Tz != "UTC" || len(s.Windows) != 1 || s.NotBefore != nil {
+		t.Fatalf("schedule %+v", s)
+	}
+	if r.Reject != nil || r.Redirect != nil || r.RateLimit != nil {
+		t.Fatalf("action parameters of a pass %+v", r)
+	}
+}
+
+func TestRuleFlagsInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-prio", "65536"},
+		{"-port", "-1"},
+		{"-except-workload", "x"},
+		{"-not-before", "tomorrow"},
+	} {
+		var rf ruleFlags
+		fs := flag.NewFlagSet("add", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		rf.bind(fs)
+		if fs.Parse(args) == nil {
+			t.Errorf("%v parsed", args)
+		}
+	}
+}
+
+func TestGroupFlags(t *testing.T) {
+	var gf groupFlags
+	fs := flag.NewFlagSet("group", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	gf.bind(fs)
+	if err := fs.Parse([]string{"-kind", "service", "-name", "web", "-service", "tcp:80", "-service", "any:8000-8100"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []spec.Service{{Proto: "tcp", Ports: "80"}, {Proto: "any", Ports: "8000-8100"}}
+	if gf.group.Kind != "service" || gf.group.Name != "web" || !reflect.DeepEqual(gf.group.Services, want) {
+		t.Fatalf("group %+v", gf.group)
+	}
+
+	if fs.Parse([]string{"-service", "80"}) == nil {
+		t.Fatal("service without a proto parsed")
+	}
+}
+
+func TestRequestFlags(t *testing.T) {
+	var rf requestFlags
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	rf.bind(fs)
+	if err := fs.Parse([]string{"-ip", "10.0.0.1", "-port", "80"}); err != nil {
+		t.Fatal(err)
+	}
+	r := rf.request()
+	if r.Ip != "10.0.0.1" || r.Port != 80 || r.Method != "GET" || r.Path != "/" || r.Dst != nil {
+		t.Fatalf("request %+v", r)
+	}
+
+	if err := fs.Parse([]string{"-dst-ip", "10.1.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if r = rf.request(); r.Dst == nil || r.Dst.Ip != "10.1.0.1" {
+		t.Fatalf("dst %+v", r.Dst)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"l7/pkg/lint"
+	"l7/pkg/spec"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: l7ctl [--file policy.json | --server http://host:port] [-o table|json] <command> [flags]
+
+commands:
+  add       add a rule
+  del       delete a rule by id
+  list      list the rules
+  apply     compile the rules
+  lookup    show the decision for a request
+  explain   show every matched pattern and rule of a request
+  stats     show the rule hit counters
+  chains    list the priority chains
+  groups    list the named groups
+  group     add, replace or delete a named group
+  import    add the rules of a policy file
+  export    write the rules as a policy file
+  lint      report shadowed, duplicate, conflicting and partly overlapping rules,
+            and a best effort guess of the overlapping uri patterns
+`
+
+type ctl struct {
+	be     backend
+	output string
+}
+
+func main() {
+	gfs := flag.NewFlagSet("l7ctl", flag.ExitOnError)
+	gfs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+
+	file := gfs.String("file", "", "policy file")
+	addr := gfs.String("server", "", "l7policyd address")
+	gen := gfs.String("generation", "", "expected policy generation of a change")
+	output := gfs.String("o", "table", "output format, table or json")
+	gfs.Parse(os.Args[1:])
+
+	if gfs.NArg() == 0 || (*file == "") == (*addr == "") {
+		gfs.Usage()
+		os.Exit(2)
+	}
+
+	c := &ctl{output: *output}
+	if *file != "" {
+		c.be = &fileBackend{path: *file}
+	} else {
+		c.be = newApiBackend(*addr, *gen)
+	}
+
+	if err := c.run(gfs.Arg(0), gfs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "l7ctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *ctl) run(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+
+	switch cmd {
+	case "add":
+		var rf ruleFlags
+		rf.bind(fs)
+		fs.Parse(args)
+
+		id, err := c.be.Add(rf.build())
+		if err != nil {
+			return err
+		}
+		fmt.Println("added rule", id)
+
+	case "del":
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return fmt.Errorf("del needs rule ids")
+		}
+		for _, s := range fs.Args() {
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid rule id %q", s)
+			}
+			if err := c.be.Del(id); err != nil {
+				return err
+			}
+		}
+
+	case "list":
+		fs.Parse(args)
+		rs, err := c.be.List()
+		if err != nil {
+			return err
+		}
+		return c.print(rs, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "ID\tPRIO\tCIDR\tWORKLOAD\tROLE\tDST\tDIR\tMETHOD\tSERVICE\tPATH\tACTION")
+			for _, r := range rs {
+				fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					r.Id, r.Prio, groupOr(r.AddrGroup, setName(r.Cidr, r.Cidrs)), r.Workload, r.Role,
+					dstName(r.Dst), r.Dir, orAny(setName(r.Method, r.Methods)), serviceName(&r),
+					groupOr(r.UriGroup, setName(r.Path, r.Paths)), r.Action)
+			}
+		})
+
+	case "apply":
+		fs.Parse(args)
+		return c.be.Apply()
+
+	case "lookup", "explain":
+		var rf requestFlags
+		rf.bind(fs)
+		fs.Parse(args)
+
+		es, err := c.be.Explain(rf.request())
+		if err != nil {
+			return err
+		}
+		if cmd == "lookup" {
+			var ds []spec.Explanation
+			for _, e := range es {
+				if e.Final {
+					ds = append(ds, e)
+				}
+			}
+			return c.print(ds, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "PATTERN\tACTION")
+				for _, e := range ds {
+					fmt.Fprintf(tw, "%s\t%s\n", e.Pattern, e.Action)
+				}
+			})
+		}
+		return c.print(es, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "PATTERN\tURI\tRESULT\tACTION\tRULE\tFINAL")
+			for _, e := range es {
+				res, rule := "match", "-"
+				if e.Default {
+					res = "default"
+				}
+				if len(e.Excepted) != 0 {
+					res += fmt.Sprintf(", excepted %v", e.Excepted)
+				}
+				if e.Rule != nil {
+					rule = fmt.Sprintf("%d %s %s %s", e.Rule.Id, setName(e.Rule.Cidr, e.Rule.Cidrs), e.Rule.Dir,
+						orAny(setName(e.Rule.Method, e.Rule.Methods)))
+				}
+				final := ""
+				if e.Final {
+					final = "*"
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", e.Pattern, e.Uri, res, e.Action, rule, final)
+			}
+		})
+
+	case "stats":
+		fs.Parse(args)
+		ss, err := c.be.Stats()
+		if err != nil {
+			return err
+		}
+		return c.print(ss, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "ID\tHITS\tANY\tINGRESS\tEGRESS\tBYTES\tLAST-HIT")
+			for _, s := range ss {
+				last := "-"
+				if s.LastHit != nil {
+					last = s.LastHit.Format("2006-01-02T15:04:05Z")
+				}
+				fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t%s\n", s.Id, s.Hits, s.Any, s.Ingress, s.Egress, s.Bytes, last)
+			}
+		})
+
+	case "chains":
+		fs.Parse(args)
+		cs, err := c.be.Chains()
+		if err != nil {
+			return err
+		}
+		return c.print(cs, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "TABLE\tPRIO\tRULES\tHITS")
+			for _, v := range cs {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", v.Table, v.Prio, v.Rules, v.Hits)
+			}
+		})
+
+	case "groups":
+		fs.Parse(args)
+		gs, err := c.be.Groups()
+		if err != nil {
+			return err
+		}
+		return c.print(gs, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "KIND\tNAME\tMEMBERS")
+			for _, g := range gs {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", g.Kind, g.Name, memberNames(&g))
+			}
+		})
+
+	case "group":
+		var gf groupFlags
+		gf.bind(fs)
+		fs.Parse(args)
+		if gf.group.Name == "" {
+			return fmt.Errorf("group needs a name")
+		}
+		if gf.del {
+			return c.be.DelGroup(gf.group.Kind, gf.group.Name)
+		}
+		return c.be.SetGroup(&gf.group)
+
+	case "import":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("import needs a policy file")
+		}
+		f, err := spec.Load(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		return c.be.Import(f)
+
+	case "export":
+		out := fs.String("out", "", "write to a file instead of stdout")
+		fs.Parse(args)
+		f, err := c.be.Export()
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			return f.Save(*out)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f)
+
+	case "lint":
+		fs.Parse(args)
+		f, err := c.be.Export()
+		if err != nil {
+			return err
+		}
+		ls, err := lint.Lint(f)
+		if err != nil {
+			return err
+		}
+		err = c.print(ls, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "KIND\tRULE\tOTHER\tPATTERNS")
+			guessed := false
+			for _, l := range ls {
+				kind := l.Kind
+				if l.BestEffort {
+					kind += "*"
+					guessed = true
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", kind, position(l.Index), position(l.Other),
+					strings.Trim(l.Pattern+" "+l.OtherPattern, " "))
+			}
+			if guessed {
+				fmt.Fprintln(tw, "* best effort, found on sample paths of the patterns, others may be missed")
+			}
+		})
+		if err == nil && len(ls) > 0 {
+			os.Exit(1)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+
+	return nil
+}
+
+func (c *ctl) print(v interface{}, table func(tw *tabwriter.Writer)) error {
+	switch c.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	}
+
+	return fmt.Errorf("unknown output format %q", c.output)
+}
+
+// position names the rule at index i of an export.
+func position(i int) string {
+	if i < 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("#%d", i)
+}
+
+// dstName shows the constrained fields of d, ANY if there are none.
+func dstName(d *spec.Dst) string {
+	if d == nil {
+		return "ANY"
+	}
+
+	var ss []string
+	if d.Cidr != "" {
+		ss = append(ss, d.Cidr)
+	}
+	if d.Workload != 0 {
+		ss = append(ss, fmt.Sprintf("workload=%d", d.Workload))
+	}
+	if d.Role != 0 {
+		ss = append(ss, fmt.Sprintf("role=%d", d.Role))
+	}
+	if d.Group != (spec.Group{}) {
+		ss = append(ss, fmt.Sprintf("group=%d/%d/%d", d.Group.App, d.Group.Loc, d.Group.Env))
+	}
+
+	return strings.Join(ss, ",")
+}
+
+// serviceName shows the service of r as type/proto:port.
+func serviceName(r *spec.Rule) string {
+	if r.ServiceGroup != "" {
+		return "@" + r.ServiceGroup
+	}
+
+	return fmt.Sprintf("%s/%s:%s", r.Type, r.Proto, portName(r.Port, r.Ports))
+}
+
+func portName(port uint16, ports string) string {
+	if ports != "" {
+		return ports
+	}
+
+	return strconv.Itoa(int(port))
+}
+
+// memberNames shows the members of g.
+func memberNames(g *spec.NamedGroup) string {
+	ss := append(append([]string(nil), g.Cidrs...), g.Paths...)
+	for _, s := range g.Services {
+		ss = append(ss, fmt.Sprintf("%s/%s:%s", s.Type, s.Proto, portName(s.Port, s.Ports)))
+	}
+
+	return strings.Join(ss, ",")
+}
+
+// setName shows the values of a set rule, or the single one.
+func setName(single string, set []string) string {
+	if len(set) == 0 {
+		return single
+	}
+
+	return strings.Join(set, ",")
+}
+
+// groupOr shows a group a rule names, s if it names none.
+func groupOr(name, s string) string {
+	if name != "" {
+		return "@" + name
+	}
+
+	return s
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "ANY"
+	}
+
+	return strings.ToUpper(s)
+}
+
+func parseUint(s string, v *uint, bits int) error {
+	n, err := strconv.ParseUint(s, 10, bits)
+	*v = uint(n)
+
+	return err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"l7/pkg/diff"
+	"l7/pkg/spec"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	var (
+		oldf   = flag.String("old", "", "current policy, a file or a l7policyd address")
+		newf   = flag.String("new", "", "candidate policy, a file or a l7policyd address")
+		corpus = flag.String("corpus", "", "recorded requests to replay, json lines")
+		output = flag.String("o", "text", "output format, text or json")
+	)
+	flag.Parse()
+
+	if *oldf == "" || *newf == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	changed, err := run(*oldf, *newf, *corpus, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "l7diff:", err)
+		os.Exit(2)
+	}
+	if changed {
+		os.Exit(1)
+	}
+}
+
+// load reads a policy file or the dump of a running l7policyd.
+func load(s string) (*spec.File, error) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return spec.Load(s)
+	}
+
+	hc := http.Client{Timeout: 30 * time.Second}
+	resp, err := hc.Get(strings.TrimSuffix(s, "/") + "/v1/dump")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dump %s: %s", s, resp.Status)
+	}
+
+	return spec.Parse(resp.Body)
+}
+
+func run(oldf, newf, corpus, output string) (bool, error) {
+	a, err := load(oldf)
+	if err != nil {
+		return false, err
+	}
+	b, err := load(newf)
+	if err != nil {
+		return false, err
+	}
+
+	d, err := diff.Rules(a, b)
+	if err != nil {
+		return false, err
+	}
+
+	var rp *diff.Report
+	if corpus != "" {
+		f, err := os.Open(corpus)
+		if err != nil {
+			return false, err
+		}
+		reqs, err := diff.LoadCorpus(f)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+
+		ae, err := diff.NewEngine(a)
+		if err != nil {
+			return false, fmt.Errorf("old: %v", err)
+		}
+		be, err := diff.NewEngine(b)
+		if err != nil {
+			return false, fmt.Errorf("new: %v", err)
+		}
+		if rp, err = diff.Replay(ae, be, reqs); err != nil {
+			return false, err
+		}
+	}
+
+	changed := !d.Empty() || (rp != nil && len(rp.Flips) != 0)
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return changed, enc.Encode(struct {
+			Rules  *diff.RuleDiff `json:"rules"`
+			Replay *diff.Report   `json:"replay,omitempty"`
+		}{d, rp})
+	}
+
+	for _, r := range d.Removed {
+		fmt.Printf("- %s\n", ruleText(&r))
+	}
+	for _, r := range d.Added {
+		fmt.Printf("+ %s\n", ruleText(&r))
+	}
+	for _, c := range d.Modified {
+		fmt.Printf("~ %s\n    -> %s\n", ruleText(&c.Old), c.New.Action)
+	}
+	for _, c := range d.Defaults {
+		switch {
+		case c.Old == nil:
+			fmt.Printf("+ default %s\n", defaultText(c.New))
+		case c.New == nil:
+			fmt.Printf("- default %s\n", defaultText(c.Old))
+		default:
+			fmt.Printf("~ default %s -> %s\n", defaultText(c.Old), c.New.Action)
+		}
+	}
+
+	for _, c := range d.Groups {
+		switch {
+		case c.Old == nil:
+			fmt.Printf("+ group %s\n", groupText(c.New))
+		case c.New == nil:
+			fmt.Printf("- group %s\n", groupText(c.Old))
+		default:
+			fmt.Printf("~ group %s\n    -> %s\n", groupText(c.Old), groupText(c.New))
+		}
+	}
+
+	if rp != nil {
+		fmt.Printf("replayed %d requests, %d candidates, %d flipped\n", rp.Requests, rp.Candidates, len(rp.Flips))
+		for _, f := range rp.Flips {
+			fmt.Printf("  %s %s %s %s [%s]: %s -> [%s]: %s\n", f.Request.Ip, f.Request.Dir, f.Request.Method,
+				f.Request.Path, f.Old.Pattern, f.Old.Action, f.New.Pattern, f.New.Action)
+		}
+		for _, c := range rp.Patterns {
+			was, now := "-", "-"
+			if c.Old != nil {
+				was = c.Old.Action
+			}
+			if c.New != nil {
+				now = c.New.Action
+			}
+			fmt.Printf("  %s %s %s %s pattern [%s]: %s -> %s\n", c.Request.Ip, c.Request.Dir, c.Request.Method,
+				c.Request.Path, c.Pattern, was, now)
+		}
+	}
+
+	return changed, nil
+}
+
+func ruleText(r *spec.Rule) string {
+	method := r.Method
+	if method == "" {
+		method = "ANY"
+	}
+
+	cidr, path := r.Cidr, r.Path
+	if len(r.Methods) != 0 {
+		method = strings.Join(r.Methods, ",")
+	}
+	if len(r.Cidrs) != 0 {
+		cidr = strings.Join(r.Cidrs, ",")
+	}
+	if len(r.Paths) != 0 {
+		path = strings.Join(r.Paths, ",")
+	}
+	if r.AddrGroup != "" {
+		cidr = "@" + r.AddrGroup
+	}
+	if r.UriGroup != "" {
+		path = "@" + r.UriGroup
+	}
+	port := strconv.Itoa(int(r.Port))
+	if r.Ports != "" {
+		port = r.Ports
+	}
+	if r.ServiceGroup != "" {
+		port = "@" + r.ServiceGroup
+	}
+
+	return fmt.Sprintf("prio=%d cidr=%s workload=%d role=%d dir=%s method=%s port=%s path=%s action=%s",
+		r.Prio, cidr, r.Workload, r.Role, r.Dir, method, port, path, r.Action)
+}
+
+func groupText(g *spec.NamedGroup) string {
+	var ms []string
+	ms = append(ms, g.Cidrs...)
+	ms = append(ms, g.Paths...)
+	for _, s := range g.Services {
+		port := strconv.Itoa(int(s.Port))
+		if s.Ports != "" {
+			port = s.Ports
+		}
+		ms = append(ms, fmt.Sprintf("%s/%s:%s", s.Type, s.Proto, port))
+	}
+
+	return fmt.Sprintf("%s %s=%s", g.Kind, g.Name, strings.Join(ms, ","))
+}
+
+func defaultText(d *spec.Default) string {
+	return fmt.Sprintf("workload=%d role=%d dir=%s action=%s", d.Workload, d.Role, d.Dir, d.Action)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"l7/pkg/ads"
+	"l7/pkg/audit"
+	"l7/pkg/dist"
+	"l7/pkg/metrics"
+	"l7/pkg/policy"
+	"l7/pkg/reload"
+	"l7/pkg/server"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var (
+		listen   = flag.String("listen", "127.0.0.1:7070", "management api address")
+		file     = flag.String("policy", "", "policy file or directory of *.json files loaded at start")
+		watch    = flag.Bool("watch", false, "reload the policy files when they change")
+		interval = flag.Duration("watch-interval", reload.DEFAULT_RELOAD_INTERVAL, "policy files polling period")
+		debounce = flag.Duration("watch-debounce", reload.DEFAULT_RELOAD_DEBOUNCE, "quiet time after a change before reloading")
+		auditLog = flag.String("audit", "", "json lines audit log file")
+		sample   = flag.Float64("audit-pass-sample", 0, "share of allowed decisions audited")
+		tick     = flag.Duration("schedule", time.Minute, "scheduled rules check interval")
+		hub      = flag.Bool("dist", false, "serve the policy to agents on /v1/dist/")
+		from     = flag.String("dist-from", "", "take the policy from the hub at this address, http://host:port")
+		node     = flag.String("node", "", "name reported to the hub or ads server, the host name if empty")
+		adsFrom  = flag.String("ads", "", "take the policy from the ads server at this address, http://host:port")
+		adsNames = flag.String("ads-resources", "", "comma separated policy resources to subscribe to, all if empty")
+	)
+	flag.Parse()
+
+	n := 0
+	for _, s := range []string{*file, *from, *adsFrom} {
+		if s != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		fmt.Fprintln(os.Stderr, "l7policyd: -policy, -dist-from and -ads are exclusive")
+		os.Exit(2)
+	}
+	if *node == "" {
+		*node, _ = os.Hostname()
+	}
+
+	conf := reload.Config{Path: *file, Interval: *interval, Debounce: *debounce}
+	agent := dist.AgentConfig{Server: *from, Node: *node}
+	client := ads.ClientConfig{Server: *adsFrom, Node: ads.Node{Id: *node}}
+	if *adsNames != "" {
+		client.Names = strings.Split(*adsNames, ",")
+	}
+	if err := run(*listen, conf, *watch, *hub, agent, client, *auditLog, *sample, *tick); err != nil {
+		fmt.Fprintln(os.Stderr, "l7policyd:", err)
+		os.Exit(1)
+	}
+}
+
+func run(listen string, conf reload.Config, watch, hub bool, agent dist.AgentConfig, client ads.ClientConfig,
+	auditLog string, sample float64, tick time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := server.New(metrics.Register())
+	if conf.Path != "" {
+		conf.Lock = srv
+		r := reload.New(policy.Default(), conf)
+		if err := r.Load(); err != nil {
+			return fmt.Errorf("load policy failed, %v", err)
+		}
+		srv.SetReloader(r)
+		if watch {
+			go r.Run(ctx.Done())
+		}
+	}
+
+	if hub {
+		h := dist.NewHub(0)
+		srv.Handle("/v1/dist/", h)
+		go h.Run(0, srv, ctx.Done())
+	}
+	if agent.Server != "" {
+		agent.Lock = srv
+		go dist.NewAgent(policy.Default(), agent).Run(ctx)
+	}
+	if client.Server != "" {
+		client.Lock = srv
+		go ads.NewClient(policy.Default(), client).Run(ctx)
+	}
+
+	if auditLog != "" {
+		sink, err := audit.OpenJsonFile(auditLog)
+		if err != nil {
+			return err
+		}
+		l := audit.NewLogger(audit.Config{PassSample: sample}, sink)
+		defer l.Close()
+		policy.PolicyAddObserver(l)
+	}
+
+	go policy.PolicySchedule(tick, ctx.Done())
+
+	fmt.Println("l7policyd listening on", listen)
+	return srv.ListenAndServe(ctx, listen)
+}
@@ -3,5 +3,5 @@ package main
 import "fmt"
 
 func main() {
-	fmt.Println("U will see some examples in the test folder.")
+	fmt.Println("U will see some examples in the test folder, run cmd/l7policyd for the daemon.")
 }
@@ -22,11 +22,13 @@ type Cidr struct {
 
 type AddrObjCbs struct {
 	sync.RWMutex
-	db map[Cidr]base.AddrId
+	db  map[Cidr]base.AddrId
+	ids map[base.AddrId]Cidr
 }
 
 func (a *AddrObjCbs) Init() {
-	a.db = make(map[Cidr]base.AddrId, 65536)
+	a.db = make(map[Cidr]base.AddrId)
+	a.ids = make(map[base.AddrId]Cidr)
 }
 
 func (a *AddrObjCbs) Lookup(ip netip.Addr) []base.AddrId {
@@ -77,10 +79,27 @@ func (a *AddrObjCbs) GetId(ip netip.Addr, masklen uint8) base.AddrId {
 
 	r := base.AddrId(time.Now().UnixNano())
 	a.db[k] = r
+	a.ids[r] = k
 
 	return r
 }
 
+// FindId is GetId without allocating, ok is false for an unknown cidr.
+func (a *AddrObjCbs) FindId(ip netip.Addr, masklen uint8) (base.AddrId, bool) {
+	if !ip.Is4() {
+		return 0, false
+	}
+	u := binary.BigEndian.Uint32(ip.AsSlice())
+
+	a.RLock()
+	defer a.RUnlock()
+
+	shift := 32 - masklen
+	r, ok := a.db[Cidr{u >> uint32(shift) << uint32(shift), masklen}]
+
+	return r, ok
+}
+
 func (a *AddrObjCbs) DelId(ip netip.Addr, masklen uint8) {
 	if !ip.Is4() {
 		fmt.Println("Ipv6 is not ready!")
@@ -94,9 +113,21 @@ func (a *AddrObjCbs) DelId(ip netip.Addr, masklen uint8) {
 	shift := 32 - masklen
 	k := Cidr{u >> uint32(shift) << uint32(shift), masklen}
 
+	delete(a.ids, a.db[k])
 	delete(a.db, k)
 }
 
+// DelById deletes the address object id, if any.
+func (a *AddrObjCbs) DelById(id base.AddrId) {
+	a.Lock()
+	defer a.Unlock()
+
+	if k, ok := a.ids[id]; ok {
+		delete(a.db, k)
+		delete(a.ids, id)
+	}
+}
+
 func (a *AddrObjCbs) DeleteAll() {
 	a.Lock()
 	defer a.Unlock()
@@ -104,6 +135,9 @@ func (a *AddrObjCbs) DeleteAll() {
 	for k := range a.db {
 		delete(a.db, k)
 	}
+	for k := range a.ids {
+		delete(a.ids, k)
+	}
 }
 
 func (a *AddrObjCbs) Len() int {
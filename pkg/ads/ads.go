@@ -0,0 +1,89 @@
+package ads
+
+import (
+	"fmt"
+	"l7/pkg/spec"
+	"sort"
+	"time"
+)
+
+// POLICY_TYPE_URL is the resource type carrying a policy file.
+const POLICY_TYPE_URL = "type.googleapis.com/l7.policy.v1.Policy"
+
+const (
+	DEFAULT_ADS_RETRY     = 2 * time.Second
+	DEFAULT_ADS_KEEPALIVE = 15 * time.Second
+
+	ADS_BODY_LIMIT = 4 << 20
+
+	HEADER_STREAM = "X-Ads-Stream"
+)
+
+// CODE_OF_INVALID_ARGUMENT is the google.rpc.Code of a nack.
+const CODE_OF_INVALID_ARGUMENT = 3
+
+// The messages follow the json mapping of the envoy discovery api. A stream
+// is opened by POSTing the first request to /v1/ads, the answer is a stream
+// of json lines of responses, and the requests after it, acks and nacks, are
+// POSTed to /v1/ads/<stream> as named by the X-Ads-Stream header.
+
+type Node struct {
+	Id      string `json:"id"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+type Status struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// DiscoveryRequest subscribes to a resource type, or acks the response of
+// ResponseNonce. A nack carries the last good version and ErrorDetail.
+type DiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	Node          *Node    `json:"node,omitempty"`
+	ResourceNames []string `json:"resource_names,omitempty"` // all if empty
+	TypeUrl       string   `json:"type_url"`
+	ResponseNonce string   `json:"response_nonce,omitempty"`
+	ErrorDetail   *Status  `json:"error_detail,omitempty"`
+}
+
+// DiscoveryResponse holds every subscribed resource as of VersionInfo.
+type DiscoveryResponse struct {
+	VersionInfo string     `json:"version_info"`
+	Resources   []Resource `json:"resources"`
+	TypeUrl     string     `json:"type_url"`
+	Nonce       string     `json:"nonce"`
+}
+
+// Resource is a named policy, the Any of the discovery api.
+type Resource struct {
+	Type   string     `json:"@type"`
+	Name   string     `json:"name"`
+	Policy *spec.File `json:"policy"`
+}
+
+// merge joins the policies of rs by name into one file.
+func merge(rs []Resource) (*spec.File, error) {
+	rs = append([]Resource(nil), rs...)
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Name < rs[j].Name })
+
+	f := &spec.File{Rules: []spec.Rule{}}
+	for i := range rs {
+		r := &rs[i]
+		if r.Type != POLICY_TYPE_URL {
+			return nil, fmt.Errorf("resource %q: unknown type %q", r.Name, r.Type)
+		}
+		if i > 0 && rs[i-1].Name == r.Name {
+			return nil, fmt.Errorf("resource %q: sent twice", r.Name)
+		}
+		if r.Policy == nil {
+			return nil, fmt.Errorf("resource %q: no policy", r.Name)
+		}
+		f.Groups = append(f.Groups, r.Policy.Groups...)
+		f.Defaults = append(f.Defaults, r.Policy.Defaults...)
+		f.Rules = append(f.Rules, r.Policy.Rules...)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,168 @@
+package ads
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func rules(action string, paths ...string) *spec.File {
+	f := &spec.File{Rules: []spec.Rule{}}
+	for _, p := range paths {
+		f.Rules = append(f.Rules, spec.Rule{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: p, Action: action})
+	}
+
+	return f
+}
+
+// eventually waits for ok for up to five seconds.
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	for end := time.Now().Add(5 * time.Second); !ok(); {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recorder keeps the versions the streams were opened with.
+type recorder struct {
+	s *Server
+
+	mu   sync.Mutex
+	subs []string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v1/ads" {
+		b, _ := io.ReadAll(req.Body)
+		var v DiscoveryRequest
+		json.Unmarshal(b, &v)
+		r.mu.Lock()
+		r.subs = append(r.subs, v.VersionInfo)
+		r.mu.Unlock()
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	r.s.ServeHTTP(w, req)
+}
+
+func (r *recorder) opened() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.subs...)
+}
+
+func TestClientAckNack(t *testing.T) {
+	srv := NewServer()
+	rec := &recorder{s: srv}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	e := policy.NewEngine()
+	c := NewClient(e, ClientConfig{Server: ts.URL, Node: Node{Id: "n1"}, Retry: 20 * time.Millisecond})
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	node := func() NodeStatus {
+		for _, n := range srv.Nodes() {
+			if n.Node == "n1" {
+				return n
+			}
+		}
+		return NodeStatus{}
+	}
+
+	// ack
+	srv.SetSnapshot("v1", map[string]*spec.File{"a": rules("drop", "/a"), "b": rules("pass", "/b")})
+	eventually(t, "the ack", func() bool { return node().Version == "v1" })
+	if st := c.Status(); st.Version != "v1" || st.Acks != 1 || st.Nacks != 0 || len(e.Dump()) != 2 {
+		t.Fatalf("status %+v, %d rules", st, len(e.Dump()))
+	}
+	gen := e.Generation()
+
+	// nacks, a rule that doesn't build and a pattern that doesn't compile
+	for i, v := range []struct {
+		version string
+		f       *spec.File
+	}{
+		{"v2", rules("nope", "/a")},
+		{"v3", rules("drop", "/a(")},
+	} {
+		srv.SetSnapshot(v.version, map[string]*spec.File{"a": v.f})
+		eventually(t, "the nack of "+v.version, func() bool { return node().Rejected == v.version })
+		if n := node(); n.Version != "v1" || n.Error == "" {
+			t.Errorf("%s: node %+v", v.version, n)
+		}
+		st := c.Status()
+		if st.Version != "v1" || st.Rejected != v.version || st.Error == "" || st.Nacks != uint64(i+1) {
+			t.Errorf("%s: status %+v", v.version, st)
+		}
+		if len(e.Dump()) != 2 || e.Generation() != gen {
+			t.Errorf("%s: policy touched", v.version)
+		}
+	}
+	srv.SetSnapshot("v4", map[string]*spec.File{"a": rules("drop", "/a", "/c")})
+	eventually(t, "the ack of v4", func() bool { return node().Version == "v4" })
+	if st := c.Status(); st.Rejected != "" || st.Error != "" || st.Acks != 2 || len(e.Dump()) != 2 {
+		t.Errorf("status %+v", st)
+	}
+
+	// a new stream subscribes with the version running and gets nothing
+	// until the next snapshot
+	ts.CloseClientConnections()
+	eventually(t, "the new stream", func() bool { return len(rec.opened()) == 2 && c.Status().Connected })
+	if subs := rec.opened(); subs[0] != "" || subs[1] != "v4" {
+		t.Errorf("subscribed with %q", subs)
+	}
+	srv.SetSnapshot("v5", map[string]*spec.File{"a": rules("drop", "/a")})
+	eventually(t, "the ack of v5", func() bool { return node().Version == "v5" })
+	if st := c.Status(); st.Acks != 3 || st.StreamError != "" {
+		t.Errorf("status %+v", st)
+	}
+}
+
+func TestClientNames(t *testing.T) {
+	srv := NewServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	srv.SetSnapshot("v1", map[string]*spec.File{"a": rules("drop", "/a"), "b": rules("pass", "/b", "/c")})
+
+	e := policy.NewEngine()
+	c := NewClient(e, ClientConfig{Server: ts.URL, Node: Node{Id: "n2"}, Names: []string{"b"}})
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	eventually(t, "the ack", func() bool { return c.Status().Version == "v1" })
+	if n := len(e.Dump()); n != 2 {
+		t.Errorf("%d rules, want the 2 of b", n)
+	}
+}
@@ -0,0 +1,197 @@
+package ads
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClientConfig struct {
+	Server string        // base url of the ads server, http://host:port
+	Node   Node          // Id is required
+	Names  []string      // policy resources subscribed to, all if empty
+	Retry  time.Duration // wait before a new stream, DEFAULT_ADS_RETRY if 0
+
+	Lock   sync.Locker  // held while the new set is swapped in, nil for none
+	Client *http.Client // http.DefaultClient if nil
+}
+
+type ClientStatus struct {
+	Server    string `json:"server"`
+	Node      string `json:"node"`
+	Version   string `json:"version"` // last acked, live
+	Rejected  string `json:"rejected,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Acks      uint64 `json:"acks"`
+	Nacks     uint64 `json:"nacks"`
+	Connected bool   `json:"connected"`
+
+	// StreamError is why the last stream broke, cleared by the next stream
+	// opened.
+	StreamError string `json:"stream_error,omitempty"`
+}
+
+// Client consumes the policy resources of an ads server into an engine.
+// Every response is built in a new engine and swapped in whole, then acked.
+// A response that doesn't build is nacked with the version still running.
+type Client struct {
+	conf ClientConfig
+	e    *policy.Engine
+
+	mu sync.Mutex // guards st
+	st ClientStatus
+}
+
+func NewClient(e *policy.Engine, conf ClientConfig) *Client {
+	if conf.Retry <= 0 {
+		conf.Retry = DEFAULT_ADS_RETRY
+	}
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+	conf.Server = strings.TrimRight(conf.Server, "/")
+
+	return &Client{conf: conf, e: e, st: ClientStatus{Server: conf.Server, Node: conf.Node.Id}}
+}
+
+func (c *Client) Status() ClientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.st
+}
+
+// Run keeps a stream open until ctx is done.
+func (c *Client) Run(ctx context.Context) {
+	for {
+		err := c.stream(ctx)
+
+		c.mu.Lock()
+		c.st.Connected = false
+		if ctx.Err() == nil {
+			c.st.StreamError = err.Error()
+		}
+		c.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.conf.Retry):
+		}
+	}
+}
+
+// stream subscribes with the version running and takes responses until the
+// stream breaks.
+func (c *Client) stream(ctx context.Context) error {
+	sub := &DiscoveryRequest{
+		VersionInfo:   c.Status().Version,
+		Node:          &c.conf.Node,
+		ResourceNames: c.conf.Names,
+		TypeUrl:       POLICY_TYPE_URL,
+	}
+	resp, err := c.post(ctx, "/v1/ads", sub)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return spec.ErrorOf(resp)
+	}
+	id := resp.Header.Get(HEADER_STREAM)
+	if id == "" {
+		return fmt.Errorf("answer without a stream id")
+	}
+
+	c.mu.Lock()
+	c.st.Connected, c.st.StreamError = true, ""
+	c.mu.Unlock()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var v DiscoveryResponse
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		req := c.apply(&v)
+		ack, err := c.post(ctx, "/v1/ads/"+id, req)
+		if err != nil {
+			return err
+		}
+		if ack.StatusCode != http.StatusNoContent {
+			err = spec.ErrorOf(ack)
+		}
+		ack.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// apply swaps the policy of v in and returns the ack, or the nack.
+func (c *Client) apply(v *DiscoveryResponse) *DiscoveryRequest {
+	err := c.swap(v)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req := &DiscoveryRequest{
+		Node:          &c.conf.Node,
+		ResourceNames: c.conf.Names,
+		TypeUrl:       POLICY_TYPE_URL,
+		ResponseNonce: v.Nonce,
+	}
+	if err != nil {
+		c.st.Rejected, c.st.Error = v.VersionInfo, err.Error()
+		c.st.Nacks++
+		req.VersionInfo = c.st.Version
+		req.ErrorDetail = &Status{Code: CODE_OF_INVALID_ARGUMENT, Message: err.Error()}
+		return req
+	}
+
+	c.st.Version, c.st.Rejected, c.st.Error = v.VersionInfo, "", ""
+	c.st.Acks++
+	req.VersionInfo = v.VersionInfo
+
+	return req
+}
+
+func (c *Client) swap(v *DiscoveryResponse) error {
+	if v.TypeUrl != POLICY_TYPE_URL {
+		return fmt.Errorf("unknown type %q", v.TypeUrl)
+	}
+	f, err := merge(v.Resources)
+	if err != nil {
+		return err
+	}
+
+	return f.Swap(c.e, c.conf.Lock)
+}
+
+func (c *Client) post(ctx context.Context, path string, v *DiscoveryRequest) (*http.Response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.conf.Server+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.conf.Client.Do(req)
+}
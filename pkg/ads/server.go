@@ -0,0 +1,263 @@
+package ads
+
+import (
+	"encoding/json"
+	"fmt"
+	"l7/pkg/spec"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NodeStatus struct {
+	Node     string     `json:"node"`
+	Version  string     `json:"version"`            // last acked
+	Rejected string     `json:"rejected,omitempty"` // last nacked, if after Version
+	Error    string     `json:"error,omitempty"`
+	Seen     *time.Time `json:"seen,omitempty"`
+}
+
+// Server is a minimal state of the world ads server, it sends every stream
+// the policies of the last snapshot and records the acks. It is meant to
+// stand in for a control plane in tests and trials.
+type Server struct {
+	mu      sync.Mutex
+	version string
+	res     []Resource
+	wake    chan struct{} // closed by the next snapshot
+	seq     uint64        // of streams and nonces
+	streams map[string]*stream
+	nodes   map[string]*NodeStatus
+
+	mux *http.ServeMux
+}
+
+// stream is the state of one open stream.
+type stream struct {
+	node  string
+	names map[string]bool // all if empty
+	sent  string          // version
+	nonce string          // of the last response
+}
+
+func NewServer() *Server {
+	s := &Server{
+		wake:    make(chan struct{}),
+		streams: make(map[string]*stream),
+		nodes:   make(map[string]*NodeStatus),
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/ads", s.open)
+	s.mux.HandleFunc("/v1/ads/", s.request)
+	s.mux.HandleFunc("/v1/ads/nodes", s.nodeList)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetSnapshot makes the policies ps by name the state of version, it is sent
+// to every stream not at version yet. The policies must not change
+// afterwards.
+func (s *Server) SetSnapshot(version string, ps map[string]*spec.File) {
+	res := make([]Resource, 0, len(ps))
+	for name, f := range ps {
+		res = append(res, Resource{Type: POLICY_TYPE_URL, Name: name, Policy: f})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version, s.res = version, res
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// Nodes returns what every node acked by name.
+func (s *Server) Nodes() []NodeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := make([]NodeStatus, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		r = append(r, *n)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Node < r[j].Node })
+
+	return r
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request) (*DiscoveryRequest, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return nil, false
+	}
+
+	var v DiscoveryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ADS_BODY_LIMIT)).Decode(&v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body, %v", err))
+		return nil, false
+	}
+	if v.TypeUrl != POLICY_TYPE_URL {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown type %q", v.TypeUrl))
+		return nil, false
+	}
+
+	return &v, true
+}
+
+// next returns the response st misses, nil if none, and a channel closed
+// when there may be one.
+func (s *Server) next(st *stream) (*DiscoveryResponse, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.version == "" || s.version == st.sent {
+		return nil, s.wake
+	}
+
+	s.seq++
+	st.sent, st.nonce = s.version, strconv.FormatUint(s.seq, 10)
+
+	resp := &DiscoveryResponse{VersionInfo: s.version, Resources: []Resource{}, TypeUrl: POLICY_TYPE_URL, Nonce: st.nonce}
+	for _, v := range s.res {
+		if len(st.names) == 0 || st.names[v.Name] {
+			resp.Resources = append(resp.Resources, v)
+		}
+	}
+
+	return resp, s.wake
+}
+
+// open serves POST /v1/ads, the body is the first request of the stream.
+func (s *Server) open(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Node == nil || req.Node.Id == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("request without a node id"))
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	st := &stream{node: req.Node.Id, names: make(map[string]bool), sent: req.VersionInfo}
+	for _, n := range req.ResourceNames {
+		st.names[n] = true
+	}
+
+	s.mu.Lock()
+	s.seq++
+	id := strconv.FormatUint(s.seq, 10)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set(HEADER_STREAM, id)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	t := time.NewTicker(DEFAULT_ADS_KEEPALIVE)
+	defer t.Stop()
+
+	enc := json.NewEncoder(w)
+	for {
+		resp, wake := s.next(st)
+		if resp != nil {
+			if err := enc.Encode(resp); err != nil {
+				return
+			}
+			fl.Flush()
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-wake:
+				waiting = false
+			case <-t.C:
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return
+				}
+				fl.Flush()
+			}
+		}
+	}
+}
+
+// request serves POST /v1/ads/<stream>, the acks and nacks of a stream. A
+// request for an older response than the last one is stale and dropped.
+func (s *Server) request(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/ads/")
+
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("stream %q not found", id))
+		return
+	}
+	if req.ResponseNonce == "" || req.ResponseNonce != st.nonce {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	n, ok := s.nodes[st.node]
+	if !ok {
+		n = &NodeStatus{Node: st.node}
+		s.nodes[st.node] = n
+	}
+	now := time.Now()
+	n.Seen = &now
+	if req.ErrorDetail == nil {
+		n.Version, n.Rejected, n.Error = req.VersionInfo, "", ""
+	} else {
+		n.Rejected, n.Error = st.sent, req.ErrorDetail.Message
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) nodeList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.Nodes())
+}
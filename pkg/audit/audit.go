@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_AUDIT_QUEUE = 4096
+)
+
+// what to do with a record when the queue is full
+const (
+	AUDIT_FULL_OF_DROP uint8 = iota
+	AUDIT_FULL_OF_BLOCK
+)
+
+type Record struct {
+	Time     time.Time      `json:"time"`
+	Tenant   uint64         `json:"tenant,omitempty"`
+	Ip       string         `json:"ip"`
+	Workload uint64         `json:"workload,omitempty"`
+	Role     uint64         `json:"role,omitempty"`
+	Group    base.WorkGroup `json:"group"`
+	DstIp    string         `json:"dst_ip,omitempty"`
+	DstWork  uint64         `json:"dst_workload,omitempty"`
+	Dir      string         `json:"dir"`
+	Method   string         `json:"method"`
+	Path     string         `json:"path,omitempty"`
+	Pattern  string         `json:"pattern,omitempty"`
+	Rule     uint64         `json:"rule,omitempty"`
+	Action   string         `json:"action"`
+	Default  bool           `json:"default,omitempty"`
+}
+
+type Sink interface {
+	Write(r *Record) error
+	Close() error
+}
+
+type Config struct {
+	Queue      int     // queue length, DEFAULT_AUDIT_QUEUE if 0
+	PassSample float64 // share of allowed decisions logged, 0 logs none
+	Full       uint8   // AUDIT_FULL_OF_xxx
+
+	Now  func() time.Time // record time, time.Now if nil
+	Rand func() float64   // sampling source, math/rand if nil
+}
+
+// Logger is a policy.Observer writing every denied or audited decision and a
+// sample of the allowed ones to its sinks from a background goroutine.
+type Logger struct {
+	conf  Config
+	sinks []Sink
+	q     chan *Record
+	done  chan struct{}
+
+	mu     sync.RWMutex // guards closing q against push
+	closed bool
+
+	dropped uint64 // records lost to a full queue
+	failed  uint64 // sink write errors
+}
+
+func NewLogger(conf Config, sinks ...Sink) *Logger {
+	if conf.Queue <= 0 {
+		conf.Queue = DEFAULT_AUDIT_QUEUE
+	}
+	if conf.Now == nil {
+		conf.Now = time.Now
+	}
+	if conf.Rand == nil {
+		conf.Rand = rand.Float64
+	}
+
+	l := &Logger{
+		conf:  conf,
+		sinks: sinks,
+		q:     make(chan *Record, conf.Queue),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+
+	return l
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	for r := range l.q {
+		for _, s := range l.sinks {
+			if err := s.Write(r); err != nil {
+				atomic.AddUint64(&l.failed, 1)
+			}
+		}
+	}
+}
+
+// wanted tells if r is logged whatever the sampling: the audited, throttled
+// and denied decisions, and the mtls ones since only the request tells if
+// they deny.
+func wanted(r *policy.Result) bool {
+	if r.Audit() || r.Throttled {
+		return true
+	}
+
+	switch uint8(r.Action) {
+	case policy.POLICY_ACTION_OF_DROP, policy.POLICY_ACTION_OF_REJECT, policy.POLICY_ACTION_OF_REDIRECT,
+		policy.POLICY_ACTION_OF_MTLS:
+		return true
+	}
+
+	return false
+}
+
+func (l *Logger) OnLookup(ev *policy.LookupEvent) {
+	if !wanted(ev.Result) && (l.conf.PassSample <= 0 || l.conf.Rand() >= l.conf.PassSample) {
+		return
+	}
+
+	r := &Record{
+		Time:     l.conf.Now(),
+		Tenant:   uint64(ev.Client.Tenant),
+		Ip:       ev.Client.Ip.String(),
+		Workload: uint64(ev.Client.Workload),
+		Role:     uint64(ev.Client.Role),
+		Group:    ev.Client.Group,
+		Dir:      ev.Dir.String(),
+		Method:   ev.Method.String(),
+		Path:     ev.Path,
+		Pattern:  ev.Pattern,
+		Action:   ev.Result.Action.String(),
+		Default:  ev.Result.Kind == policy.POLICY_RESULT_OF_DEFAULT,
+	}
+	if ev.Result.Rule != nil {
+		r.Rule = ev.Result.Rule.Id
+	}
+	if ev.Client.Dst.Ip.IsValid() {
+		r.DstIp = ev.Client.Dst.Ip.String()
+	}
+	r.DstWork = uint64(ev.Client.Dst.Workload)
+
+	l.push(r)
+}
+
+func (l *Logger) OnApply(d time.Duration, err error) {}
+
+func (l *Logger) push(r *Record) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		atomic.AddUint64(&l.dropped, 1)
+		return
+	}
+
+	if l.conf.Full == AUDIT_FULL_OF_BLOCK {
+		l.q <- r
+		return
+	}
+
+	select {
+	case l.q <- r:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *Logger) Failed() uint64 {
+	return atomic.LoadUint64(&l.failed)
+}
+
+// Close flushes the queued records and closes the sinks, later records are
+// counted as dropped.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.q)
+	l.mu.Unlock()
+
+	<-l.done
+
+	var err error
+	for _, s := range l.sinks {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
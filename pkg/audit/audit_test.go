@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func event(action uint8) *policy.LookupEvent {
+	return &policy.LookupEvent{
+		Client: &base.Client{Ip: netip.MustParseAddr("10.1.2.3")},
+		Dir:    base.L7_INGRESS,
+		Method: base.HTTP_GET,
+		Api:    &base.ApiService{},
+		Result: &policy.Result{Kind: policy.POLICY_RESULT_OF_DEFAULT, Action: policy.Action(action)},
+	}
+}
+
+// gate holds every write until opened, it tells when the first one waits.
+type gate struct {
+	RingSink
+	waiting chan struct{}
+	open    chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{RingSink: RingSink{buf: make([]Record, 8)}, waiting: make(chan struct{}, 8), open: make(chan struct{})}
+}
+
+func (g *gate) Write(r *Record) error {
+	g.waiting <- struct{}{}
+	<-g.open
+
+	return g.RingSink.Write(r)
+}
+
+func TestSampling(t *testing.T) {
+	rolls := []float64{0.2, 0.7, 0.4, 0.9}
+	ring := NewRingSink(16)
+	l := NewLogger(Config{PassSample: 0.5, Rand: func() float64 {
+		v := rolls[0]
+		rolls = rolls[1:]
+		return v
+	}}, ring)
+
+	// half of the passes
+	for range []int{0, 1, 2, 3} {
+		l.OnLookup(event(policy.POLICY_ACTION_OF_PASS))
+	}
+	// the denied, audited and mtls decisions whatever the sample
+	for _, a := range []uint8{policy.POLICY_ACTION_OF_DROP, policy.POLICY_ACTION_OF_AUDIT, policy.POLICY_ACTION_OF_MTLS} {
+		l.OnLookup(event(a))
+	}
+	l.Close()
+
+	var got []string
+	for _, r := range ring.Records() {
+		got = append(got, r.Action)
+	}
+	if len(got) != 5 || got[0] != "pass" || got[1] != "pass" || got[2] != "drop" || got[4] != "mtls" {
+		t.Errorf("records %v", got)
+	}
+	if len(rolls) != 0 {
+		t.Errorf("%d rolls left, only the passes are sampled", len(rolls))
+	}
+}
+
+func TestFullDrop(t *testing.T) {
+	g := newGate()
+	l := NewLogger(Config{Queue: 1, Full: AUDIT_FULL_OF_DROP}, g)
+
+	// one record in the sink, one in the queue, the third has no room
+	l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+	<-g.waiting
+	l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+	l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+	if n := l.Dropped(); n != 1 {
+		t.Errorf("%d dropped, want 1", n)
+	}
+
+	close(g.open)
+	l.Close()
+	if n := len(g.Records()); n != 2 {
+		t.Errorf("%d records, want 2", n)
+	}
+}
+
+func TestFullBlock(t *testing.T) {
+	g := newGate()
+	l := NewLogger(Config{Queue: 1, Full: AUDIT_FULL_OF_BLOCK}, g)
+
+	l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+	<-g.waiting
+	l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+
+	// the third waits for room rather than being dropped
+	done := make(chan struct{})
+	go func() {
+		l.OnLookup(event(policy.POLICY_ACTION_OF_DROP))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("record pushed on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(g.open)
+	<-done
+	l.Close()
+	if n := len(g.Records()); n != 3 || l.Dropped() != 0 {
+		t.Errorf("%d records, %d dropped", n, l.Dropped())
+	}
+}
+
+// TestLookupLogged has the logger observe a lookup without the defaults.
+func TestLookupLogged(t *testing.T) {
+	ring := NewRingSink(4)
+	l := NewLogger(Config{}, ring)
+	policy.PolicyAddObserver(l)
+	defer policy.PolicyDeleteAll()
+
+	arg := &policy.PolicyOpPara{
+		Cidr:    "10.0.0.0/8",
+		Dir:     base.L7_INGRESS,
+		Type:    base.SERVICE_OF_HTTP,
+		Proto:   6,
+		Port:    80,
+		Httpath: "/a",
+	}
+	if err := policy.PolicyAdd(arg, policy.Action(policy.POLICY_ACTION_OF_DROP)); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.ApplyRules(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := policy.ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	ra, _ := policy.PolicyLookupPath(c, base.L7_INGRESS, base.HTTP_GET, &as[0], "/a/b")
+	if ra == nil {
+		t.Fatal("lookup missed")
+	}
+	l.Close()
+
+	rs := ring.Records()
+	if len(rs) != 1 || rs[0].Rule != ra.Id || rs[0].Action != "drop" || rs[0].Path != "/a/b" || rs[0].Pattern != "/a" {
+		t.Errorf("records %+v", rs)
+	}
+}
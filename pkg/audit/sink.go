@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// JsonSink writes one json object per line.
+type JsonSink struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewJsonSink(w io.Writer) *JsonSink {
+	return &JsonSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func OpenJsonFile(path string) (*JsonSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJsonSink(f), nil
+}
+
+func (s *JsonSink) Write(r *Record) error {
+	return s.enc.Encode(r)
+}
+
+func (s *JsonSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+const (
+	SYSLOG_FACILITY_LOCAL0 = 16
+	SYSLOG_SEVERITY_WARN   = 4
+	SYSLOG_SEVERITY_INFO   = 6
+)
+
+// SyslogSink writes rfc5424 lines, w may be a file or a connection to a
+// syslog daemon.
+type SyslogSink struct {
+	w        io.Writer
+	hostname string
+	app      string
+}
+
+func NewSyslogSink(w io.Writer, hostname, app string) *SyslogSink {
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	return &SyslogSink{w: w, hostname: hostname, app: app}
+}
+
+func (s *SyslogSink) Write(r *Record) error {
+	sev := SYSLOG_SEVERITY_INFO
+	if r.Action != "pass" && r.Action != "audit" {
+		sev = SYSLOG_SEVERITY_WARN
+	}
+
+	msg, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.w, "<%d>1 %s %s %s %d - - %s\n",
+		SYSLOG_FACILITY_LOCAL0*8+sev,
+		r.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname, s.app, os.Getpid(), msg)
+
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// RingSink keeps the last records in memory.
+type RingSink struct {
+	sync.Mutex
+	buf  []Record
+	next int
+	full bool
+}
+
+func NewRingSink(size int) *RingSink {
+	return &RingSink{buf: make([]Record, size)}
+}
+
+func (s *RingSink) Write(r *Record) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	s.buf[s.next] = *r
+	s.next = (s.next + 1) % len(s.buf)
+	if s.next == 0 {
+		s.full = true
+	}
+
+	return nil
+}
+
+// Records returns the kept records, oldest first.
+func (s *RingSink) Records() []Record {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.full {
+		return append([]Record(nil), s.buf[:s.next]...)
+	}
+
+	return append(append([]Record(nil), s.buf[s.next:]...), s.buf[:s.next]...)
+}
+
+func (s *RingSink) Close() error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+)
+
+var methodNames = [...]string{
+	"ANY",
+	"GET",
+	"HEAD",
+	"POST",
+	"PUT",
+	"DELETE",
+	"CONNECT",
+	"OPTIONS",
+	"TRACE",
+	"PATCH",
+}
+
+var dirNames = [...]string{
+	"any",
+	"ingress",
+	"egress",
+}
+
+func (m Method) String() string {
+	if int(m) >= len(methodNames) {
+		return fmt.Sprintf("method(%d)", uint8(m))
+	}
+
+	return methodNames[m]
+}
+
+// ParseMethod accepts a http method name in any case, "ANY" or "" is 0.
+func ParseMethod(s string) (Method, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	for i, v := range methodNames {
+		if strings.EqualFold(v, s) {
+			return Method(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown http method %q", s)
+}
+
+func (d Direction) String() string {
+	if int(d) >= len(dirNames) {
+		return fmt.Sprintf("dir(%d)", uint8(d))
+	}
+
+	return dirNames[d]
+}
+
+func ParseDirection(s string) (Direction, error) {
+	if s == "" {
+		return L7_ANY, nil
+	}
+
+	for i, v := range dirNames {
+		if strings.EqualFold(v, s) {
+			return Direction(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown direction %q", s)
+}
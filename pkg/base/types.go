@@ -6,6 +6,9 @@ const (
 	SERVICE_OF_HTTP uint8 = 1 + iota
 )
 
+// the ApiService.Proto of a rule matching any protocol
+const PROTO_OF_ANY uint8 = 0
+
 const (
 	HTTP_GET = 1 + iota
 	HTTP_HEAD
@@ -25,6 +28,7 @@ const (
 )
 
 type AddrId uint64
+type TenantId uint64
 type WorkloadId uint64
 type WorkRole uint64
 type Method uint8
@@ -40,13 +44,25 @@ type WorkGroup struct {
 }
 
 type ApiService struct {
-	Type  uint8  // http ...
-	Proto uint8  // tcp、udp ...
-	Port  uint16 // port number
-	Uri   UriId  // api id
+	Type    uint8  // http ...
+	Proto   uint8  // tcp、udp ...
+	Port    uint16 // port number
+	Uri     UriId  // api id
+	PortMax uint16 // last port of a rule range, 0 for Port only
 }
 
+// Client is the source of a request, Dst where it goes.
 type Client struct {
+	Tenant   TenantId // 0 is the default tenant
+	Ip       netip.Addr
+	Workload WorkloadId
+	Role     WorkRole
+	Group    WorkGroup
+	Dst      Endpoint
+}
+
+// Endpoint is the destination of a request, zero fields are unknown.
+type Endpoint struct {
 	Ip       netip.Addr
 	Workload WorkloadId
 	Role     WorkRole
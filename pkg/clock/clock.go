@@ -0,0 +1,47 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type SysClock struct{}
+
+func (SysClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock only moves when told to, it makes time based policies testable.
+type FakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.t
+}
+
+func (c *FakeClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.t = t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.t = c.t.Add(d)
+}
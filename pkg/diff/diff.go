@@ -0,0 +1,327 @@
+package diff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"reflect"
+	"sort"
+)
+
+type Change struct {
+	Old spec.Rule `json:"old"`
+	New spec.Rule `json:"new"`
+}
+
+type DefaultChange struct {
+	Old *spec.Default `json:"old,omitempty"`
+	New *spec.Default `json:"new,omitempty"`
+}
+
+type GroupChange struct {
+	Old *spec.NamedGroup `json:"old,omitempty"`
+	New *spec.NamedGroup `json:"new,omitempty"`
+}
+
+type RuleDiff struct {
+	Added    []spec.Rule     `json:"added"`
+	Removed  []spec.Rule     `json:"removed"`
+	Modified []Change        `json:"modified"`
+	Defaults []DefaultChange `json:"defaults"`
+	Groups   []GroupChange   `json:"groups"`
+}
+
+func (d *RuleDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.Defaults) == 0 && len(d.Groups) == 0
+}
+
+// ruleValue is what a rule does, and the requests it leaves out.
+func ruleValue(r *spec.Rule) string {
+	b, _ := json.Marshal([]interface{}{r.Action, r.Reject, r.Redirect, r.RateLimit, r.Schedule, r.Except})
+	return string(b)
+}
+
+func index(f *spec.File) (map[spec.RuleKey]*spec.Rule, []spec.RuleKey, error) {
+	m := make(map[spec.RuleKey]*spec.Rule, len(f.Rules))
+
+	var keys []spec.RuleKey
+	for i := range f.Rules {
+		k, err := f.Rules[i].Key()
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		if _, ok := m[k]; !ok {
+			keys = append(keys, k)
+		}
+		m[k] = &f.Rules[i]
+	}
+
+	return m, keys, nil
+}
+
+// Rules compares the rule sets a and b, rules are paired by what they match.
+func Rules(a, b *spec.File) (*RuleDiff, error) {
+	d := &RuleDiff{}
+
+	am, akeys, err := index(a)
+	if err != nil {
+		return nil, fmt.Errorf("old: %v", err)
+	}
+	bm, bkeys, err := index(b)
+	if err != nil {
+		return nil, fmt.Errorf("new: %v", err)
+	}
+
+	for _, k := range akeys {
+		o := am[k]
+		n, ok := bm[k]
+		if !ok {
+			d.Removed = append(d.Removed, *o)
+		} else if ruleValue(o) != ruleValue(n) {
+			d.Modified = append(d.Modified, Change{Old: *o, New: *n})
+		}
+	}
+	for _, k := range bkeys {
+		if _, ok := am[k]; !ok {
+			d.Added = append(d.Added, *bm[k])
+		}
+	}
+
+	if d.Defaults, err = defaults(a, b); err != nil {
+		return nil, err
+	}
+	d.Groups = groups(a, b)
+
+	return d, nil
+}
+
+// groups compares the named groups, a group edit changes every rule naming
+// it.
+func groups(a, b *spec.File) []GroupChange {
+	var r []GroupChange
+
+	get := func(f *spec.File) map[[2]string]*spec.NamedGroup {
+		m := make(map[[2]string]*spec.NamedGroup, len(f.Groups))
+		for i := range f.Groups {
+			m[[2]string{f.Groups[i].Kind, f.Groups[i].Name}] = &f.Groups[i]
+		}
+		return m
+	}
+
+	am, bm := get(a), get(b)
+	for k, o := range am {
+		if n, ok := bm[k]; !ok {
+			r = append(r, GroupChange{Old: o})
+		} else if !reflect.DeepEqual(o, n) {
+			r = append(r, GroupChange{Old: o, New: n})
+		}
+	}
+	for k, n := range bm {
+		if _, ok := am[k]; !ok {
+			r = append(r, GroupChange{New: n})
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return groupName(&r[i]) < groupName(&r[j])
+	})
+
+	return r
+}
+
+func groupName(c *GroupChange) string {
+	g := c.Old
+	if g == nil {
+		g = c.New
+	}
+
+	return g.Kind + "/" + g.Name
+}
+
+func defaults(a, b *spec.File) ([]DefaultChange, error) {
+	var r []DefaultChange
+
+	get := func(f *spec.File) (map[policy.DefaultKey]*spec.Default, error) {
+		m := make(map[policy.DefaultKey]*spec.Default, len(f.Defaults))
+		for i := range f.Defaults {
+			k, _, err := f.Defaults[i].Policy()
+			if err != nil {
+				return nil, fmt.Errorf("default %d: %v", i, err)
+			}
+			m[*k] = &f.Defaults[i]
+		}
+		return m, nil
+	}
+
+	am, err := get(a)
+	if err != nil {
+		return nil, err
+	}
+	bm, err := get(b)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, o := range am {
+		if n, ok := bm[k]; !ok {
+			r = append(r, DefaultChange{Old: o})
+		} else if o.Action != n.Action {
+			r = append(r, DefaultChange{Old: o, New: n})
+		}
+	}
+	for k, n := range bm {
+		if _, ok := am[k]; !ok {
+			r = append(r, DefaultChange{New: n})
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return defaultName(&r[i]) < defaultName(&r[j])
+	})
+
+	return r, nil
+}
+
+func defaultName(c *DefaultChange) string {
+	d := c.Old
+	if d == nil {
+		d = c.New
+	}
+
+	return fmt.Sprintf("%020d/%020d/%s", d.Workload, d.Role, d.Dir)
+}
+
+// Engine is a policy engine holding one rule set.
+type Engine struct {
+	pe *policy.Engine
+}
+
+func NewEngine(f *spec.File) (*Engine, error) {
+	e := &Engine{pe: policy.NewEngine()}
+
+	if err := f.InstallTo(e.pe); err != nil {
+		return nil, err
+	}
+	if err := e.pe.Apply(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Engine) Explain(r *spec.Request) ([]spec.Explanation, error) {
+	return r.ExplainIn(e.pe)
+}
+
+// Flip is a request the two rule sets decide differently, Old and New are
+// the final explanations.
+type Flip struct {
+	Request spec.Request     `json:"request"`
+	Old     spec.Explanation `json:"old"`
+	New     spec.Explanation `json:"new"`
+}
+
+// PatternChange is a uri pattern a request matches whose decision differs,
+// Old is nil for a pattern only the new rule set has, New for a removed one.
+type PatternChange struct {
+	Request spec.Request      `json:"request"`
+	Pattern string            `json:"pattern"`
+	Old     *spec.Explanation `json:"old,omitempty"`
+	New     *spec.Explanation `json:"new,omitempty"`
+}
+
+type Report struct {
+	Requests   int             `json:"requests"`
+	Candidates int             `json:"candidates"` // request and matched pattern pairs of either set
+	Flips      []Flip          `json:"flips"`
+	Patterns   []PatternChange `json:"patterns,omitempty"`
+}
+
+// Replay runs every request through both engines and reports the ones
+// whose final decision differs, and the matched patterns, paired by their
+// text, deciding differently or matched in one rule set only.
+func Replay(a, b *Engine, reqs []spec.Request) (*Report, error) {
+	rp := &Report{Requests: len(reqs)}
+
+	for i := range reqs {
+		ae, err := a.Explain(&reqs[i])
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %v", i, err)
+		}
+		be, err := b.Explain(&reqs[i])
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %v", i, err)
+		}
+
+		if af, bf := final(ae), final(be); af.Action != bf.Action {
+			rp.Flips = append(rp.Flips, Flip{Request: reqs[i], Old: *af, New: *bf})
+		}
+
+		// the decision without a pattern is no candidate
+		news := make(map[string]*spec.Explanation, len(be))
+		for j := range be {
+			if be[j].Uri != 0 {
+				news[be[j].Pattern] = &be[j]
+			}
+		}
+		for j := range ae {
+			o := &ae[j]
+			if o.Uri == 0 {
+				continue
+			}
+			rp.Candidates++
+			n, ok := news[o.Pattern]
+			delete(news, o.Pattern)
+			if !ok {
+				rp.Patterns = append(rp.Patterns, PatternChange{Request: reqs[i], Pattern: o.Pattern, Old: o})
+			} else if o.Action != n.Action {
+				rp.Patterns = append(rp.Patterns, PatternChange{Request: reqs[i], Pattern: o.Pattern, Old: o, New: n})
+			}
+		}
+		for j := range be {
+			if n := &be[j]; news[n.Pattern] == n {
+				rp.Candidates++
+				rp.Patterns = append(rp.Patterns, PatternChange{Request: reqs[i], Pattern: n.Pattern, New: n})
+			}
+		}
+	}
+
+	return rp, nil
+}
+
+// final returns the explanation deciding the request.
+func final(es []spec.Explanation) *spec.Explanation {
+	for i := range es {
+		if es[i].Final {
+			return &es[i]
+		}
+	}
+
+	return &spec.Explanation{}
+}
+
+// LoadCorpus reads recorded requests, one json spec.Request per line.
+func LoadCorpus(r io.Reader) ([]spec.Request, error) {
+	var reqs []spec.Request
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		l := bytes.TrimSpace(sc.Bytes())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+
+		var v spec.Request
+		if err := json.Unmarshal(l, &v); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		reqs = append(reqs, v)
+	}
+
+	return reqs, sc.Err()
+}
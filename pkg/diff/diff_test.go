@@ -0,0 +1,61 @@
+package diff
+
+import (
+	"l7/pkg/spec"
+	"testing"
+)
+
+func TestReplayPatternSets(t *testing.T) {
+	rule := func(path, action string) spec.Rule {
+		return spec.Rule{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: path, Action: action}
+	}
+	defs := []spec.Default{{Dir: "ingress", Action: "drop"}}
+
+	// the patterns get different ids in either engine
+	a, err := NewEngine(&spec.File{Defaults: defs, Rules: []spec.Rule{rule("/a", "drop"), rule("/b", "pass")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEngine(&spec.File{Defaults: defs, Rules: []spec.Rule{rule("/c", "pass"), rule("/a", "drop")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := func(path string) spec.Request {
+		return spec.Request{Ip: "10.1.1.1", Dir: "ingress", Method: "GET", Port: 80, Path: path}
+	}
+	rp, err := Replay(a, b, []spec.Request{req("/a/x"), req("/b/x"), req("/c/x"), req("/d")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flips := map[string][2]string{}
+	for _, f := range rp.Flips {
+		flips[f.Request.Path] = [2]string{f.Old.Action, f.New.Action}
+	}
+	want := map[string][2]string{"/b/x": {"pass", "drop"}, "/c/x": {"drop", "pass"}}
+	if len(flips) != len(want) || flips["/b/x"] != want["/b/x"] || flips["/c/x"] != want["/c/x"] {
+		t.Fatalf("flips %v, want %v", flips, want)
+	}
+
+	if len(rp.Patterns) != 2 {
+		t.Fatalf("pattern changes %+v, want 2", rp.Patterns)
+	}
+	for _, c := range rp.Patterns {
+		switch c.Pattern {
+		case "/b":
+			if c.Old == nil || c.New != nil {
+				t.Errorf("/b not reported removed, %+v", c)
+			}
+		case "/c":
+			if c.Old != nil || c.New == nil {
+				t.Errorf("/c not reported added, %+v", c)
+			}
+		default:
+			t.Errorf("unexpected pattern change %+v", c)
+		}
+	}
+	if rp.Candidates != 3 {
+		t.Errorf("%d candidates, want 3", rp.Candidates)
+	}
+}
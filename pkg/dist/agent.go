@@ -0,0 +1,216 @@
+package dist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AgentConfig struct {
+	Server string        // base url of the hub, http://host:port
+	Node   string        // name reported to the hub
+	Retry  time.Duration // wait before a new watch, DEFAULT_DIST_RETRY if 0
+
+	Lock   sync.Locker  // held while the new set is swapped in, nil for none
+	Client *http.Client // http.DefaultClient if nil
+}
+
+type AgentStatus struct {
+	Server    string `json:"server"`
+	Node      string `json:"node"`
+	Epoch     uint64 `json:"epoch"`   // of the hub
+	Version   uint64 `json:"version"` // live, 0 before the first good apply
+	Wanted    uint64 `json:"wanted"`  // last received
+	Error     string `json:"error,omitempty"`
+	Connected bool   `json:"connected"`
+
+	// WatchError is the last failure of a watch or an ack, cleared by the
+	// next watch taken or ack sent.
+	WatchError string `json:"watch_error,omitempty"`
+}
+
+// Agent keeps an engine in line with the rule sets of a hub. Every update is
+// built in a new engine and swapped in whole, then acked. A rule set that
+// doesn't build is nacked and the running policy stays, the next delta is
+// still taken from it.
+type Agent struct {
+	conf AgentConfig
+	e    *policy.Engine
+
+	// owned by Run
+	want    *spec.File
+	epoch   uint64 // of want
+	version uint64
+
+	mu sync.Mutex // guards st
+	st AgentStatus
+}
+
+func NewAgent(e *policy.Engine, conf AgentConfig) *Agent {
+	if conf.Retry <= 0 {
+		conf.Retry = DEFAULT_DIST_RETRY
+	}
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+	conf.Server = strings.TrimRight(conf.Server, "/")
+
+	return &Agent{conf: conf, e: e, st: AgentStatus{Server: conf.Server, Node: conf.Node}}
+}
+
+func (a *Agent) Status() AgentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.st
+}
+
+// Run watches the hub until ctx is done, watching again after an error.
+func (a *Agent) Run(ctx context.Context) {
+	for {
+		err := a.watch(ctx)
+
+		a.mu.Lock()
+		a.st.Connected = false
+		if ctx.Err() == nil {
+			a.st.WatchError = err.Error()
+		}
+		a.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.conf.Retry):
+		}
+	}
+}
+
+// watch takes updates from one stream until it breaks.
+func (a *Agent) watch(ctx context.Context) error {
+	q := url.Values{}
+	q.Set("node", a.conf.Node)
+	q.Set("epoch", strconv.FormatUint(a.epoch, 10))
+	q.Set("version", strconv.FormatUint(a.version, 10))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.conf.Server+"/v1/dist/watch?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.conf.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return spec.ErrorOf(resp)
+	}
+
+	a.mu.Lock()
+	a.st.Connected, a.st.WatchError = true, ""
+	a.mu.Unlock()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var u Update
+		if err := dec.Decode(&u); err != nil {
+			return err
+		}
+		if err := a.update(ctx, &u); err != nil {
+			return err
+		}
+	}
+}
+
+// update applies u, an error means the agent lost track of the hub and must
+// start over from a snapshot.
+func (a *Agent) update(ctx context.Context, u *Update) error {
+	switch {
+	case u.Snapshot != nil:
+		a.want = u.Snapshot
+	case u.Delta != nil && u.Epoch == a.epoch && u.From == a.version && a.want != nil:
+		f, err := patch(a.want, u.Delta)
+		if err == nil {
+			f.Rules, err = reorder(f.Rules, u.Order)
+		}
+		if err != nil {
+			a.version = 0
+			return fmt.Errorf("version %d: %v", u.Version, err)
+		}
+		a.want = f
+	default:
+		e, v := a.epoch, a.version
+		a.version = 0
+		return fmt.Errorf("version %d/%d from %d, at %d/%d", u.Epoch, u.Version, u.From, e, v)
+	}
+	a.epoch, a.version = u.Epoch, u.Version
+
+	err := a.swap(a.want)
+
+	a.mu.Lock()
+	a.st.Epoch, a.st.Wanted = u.Epoch, u.Version
+	if err == nil {
+		a.st.Version, a.st.Error = u.Version, ""
+	} else {
+		a.st.Error = fmt.Sprintf("version %d: %v", u.Version, err)
+	}
+	a.mu.Unlock()
+
+	ack := Ack{Node: a.conf.Node, Version: u.Version}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	err = a.ack(ctx, &ack)
+
+	a.mu.Lock()
+	a.st.WatchError = ""
+	if err != nil {
+		a.st.WatchError = fmt.Sprintf("ack version %d: %v", u.Version, err)
+	}
+	a.mu.Unlock()
+
+	return nil
+}
+
+// swap makes f live, even for a delta it is built whole, see spec.File.Swap.
+func (a *Agent) swap(f *spec.File) error {
+	return f.Swap(a.e, a.conf.Lock)
+}
+
+func (a *Agent) ack(ctx context.Context, v *Ack) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.conf.Server+"/v1/dist/ack", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.conf.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return spec.ErrorOf(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package dist
+
+import (
+	"context"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func rules(paths ...string) *spec.File {
+	f := &spec.File{Rules: []spec.Rule{}}
+	for _, p := range paths {
+		f.Rules = append(f.Rules, spec.Rule{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: p, Action: "drop"})
+	}
+
+	return f
+}
+
+// paths returns the paths of the live rules of e by id.
+func paths(e *policy.Engine) []string {
+	var r []string
+	for _, v := range e.Dump() {
+		r = append(r, v.Para.Httpath)
+	}
+
+	return r
+}
+
+// ids returns the ids of the live rules of e by path.
+func ids(e *policy.Engine) map[string]uint64 {
+	r := make(map[string]uint64)
+	for _, v := range e.Dump() {
+		r[v.Para.Httpath] = v.Id
+	}
+
+	return r
+}
+
+// eventually waits for ok for up to five seconds.
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	for end := time.Now().Add(5 * time.Second); !ok(); {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// swapper serves the hub of the moment, like a hub restarted at the same
+// address.
+type swapper struct {
+	mu sync.Mutex
+	h  *Hub
+}
+
+func (s *swapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	h := s.h
+	s.mu.Unlock()
+
+	h.ServeHTTP(w, r)
+}
+
+type testAgent struct {
+	*Agent
+	e    *policy.Engine
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func startAgent(url, node string, q policy.Quota) *testAgent {
+	e := policy.NewEngine()
+	e.SetQuota(&q)
+	a := &testAgent{
+		Agent: NewAgent(e, AgentConfig{Server: url, Node: node, Retry: 20 * time.Millisecond}),
+		e:     e,
+	}
+	a.start()
+
+	return a
+}
+
+func (a *testAgent) start() {
+	ctx, stop := context.WithCancel(context.Background())
+	a.stop, a.done = stop, make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(a.done)
+	}()
+}
+
+func (a *testAgent) halt() {
+	a.stop()
+	<-a.done
+}
+
+func TestHubAgents(t *testing.T) {
+	h := NewHub(2)
+	sw := &swapper{h: h}
+	ts := httptest.NewServer(sw)
+	defer ts.Close()
+
+	if _, err := h.Publish(rules("/a", "/b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second agent takes two rules at most and nacks anything bigger
+	as := []*testAgent{
+		startAgent(ts.URL, "n1", policy.Quota{}),
+		startAgent(ts.URL, "n2", policy.Quota{Rules: 2}),
+		startAgent(ts.URL, "n3", policy.Quota{}),
+	}
+	defer func() {
+		for _, a := range as {
+			a.halt()
+		}
+	}()
+	at := func(v uint64, as ...*testAgent) func() bool {
+		return func() bool {
+			for _, a := range as {
+				if a.Status().Version != v {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// snapshot
+	eventually(t, "the snapshot", at(1, as...))
+	for _, a := range as {
+		if got := paths(a.e); !reflect.DeepEqual(got, []string{"/a", "/b"}) {
+			t.Errorf("%s: rules %v", a.conf.Node, got)
+		}
+	}
+
+	// delta adding a rule in the middle, the others keep their ids so it
+	// comes last by id
+	was := ids(as[0].e)
+	if v, err := h.Publish(rules("/a", "/c", "/b")); err != nil || v != 2 {
+		t.Fatalf("version %d, %v", v, err)
+	}
+	us, _ := h.next(h.epoch, 1)
+	if len(us) != 1 || us[0].Delta == nil || !reflect.DeepEqual(us[0].Order, []int{0, 2, 1}) {
+		t.Fatalf("updates %+v", us)
+	}
+	eventually(t, "the delta", at(2, as[0], as[2]))
+	for _, a := range []*testAgent{as[0], as[2]} {
+		if got := paths(a.e); !reflect.DeepEqual(got, []string{"/a", "/b", "/c"}) {
+			t.Errorf("%s: rules %v", a.conf.Node, got)
+		}
+	}
+	if now := ids(as[0].e); now["/a"] != was["/a"] || now["/b"] != was["/b"] {
+		t.Errorf("ids %v, were %v", now, was)
+	}
+
+	// nack, the running policy stays
+	eventually(t, "the nack", func() bool {
+		for _, n := range h.Nodes() {
+			if n.Node == "n2" {
+				return n.Version == 1 && n.Rejected == 2 && n.Error != ""
+			}
+		}
+		return false
+	})
+	if st := as[1].Status(); st.Version != 1 || st.Wanted != 2 || st.Error == "" {
+		t.Errorf("n2: status %+v", st)
+	}
+	if got := paths(as[1].e); !reflect.DeepEqual(got, []string{"/a", "/b"}) {
+		t.Errorf("n2: rules %v", got)
+	}
+
+	// catch up on the deltas missed, n2 patches on the version it nacked
+	as[2].halt()
+	h.Publish(rules("/a", "/b"))
+	eventually(t, "the revert", at(3, as[0], as[1]))
+	as[2].start()
+	eventually(t, "the catch up", at(3, as[2]))
+	if got := paths(as[2].e); !reflect.DeepEqual(got, []string{"/a", "/b"}) {
+		t.Errorf("n3: rules %v", got)
+	}
+
+	// too far behind for the history, a snapshot
+	h.Publish(rules("/d"))
+	h.Publish(rules("/e"))
+	if us, _ := h.next(h.epoch, 2); len(us) != 1 || us[0].Snapshot == nil || us[0].Version != 5 {
+		t.Errorf("updates %+v", us)
+	}
+	eventually(t, "the history", at(5, as...))
+
+	// a restarted hub counts versions from 1 again, the agents at the same
+	// version of the old epoch start over
+	h2 := NewHub(0)
+	for _, p := range []string{"/f", "/g", "/h", "/i", "/j"} {
+		if _, err := h2.Publish(rules(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sw.mu.Lock()
+	sw.h = h2
+	sw.mu.Unlock()
+	ts.CloseClientConnections()
+
+	eventually(t, "the new epoch", func() bool {
+		for _, a := range as {
+			if a.Status().Epoch != h2.epoch {
+				return false
+			}
+		}
+		return true
+	})
+	for _, a := range as {
+		if got := paths(a.e); !reflect.DeepEqual(got, []string{"/j"}) || a.Status().Version != 5 {
+			t.Errorf("%s: rules %v, status %+v", a.conf.Node, got, a.Status())
+		}
+	}
+}
+
+func TestOrderOf(t *testing.T) {
+	for _, v := range []struct {
+		a, b  []string
+		order []int
+	}{
+		{[]string{"/a", "/b"}, []string{"/a", "/b", "/c"}, nil},
+		{[]string{"/a", "/b"}, []string{"/c", "/a", "/b"}, []int{2, 0, 1}},
+		{[]string{"/a", "/b", "/c"}, []string{"/c", "/b"}, []int{1, 0}},
+	} {
+		a, b := rules(v.a...), rules(v.b...)
+		h := NewHub(0)
+		h.Publish(a)
+		h.Publish(b)
+		us, _ := h.next(h.epoch, 1)
+		if len(us) != 1 || us[0].Delta == nil || !reflect.DeepEqual(us[0].Order, v.order) {
+			t.Errorf("%v to %v: updates %+v", v.a, v.b, us)
+			continue
+		}
+
+		f, err := patch(a, us[0].Delta)
+		if err == nil {
+			f.Rules, err = reorder(f.Rules, us[0].Order)
+		}
+		if err != nil || !reflect.DeepEqual(f.Rules, b.Rules) {
+			t.Errorf("%v to %v: patched %v, %v", v.a, v.b, f, err)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package dist
+
+import (
+	"encoding/json"
+	"fmt"
+	"l7/pkg/diff"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DIST_HISTORY   = 64 // deltas kept for agents catching up
+	DEFAULT_DIST_KEEPALIVE = 15 * time.Second
+	DEFAULT_DIST_INTERVAL  = time.Second
+	DEFAULT_DIST_RETRY     = 2 * time.Second
+
+	DIST_BODY_LIMIT = 1 << 20
+)
+
+// Update is one message of a watch stream, either the whole rule set or the
+// changes from the version before. Versions count from 1 in each epoch, a
+// restarted hub starts a new one.
+type Update struct {
+	Epoch    uint64         `json:"epoch"`
+	Version  uint64         `json:"version"`
+	From     uint64         `json:"from,omitempty"` // version the delta applies to
+	Snapshot *spec.File     `json:"snapshot,omitempty"`
+	Delta    *diff.RuleDiff `json:"delta,omitempty"`
+	Order    []int          `json:"order,omitempty"` // rule i of the version is rule Order[i] of the patched set, see patch
+}
+
+// Ack is what an agent made of a version, a nack if Error is set.
+type Ack struct {
+	Node    string `json:"node"`
+	Version uint64 `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HubStatus is what the publishes left behind, the last error is cleared by
+// the next good publish.
+type HubStatus struct {
+	Epoch     uint64     `json:"epoch"`
+	Version   uint64     `json:"version"`
+	Published *time.Time `json:"published,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Failed    *time.Time `json:"failed,omitempty"`
+}
+
+type NodeStatus struct {
+	Node     string     `json:"node"`
+	Version  uint64     `json:"version"`            // last acked
+	Rejected uint64     `json:"rejected,omitempty"` // last nacked, if after Version
+	Error    string     `json:"error,omitempty"`
+	Seen     *time.Time `json:"seen,omitempty"`
+	Watching int        `json:"watching"` // open streams
+}
+
+// Hub serves versioned rule sets to agents. Each published rule set that
+// differs from the one before gets the next version, agents watching get
+// the delta, or a snapshot when they are too far behind.
+type Hub struct {
+	history int
+	epoch   uint64 // unix nano of the start
+
+	mu      sync.Mutex
+	version uint64
+	snap    *spec.File
+	deltas  []Update      // the last history deltas, oldest first
+	wake    chan struct{} // closed by the next publish
+	nodes   map[string]*NodeStatus
+	st      HubStatus
+
+	mux *http.ServeMux
+}
+
+// NewHub builds a hub keeping history deltas, DEFAULT_DIST_HISTORY if 0.
+func NewHub(history int) *Hub {
+	if history <= 0 {
+		history = DEFAULT_DIST_HISTORY
+	}
+
+	h := &Hub{
+		history: history,
+		epoch:   uint64(time.Now().UnixNano()),
+		wake:    make(chan struct{}),
+		nodes:   make(map[string]*NodeStatus),
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/v1/dist/watch", h.watch)
+	h.mux.HandleFunc("/v1/dist/ack", h.ack)
+	h.mux.HandleFunc("/v1/dist/snapshot", h.snapshot)
+	h.mux.HandleFunc("/v1/dist/nodes", h.nodeList)
+	h.mux.HandleFunc("/v1/dist/status", h.status)
+	h.st.Epoch = h.epoch
+
+	return h
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Hub) Version() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.version
+}
+
+func (h *Hub) Status() HubStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.st
+}
+
+// Publish makes f the current rule set and returns its version, an
+// unchanged rule set keeps the version. f must not change afterwards.
+func (h *Hub) Publish(f *spec.File) (uint64, error) {
+	if err := f.Validate(); err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.snap != nil {
+		d, err := diff.Rules(h.snap, f)
+		if err != nil {
+			return 0, err
+		}
+		if d.Empty() {
+			return h.version, nil
+		}
+		u := Update{Epoch: h.epoch, Version: h.version + 1, From: h.version, Delta: d}
+		if u.Order, err = orderOf(h.snap, f, d); err != nil {
+			// the delta can't rebuild f, the agents take it whole
+			u = Update{Epoch: h.epoch, Version: h.version + 1, From: h.version, Snapshot: f}
+		}
+		h.deltas = append(h.deltas, u)
+		if len(h.deltas) > h.history {
+			h.deltas = h.deltas[len(h.deltas)-h.history:]
+		}
+	}
+
+	h.version++
+	h.snap = f
+	close(h.wake)
+	h.wake = make(chan struct{})
+
+	now := time.Now()
+	h.st.Version, h.st.Published = h.version, &now
+
+	return h.version, nil
+}
+
+// Run publishes the default policy every time its generation moves, until
+// stop is closed. lock, if not nil, is held while the policy is read. A
+// failed publish is recorded in the status and tried again on the next
+// move.
+func (h *Hub) Run(interval time.Duration, lock sync.Locker, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = DEFAULT_DIST_INTERVAL
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var gen uint64
+	for first := true; ; first = false {
+		if g := policy.PolicyGeneration(); first || g != gen {
+			if lock != nil {
+				lock.Lock()
+			}
+			g, f := policy.PolicyGeneration(), spec.Dump()
+			if lock != nil {
+				lock.Unlock()
+			}
+
+			_, err := h.Publish(f)
+			h.published(g, err)
+			gen = g
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (h *Hub) published(gen uint64, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		h.st.Error, h.st.Failed = "", nil
+		return
+	}
+	now := time.Now()
+	h.st.Error, h.st.Failed = fmt.Sprintf("generation %d: %v", gen, err), &now
+}
+
+// next returns what an agent at version v of epoch misses, and a channel
+// closed when there is more. An agent of another epoch starts over.
+func (h *Hub) next(epoch, v uint64) ([]Update, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.snap == nil {
+		return nil, h.wake
+	}
+	if epoch == h.epoch && v == h.version {
+		return nil, h.wake
+	}
+	if epoch != h.epoch || v == 0 || v > h.version || len(h.deltas) == 0 || v < h.deltas[0].From {
+		return []Update{{Epoch: h.epoch, Version: h.version, Snapshot: h.snap}}, h.wake
+	}
+
+	i := sort.Search(len(h.deltas), func(i int) bool { return h.deltas[i].From >= v })
+	return append([]Update(nil), h.deltas[i:]...), h.wake
+}
+
+func (h *Hub) node(name string) *NodeStatus {
+	n, ok := h.nodes[name]
+	if !ok {
+		n = &NodeStatus{Node: name}
+		h.nodes[name] = n
+	}
+
+	return n
+}
+
+func (h *Hub) watching(name string, d int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.node(name).Watching += d
+}
+
+// Nodes returns the state of every agent seen by name.
+func (h *Hub) Nodes() []NodeStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := make([]NodeStatus, 0, len(h.nodes))
+	for _, n := range h.nodes {
+		r = append(r, *n)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Node < r[j].Node })
+
+	return r
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// watch serves GET /v1/dist/watch?node=name&epoch=e&version=v, a stream of
+// json updates from version v of epoch e on, 0 for a snapshot first.
+func (h *Hub) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("node")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("watch needs a node name"))
+		return
+	}
+	var epoch, v uint64
+	for _, p := range []struct {
+		name string
+		v    *uint64
+	}{{"epoch", &epoch}, {"version", &v}} {
+		if s := q.Get(p.name); s != "" {
+			var err error
+			if *p.v, err = strconv.ParseUint(s, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", p.name, s))
+				return
+			}
+		}
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	h.watching(name, 1)
+	defer h.watching(name, -1)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	t := time.NewTicker(DEFAULT_DIST_KEEPALIVE)
+	defer t.Stop()
+
+	enc := json.NewEncoder(w)
+	for {
+		us, wake := h.next(epoch, v)
+		for i := range us {
+			if err := enc.Encode(&us[i]); err != nil {
+				return
+			}
+			epoch, v = us[i].Epoch, us[i].Version
+		}
+		fl.Flush()
+
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-wake:
+				waiting = false
+			case <-t.C:
+				// a blank line keeps idle proxies from closing the stream
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return
+				}
+				fl.Flush()
+			}
+		}
+	}
+}
+
+// ack serves POST /v1/dist/ack.
+func (h *Hub) ack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	var a Ack
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, DIST_BODY_LIMIT))
+	if err := dec.Decode(&a); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body, %v", err))
+		return
+	}
+	if a.Node == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("ack needs a node name"))
+		return
+	}
+
+	h.mu.Lock()
+	n := h.node(a.Node)
+	now := time.Now()
+	n.Seen = &now
+	if a.Error == "" {
+		n.Version = a.Version
+		if n.Rejected <= a.Version {
+			n.Rejected, n.Error = 0, ""
+		}
+	} else {
+		n.Rejected, n.Error = a.Version, a.Error
+	}
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// snapshot serves GET /v1/dist/snapshot, the current version whole.
+func (h *Hub) snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	h.mu.Lock()
+	u := Update{Epoch: h.epoch, Version: h.version, Snapshot: h.snap}
+	h.mu.Unlock()
+
+	writeJson(w, http.StatusOK, &u)
+}
+
+func (h *Hub) nodeList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, h.Nodes())
+}
+
+func (h *Hub) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, h.Status())
+}
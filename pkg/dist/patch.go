@@ -0,0 +1,225 @@
+package dist
+
+import (
+	"fmt"
+	"l7/pkg/diff"
+	"l7/pkg/spec"
+)
+
+// patch returns f with the changes of d made, d must have been taken from
+// the same rule set. The rules left keep their place and the added ones go
+// last, the Order of the update puts them where the new version has them.
+func patch(f *spec.File, d *diff.RuleDiff) (*spec.File, error) {
+	v := &spec.File{Rules: []spec.Rule{}}
+
+	drop := make(map[spec.RuleKey]bool)
+	for i := range d.Removed {
+		k, err := d.Removed[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("removed rule %d: %v", i, err)
+		}
+		drop[k] = true
+	}
+	mod := make(map[spec.RuleKey]*spec.Rule)
+	for i := range d.Modified {
+		k, err := d.Modified[i].Old.Key()
+		if err != nil {
+			return nil, fmt.Errorf("modified rule %d: %v", i, err)
+		}
+		mod[k] = &d.Modified[i].New
+	}
+
+	seen := make(map[spec.RuleKey]bool)
+	for i := range f.Rules {
+		k, err := f.Rules[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		seen[k] = true
+		if drop[k] {
+			continue
+		}
+		if n, ok := mod[k]; ok {
+			v.Rules = append(v.Rules, *n)
+			continue
+		}
+		v.Rules = append(v.Rules, f.Rules[i])
+	}
+	for k := range drop {
+		if !seen[k] {
+			return nil, fmt.Errorf("removed rule not found")
+		}
+	}
+	for k := range mod {
+		if !seen[k] {
+			return nil, fmt.Errorf("modified rule not found")
+		}
+	}
+	for i := range d.Added {
+		k, err := d.Added[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("added rule %d: %v", i, err)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("added rule %d exists", i)
+		}
+		v.Rules = append(v.Rules, d.Added[i])
+	}
+
+	var err error
+	if v.Groups, err = patchGroups(f.Groups, d.Groups); err != nil {
+		return nil, err
+	}
+	if v.Defaults, err = patchDefaults(f.Defaults, d.Defaults); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// orderOf returns the Order of the delta d from a to b, nil when the patched
+// rules are in the order of b already.
+func orderOf(a, b *spec.File, d *diff.RuleDiff) ([]int, error) {
+	p, err := patch(a, d)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Rules) != len(b.Rules) {
+		return nil, fmt.Errorf("patched %d rules, want %d", len(p.Rules), len(b.Rules))
+	}
+
+	at := make(map[spec.RuleKey][]int, len(p.Rules))
+	for i := range p.Rules {
+		k, err := p.Rules[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("patched rule %d: %v", i, err)
+		}
+		at[k] = append(at[k], i)
+	}
+
+	o := make([]int, len(b.Rules))
+	moved := false
+	for i := range b.Rules {
+		k, err := b.Rules[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		q := at[k]
+		if len(q) == 0 {
+			return nil, fmt.Errorf("rule %d not patched", i)
+		}
+		o[i], at[k] = q[0], q[1:]
+		moved = moved || o[i] != i
+	}
+	if !moved {
+		return nil, nil
+	}
+
+	return o, nil
+}
+
+// reorder puts rule o[i] of rs at i, an empty o keeps rs.
+func reorder(rs []spec.Rule, o []int) ([]spec.Rule, error) {
+	if len(o) == 0 {
+		return rs, nil
+	}
+	if len(o) != len(rs) {
+		return nil, fmt.Errorf("order of %d rules for %d", len(o), len(rs))
+	}
+
+	r := make([]spec.Rule, len(rs))
+	used := make([]bool, len(rs))
+	for i, j := range o {
+		if j < 0 || j >= len(rs) || used[j] {
+			return nil, fmt.Errorf("invalid order at %d", i)
+		}
+		used[j] = true
+		r[i] = rs[j]
+	}
+
+	return r, nil
+}
+
+func patchGroups(gs []spec.NamedGroup, cs []diff.GroupChange) ([]spec.NamedGroup, error) {
+	r := append([]spec.NamedGroup(nil), gs...)
+
+	find := func(g *spec.NamedGroup) int {
+		for i := range r {
+			if r[i].Kind == g.Kind && r[i].Name == g.Name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, c := range cs {
+		switch {
+		case c.New == nil:
+			i := find(c.Old)
+			if i < 0 {
+				return nil, fmt.Errorf("removed %s group %q not found", c.Old.Kind, c.Old.Name)
+			}
+			r = append(r[:i], r[i+1:]...)
+		case c.Old == nil:
+			if find(c.New) >= 0 {
+				return nil, fmt.Errorf("added %s group %q exists", c.New.Kind, c.New.Name)
+			}
+			r = append(r, *c.New)
+		default:
+			i := find(c.Old)
+			if i < 0 {
+				return nil, fmt.Errorf("modified %s group %q not found", c.Old.Kind, c.Old.Name)
+			}
+			r[i] = *c.New
+		}
+	}
+
+	return r, nil
+}
+
+func patchDefaults(ds []spec.Default, cs []diff.DefaultChange) ([]spec.Default, error) {
+	r := append([]spec.Default(nil), ds...)
+
+	find := func(d *spec.Default) (int, error) {
+		k, _, err := d.Policy()
+		if err != nil {
+			return 0, err
+		}
+		for i := range r {
+			if v, _, err := r[i].Policy(); err == nil && *v == *k {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+
+	for _, c := range cs {
+		d := c.Old
+		if d == nil {
+			d = c.New
+		}
+		i, err := find(d)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c.Old == nil && i >= 0:
+			return nil, fmt.Errorf("added default %s exists", defaultName(d))
+		case c.Old != nil && i < 0:
+			return nil, fmt.Errorf("default %s not found", defaultName(d))
+		case c.New == nil:
+			r = append(r[:i], r[i+1:]...)
+		case c.Old == nil:
+			r = append(r, *c.New)
+		default:
+			r[i] = *c.New
+		}
+	}
+
+	return r, nil
+}
+
+func defaultName(d *spec.Default) string {
+	return fmt.Sprintf("%d/%d/%s", d.Workload, d.Role, d.Dir)
+}
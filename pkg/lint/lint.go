@@ -0,0 +1,124 @@
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"reflect"
+)
+
+// Finding is a policy.Finding told in terms of the policy file, Index and
+// Other are rule positions in it.
+type Finding struct {
+	Kind         string     `json:"kind"`
+	Index        int        `json:"index"`
+	Other        int        `json:"other"`
+	Rule         *spec.Rule `json:"rule,omitempty"`
+	OtherRule    *spec.Rule `json:"other_rule,omitempty"`
+	Pattern      string     `json:"pattern,omitempty"`
+	OtherPattern string     `json:"other_pattern,omitempty"`
+	BestEffort   bool       `json:"best_effort,omitempty"` // other pairs like it may be missed
+}
+
+// Lint reports the rules of f that never fire, repeat, contradict or
+// partly overlap another one, and the uri patterns matching together. A
+// rule partly overlapping an earlier one is left out of the other checks.
+// The patterns matching together are found on sample paths only, so some
+// may be missed.
+func Lint(f *spec.File) ([]Finding, error) {
+	r, err := entries(f)
+	if err != nil {
+		return nil, err
+	}
+
+	e := policy.NewEngine()
+	if err := (&spec.File{Groups: f.Groups, Defaults: f.Defaults}).InstallTo(e); err != nil {
+		return nil, err
+	}
+
+	// rule ids by position in f
+	pos := make(map[uint64]int, len(f.Rules))
+	for i := range f.Rules {
+		set, ra, _ := f.Rules[i].Policy()
+		err := e.AddSet(set, ra)
+
+		var oe *policy.OverlapError
+		if errors.As(err, &oe) {
+			j := pos[oe.Other]
+			r = append(r, Finding{
+				Kind:      policy.LintName(policy.LINT_OF_PARTIAL),
+				Index:     i,
+				Other:     j,
+				Rule:      &f.Rules[i],
+				OtherRule: &f.Rules[j],
+			})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		pos[ra.Id] = i
+	}
+	if err := e.Apply(); err != nil {
+		return nil, err
+	}
+
+	at := func(id uint64) (int, *spec.Rule) {
+		i, ok := pos[id]
+		if !ok {
+			return -1, nil
+		}
+		return i, &f.Rules[i]
+	}
+
+	for _, v := range e.Lint() {
+		x := Finding{
+			Kind:         policy.LintName(v.Kind),
+			Pattern:      v.Pattern,
+			OtherPattern: v.OtherPattern,
+			BestEffort:   v.Kind == policy.LINT_OF_OVERLAP,
+		}
+		x.Index, x.Rule = at(v.Rule)
+		x.Other, x.OtherRule = at(v.Other)
+		r = append(r, x)
+	}
+
+	return r, nil
+}
+
+// entries finds the rules of f with the same key, the later one replaces
+// the earlier when installed.
+func entries(f *spec.File) ([]Finding, error) {
+	var r []Finding
+
+	seen := make(map[spec.RuleKey]int, len(f.Rules))
+	for i := range f.Rules {
+		k, err := f.Rules[i].Key()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+
+		j, ok := seen[k]
+		seen[k] = i
+		if !ok {
+			continue
+		}
+
+		_, a, _ := f.Rules[j].Policy()
+		_, b, _ := f.Rules[i].Policy()
+		kind := policy.LINT_OF_DUPLICATE
+		if !reflect.DeepEqual(a, b) {
+			kind = policy.LINT_OF_CONFLICT
+		}
+		r = append(r, Finding{
+			Kind:      policy.LintName(kind),
+			Index:     i,
+			Other:     j,
+			Rule:      &f.Rules[i],
+			OtherRule: &f.Rules[j],
+		})
+	}
+
+	return r, nil
+}
@@ -0,0 +1,121 @@
+package lint
+
+import (
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"reflect"
+	"testing"
+)
+
+// kinds returns the findings of f as kind index other, or the patterns of
+// an overlap.
+func kinds(t *testing.T, f *spec.File) []string {
+	t.Helper()
+
+	fs, err := Lint(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r []string
+	for _, v := range fs {
+		if v.BestEffort != (v.Kind == policy.LintName(policy.LINT_OF_OVERLAP)) {
+			t.Errorf("%s best effort %v", v.Kind, v.BestEffort)
+		}
+		if v.Pattern != "" && v.Index < 0 {
+			r = append(r, fmt.Sprintf("%s %s %s", v.Kind, v.Pattern, v.OtherPattern))
+			continue
+		}
+		r = append(r, fmt.Sprintf("%s %d %d", v.Kind, v.Index, v.Other))
+	}
+
+	return r
+}
+
+func TestLint(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		rules []spec.Rule
+		want  []string
+	}{
+		{"clean", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "10.1.0.0/16", Port: 80, Path: "/a", Action: "pass"},
+		}, nil},
+		{"shadowed", []spec.Rule{
+			{Cidr: "0.0.0.0/0", Workload: 3, Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "0.0.0.0/0", Workload: 3, Role: 2, Port: 80, Path: "/a", Action: "pass"},
+		}, []string{"shadowed 1 0"}},
+		{"shadowed by the same action", []spec.Rule{
+			{Cidr: "0.0.0.0/0", Workload: 3, Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "0.0.0.0/0", Workload: 3, Role: 2, Port: 80, Path: "/a", Action: "drop"},
+		}, []string{"duplicate 1 0"}},
+		{"repeated", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+		}, []string{"duplicate 1 0"}},
+		{"conflict", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "pass"},
+		}, []string{"conflict 1 0"}},
+		{"overlap", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a.*", Action: "drop"},
+		}, []string{"overlap /a /a.*"}},
+		{"overlap of different actions", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a", Action: "drop"},
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/a.*", Action: "pass"},
+		}, []string{"overlap /a /a.*", "conflict 0 1"}},
+		// best effort, /api/admin matches both
+		{"missed overlap", []spec.Rule{
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/api/.*", Action: "drop"},
+			{Cidr: "10.0.0.0/8", Port: 80, Path: "/.*/admin", Action: "drop"},
+		}, nil},
+	} {
+		got := kinds(t, &spec.File{Rules: c.rules})
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: findings %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLintPartial(t *testing.T) {
+	f := &spec.File{Rules: []spec.Rule{
+		{Cidr: "10.0.0.0/8", Port: 80, Paths: []string{"/a", "/b"}, Action: "drop"},
+		{Cidr: "10.0.0.0/8", Port: 80, Path: "/c", Action: "pass"},
+		{Cidr: "10.0.0.0/8", Port: 80, Paths: []string{"/b", "/c"}, Action: "pass"},
+	}}
+
+	fs, err := Lint(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, v := range fs {
+		if v.Kind != policy.LintName(policy.LINT_OF_PARTIAL) {
+			continue
+		}
+		n++
+		if v.Index != 2 || v.Other != 0 {
+			t.Errorf("partial %d of %d, want 2 of 0", v.Index, v.Other)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("%d partial findings in %+v, want 1", n, fs)
+	}
+}
+
+func TestLintGroups(t *testing.T) {
+	f := &spec.File{
+		Groups: []spec.NamedGroup{{Kind: "addr", Name: "lan", Cidrs: []string{"10.0.0.0/8"}}},
+		Rules: []spec.Rule{
+			{AddrGroup: "lan", Port: 80, Path: "/a", Action: "drop"},
+			{AddrGroup: "lan", Port: 80, Path: "/a", Action: "pass"},
+		},
+	}
+	if got, want := kinds(t, f), []string{"conflict 1 0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findings %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	DEFAULT_LOOKUP_BUCKETS = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 1e-3, 1e-2}
+	DEFAULT_APPLY_BUCKETS  = []float64{1e-3, 1e-2, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// histogram is a lock free prometheus histogram, counts are not cumulative
+// until written out.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // one per bound plus +Inf
+	sum    uint64   // float64 bits
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for ; i < len(h.bounds); i++ {
+		if v <= h.bounds[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, n) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// write emits the samples of h, labels is either empty or `k="v",` pairs
+// ending with a comma.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cum uint64
+
+	for i, b := range h.bounds {
+		cum += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(b), cum)
+	}
+	cum += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, cum)
+
+	labels = trimLabels(labels)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, atomic.LoadUint64(&h.count))
+}
+
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
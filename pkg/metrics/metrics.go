@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"l7/pkg/policy"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_RESULT_OF_HIT uint8 = iota
+	METRICS_RESULT_OF_MISS
+	METRICS_RESULT_OF_DEFAULT
+	METRICS_RESULT_OF_MAX
+)
+
+var resultNames = [METRICS_RESULT_OF_MAX]string{"hit", "miss", "default"}
+
+// Exporter is a policy.Observer serving its numbers in the prometheus text
+// format, mount it on /metrics.
+type Exporter struct {
+	lookup    [2]*histogram // l7, l3
+	decisions [METRICS_RESULT_OF_MAX][policy.POLICY_ACTION_OF_MAX]uint64
+	throttled uint64
+
+	apply         *histogram
+	applyFailures uint64
+
+	// rule counts of the observed engine unless replaced
+	Chains   func() []policy.Chain
+	Patterns func() int
+}
+
+func NewExporter(pe *policy.Engine) *Exporter {
+	return &Exporter{
+		lookup: [2]*histogram{
+			newHistogram(DEFAULT_LOOKUP_BUCKETS),
+			newHistogram(DEFAULT_LOOKUP_BUCKETS),
+		},
+		apply:    newHistogram(DEFAULT_APPLY_BUCKETS),
+		Chains:   pe.Chains,
+		Patterns: pe.Patterns,
+	}
+}
+
+// Register creates an exporter observing the default policy.
+func Register() *Exporter {
+	e := NewExporter(policy.Default())
+	policy.PolicyAddObserver(e)
+
+	return e
+}
+
+func (e *Exporter) OnLookup(ev *policy.LookupEvent) {
+	path := 0
+	if ev.L3 {
+		path = 1
+	}
+	e.lookup[path].observe(ev.Duration.Seconds())
+
+	r := METRICS_RESULT_OF_HIT
+	if ev.Result.Kind == policy.POLICY_RESULT_OF_DEFAULT {
+		r = METRICS_RESULT_OF_DEFAULT
+		if uint8(ev.Result.Action) == policy.POLICY_ACTION_OF_UNKNOWN {
+			r = METRICS_RESULT_OF_MISS
+		}
+	}
+	if a := uint8(ev.Result.Action); a < policy.POLICY_ACTION_OF_MAX {
+		atomic.AddUint64(&e.decisions[r][a], 1)
+	}
+	if ev.Result.Throttled {
+		atomic.AddUint64(&e.throttled, 1)
+	}
+}
+
+func (e *Exporter) OnApply(d time.Duration, err error) {
+	e.apply.observe(d.Seconds())
+	if err != nil {
+		atomic.AddUint64(&e.applyFailures, 1)
+	}
+}
+
+func (e *Exporter) Expose(w io.Writer) {
+	fmt.Fprintln(w, "# HELP l7policy_lookup_duration_seconds Policy decision latency.")
+	fmt.Fprintln(w, "# TYPE l7policy_lookup_duration_seconds histogram")
+	e.lookup[0].write(w, "l7policy_lookup_duration_seconds", `path="l7",`)
+	e.lookup[1].write(w, "l7policy_lookup_duration_seconds", `path="l3",`)
+
+	fmt.Fprintln(w, "# HELP l7policy_decisions_total Policy decisions by result and action.")
+	fmt.Fprintln(w, "# TYPE l7policy_decisions_total counter")
+	for r := range e.decisions {
+		for a := range e.decisions[r] {
+			fmt.Fprintf(w, "l7policy_decisions_total{result=%q,action=%q} %d\n",
+				resultNames[r], policy.Action(a), atomic.LoadUint64(&e.decisions[r][a]))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP l7policy_throttled_total Decisions dropped by a rule rate limit.")
+	fmt.Fprintln(w, "# TYPE l7policy_throttled_total counter")
+	fmt.Fprintf(w, "l7policy_throttled_total %d\n", atomic.LoadUint64(&e.throttled))
+
+	cs := e.Chains()
+	fmt.Fprintln(w, "# HELP l7policy_rules Installed rules by table and priority chain.")
+	fmt.Fprintln(w, "# TYPE l7policy_rules gauge")
+	for _, c := range cs {
+		fmt.Fprintf(w, "l7policy_rules{table=%q,chain=\"%d\"} %d\n", table(&c), c.Prio, c.Rules)
+	}
+
+	fmt.Fprintln(w, "# HELP l7policy_chain_hits_total Lookups decided by a rule of the chain.")
+	fmt.Fprintln(w, "# TYPE l7policy_chain_hits_total counter")
+	for _, c := range cs {
+		fmt.Fprintf(w, "l7policy_chain_hits_total{table=%q,chain=\"%d\"} %d\n", table(&c), c.Prio, c.Hits)
+	}
+
+	fmt.Fprintln(w, "# HELP l7policy_uri_patterns Registered uri patterns.")
+	fmt.Fprintln(w, "# TYPE l7policy_uri_patterns gauge")
+	fmt.Fprintf(w, "l7policy_uri_patterns %d\n", e.Patterns())
+
+	fmt.Fprintln(w, "# HELP l7policy_apply_duration_seconds Uri pattern compile time.")
+	fmt.Fprintln(w, "# TYPE l7policy_apply_duration_seconds histogram")
+	e.apply.write(w, "l7policy_apply_duration_seconds", "")
+
+	fmt.Fprintln(w, "# HELP l7policy_apply_failures_total Failed uri pattern compiles.")
+	fmt.Fprintln(w, "# TYPE l7policy_apply_failures_total counter")
+	fmt.Fprintf(w, "l7policy_apply_failures_total %d\n", atomic.LoadUint64(&e.applyFailures))
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	e.Expose(bw)
+	bw.Flush()
+}
+
+func table(c *policy.Chain) string {
+	if c.L3 {
+		return "l3"
+	}
+
+	return "l7"
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"io"
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestScrape(t *testing.T) {
+	ex := Register()
+	defer policy.PolicyDeleteAll()
+
+	arg := &policy.PolicyOpPara{
+		Cidr:    "10.0.0.0/8",
+		Dir:     base.L7_INGRESS,
+		Type:    base.SERVICE_OF_HTTP,
+		Proto:   6,
+		Port:    80,
+		Httpath: "/a",
+	}
+	if err := policy.PolicyAdd(arg, policy.Action(policy.POLICY_ACTION_OF_DROP)); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.ApplyRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := policy.ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	in := &base.Client{Ip: netip.MustParseAddr("10.1.1.1")}
+	out := &base.Client{Ip: netip.MustParseAddr("192.168.1.1")}
+	policy.PolicyDecide(in, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	policy.PolicyDecide(in, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	policy.PolicyDecide(out, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	k := &policy.DefaultKey{Dir: base.L7_INGRESS}
+	policy.PolicyDefaultSet(k, policy.Action(policy.POLICY_ACTION_OF_PASS))
+	defer policy.PolicyDefaultDel(k)
+	policy.PolicyDecide(out, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	// a lookup without the defaults is observed too
+	if r, _ := policy.PolicyLookup(in, base.L7_INGRESS, base.HTTP_GET, &as[0]); r == nil {
+		t.Fatal("lookup missed")
+	}
+
+	ts := httptest.NewServer(ex)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, l := range []string{
+		`l7policy_decisions_total{result="hit",action="drop"} 3`,
+		`l7policy_decisions_total{result="miss",action="unknown"} 1`,
+		`l7policy_decisions_total{result="default",action="pass"} 1`,
+		`l7policy_lookup_duration_seconds_count{path="l3"} 5`,
+		`l7policy_rules{table="l3",chain="0"} 1`,
+		`l7policy_chain_hits_total{table="l3",chain="0"} 3`,
+		`l7policy_uri_patterns 1`,
+		`l7policy_apply_duration_seconds_count 1`,
+		`l7policy_apply_failures_total 0`,
+		"# TYPE l7policy_decisions_total counter",
+	} {
+		if !strings.Contains(body, l+"\n") {
+			t.Errorf("missing %q in\n%s", l, body)
+		}
+	}
+}
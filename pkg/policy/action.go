@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/ratelimit"
+	"net/http"
+)
+
+var actionNames = [POLICY_ACTION_OF_MAX]string{
+	"unknown",
+	"pass",
+	"drop",
+	"audit",
+	"reject",
+	"ratelimit",
+	"redirect",
+	"mtls",
+}
+
+func (a Action) String() string {
+	if uint8(a) >= POLICY_ACTION_OF_MAX {
+		return fmt.Sprintf("action(%d)", uint8(a))
+	}
+
+	return actionNames[a]
+}
+
+func ParseAction(s string) (Action, error) {
+	for i, v := range actionNames {
+		if v == s {
+			return Action(i), nil
+		}
+	}
+
+	return Action(POLICY_ACTION_OF_UNKNOWN), fmt.Errorf("unknown action %q", s)
+}
+
+func (ra *RuleAttr) check() error {
+	switch uint8(ra.Action) {
+	case POLICY_ACTION_OF_REJECT:
+		if ra.Reject == nil || ra.Reject.Status < 100 || ra.Reject.Status > 599 {
+			return fmt.Errorf("reject action needs a valid http status")
+		}
+	case POLICY_ACTION_OF_REDIRECT:
+		if ra.Redirect == nil || ra.Redirect.Location == "" {
+			return fmt.Errorf("redirect action needs a location")
+		}
+		if ra.Redirect.Status != 0 && (ra.Redirect.Status < 300 || ra.Redirect.Status > 399) {
+			return fmt.Errorf("invalid redirect status(%d)", ra.Redirect.Status)
+		}
+	case POLICY_ACTION_OF_RATELIMIT:
+		if ra.RateLimit == nil || ra.RateLimit.Rate == 0 {
+			return fmt.Errorf("ratelimit action needs a rate")
+		}
+		if ra.RateLimit.Key >= ratelimit.RATELIMIT_KEY_OF_MAX {
+			return fmt.Errorf("invalid ratelimit key(%d)", ra.RateLimit.Key)
+		}
+	default:
+		if uint8(ra.Action) >= POLICY_ACTION_OF_MAX {
+			return fmt.Errorf("invalid action(%d)", ra.Action)
+		}
+	}
+
+	if ra.Except != nil {
+		return ra.Except.compile()
+	}
+
+	return nil
+}
+
+// Audit reports whether the decision should be logged.
+func (r *Result) Audit() bool {
+	return uint8(r.Action) == POLICY_ACTION_OF_AUDIT
+}
+
+// Allowed reports whether the request may go on, an unknown action (no rule
+// and no default) is left to the caller and treated as allowed here.
+func (r *Result) Allowed(req *http.Request) bool {
+	switch uint8(r.Action) {
+	case POLICY_ACTION_OF_DROP, POLICY_ACTION_OF_REJECT, POLICY_ACTION_OF_REDIRECT:
+		return false
+	case POLICY_ACTION_OF_MTLS:
+		return req != nil && req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+	}
+
+	return true
+}
+
+// Enforce writes the answer for a denied request, it returns true when the
+// request may be passed to the upstream handler.
+func (r *Result) Enforce(w http.ResponseWriter, req *http.Request) bool {
+	if r.Allowed(req) {
+		return true
+	}
+
+	if r.Throttled {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+
+	switch uint8(r.Action) {
+	case POLICY_ACTION_OF_REJECT:
+		if r.Rule != nil && r.Rule.Reject != nil {
+			w.WriteHeader(int(r.Rule.Reject.Status))
+			fmt.Fprint(w, r.Rule.Reject.Body)
+			return false
+		}
+	case POLICY_ACTION_OF_REDIRECT:
+		if r.Rule != nil && r.Rule.Redirect != nil {
+			status := int(r.Rule.Redirect.Status)
+			if status == 0 {
+				status = http.StatusFound
+			}
+			http.Redirect(w, req, r.Rule.Redirect.Location, status)
+			return false
+		}
+	case POLICY_ACTION_OF_MTLS:
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return false
+	}
+
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
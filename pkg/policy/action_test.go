@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"l7/pkg/base"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseAction(t *testing.T) {
+	for i := uint8(0); i < POLICY_ACTION_OF_MAX; i++ {
+		a, err := ParseAction(Action(i).String())
+		if err != nil || uint8(a) != i {
+			t.Errorf("%s parsed to %d, %v", Action(i), a, err)
+		}
+	}
+	if _, err := ParseAction("allow"); err == nil {
+		t.Error("allow parsed")
+	}
+}
+
+func TestActionParameters(t *testing.T) {
+	defer PolicyDeleteAll()
+
+	arg := &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/a"}
+	for _, ra := range []*RuleAttr{
+		{Action: Action(POLICY_ACTION_OF_REJECT)},
+		{Action: Action(POLICY_ACTION_OF_REJECT), Reject: &RejectPara{Status: 600}},
+		{Action: Action(POLICY_ACTION_OF_REDIRECT), Redirect: &RedirectPara{Status: 302}},
+		{Action: Action(POLICY_ACTION_OF_REDIRECT), Redirect: &RedirectPara{Status: 200, Location: "/b"}},
+		{Action: Action(POLICY_ACTION_OF_RATELIMIT), RateLimit: &RateLimitPara{Burst: 1}},
+		{Action: Action(POLICY_ACTION_OF_MAX)},
+	} {
+		if err := PolicyAddAttr(arg, ra); err == nil {
+			t.Errorf("added %s with %+v %+v %+v", ra.Action, ra.Reject, ra.Redirect, ra.RateLimit)
+		}
+	}
+
+	ra := &RuleAttr{Action: Action(POLICY_ACTION_OF_REJECT), Reject: &RejectPara{Status: 451, Body: "gone"}}
+	if err := PolicyAddAttr(arg, ra); err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	r := PolicyDecide(c, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	if r.Rule == nil || r.Rule.Reject == nil || r.Rule.Reject.Status != 451 {
+		t.Fatalf("decision %+v without the reject of its rule", r)
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+	for _, c := range []struct {
+		name     string
+		r        Result
+		tls      *tls.ConnectionState
+		allowed  bool
+		status   int
+		body     string
+		location string
+	}{
+		{name: "pass", r: Result{Action: Action(POLICY_ACTION_OF_PASS)}, allowed: true},
+		{name: "audit", r: Result{Action: Action(POLICY_ACTION_OF_AUDIT)}, allowed: true},
+		{name: "ratelimit", r: Result{Action: Action(POLICY_ACTION_OF_RATELIMIT)}, allowed: true},
+		{name: "no rule", r: Result{Kind: POLICY_RESULT_OF_DEFAULT}, allowed: true},
+		{name: "drop", r: Result{Action: Action(POLICY_ACTION_OF_DROP)}, status: http.StatusForbidden},
+		{name: "reject", r: Result{Action: Action(POLICY_ACTION_OF_REJECT), Rule: &RuleAttr{
+			Reject: &RejectPara{Status: 451, Body: "gone"}}}, status: 451, body: "gone"},
+		{name: "default reject", r: Result{Kind: POLICY_RESULT_OF_DEFAULT, Action: Action(POLICY_ACTION_OF_REJECT)},
+			status: http.StatusForbidden},
+		{name: "redirect", r: Result{Action: Action(POLICY_ACTION_OF_REDIRECT), Rule: &RuleAttr{
+			Redirect: &RedirectPara{Location: "/login"}}}, status: http.StatusFound, location: "/login"},
+		{name: "redirect status", r: Result{Action: Action(POLICY_ACTION_OF_REDIRECT), Rule: &RuleAttr{
+			Redirect: &RedirectPara{Status: 307, Location: "/login"}}}, status: 307, location: "/login"},
+		{name: "mtls without a cert", r: Result{Action: Action(POLICY_ACTION_OF_MTLS)}, tls: &tls.ConnectionState{},
+			status: http.StatusUnauthorized},
+		{name: "mtls", r: Result{Action: Action(POLICY_ACTION_OF_MTLS)}, tls: verified, allowed: true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/a", nil)
+		req.TLS = c.tls
+		w := httptest.NewRecorder()
+
+		if ok := c.r.Enforce(w, req); ok != c.allowed {
+			t.Errorf("%s: allowed %v", c.name, ok)
+		}
+		if c.allowed {
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Errorf("%s: allowed request answered %d %q", c.name, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.status)
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Errorf("%s: body %q, want %q", c.name, w.Body, c.body)
+		}
+		if l := w.Header().Get("Location"); l != c.location {
+			t.Errorf("%s: location %q, want %q", c.name, l, c.location)
+		}
+	}
+
+	if !(&Result{Action: Action(POLICY_ACTION_OF_AUDIT)}).Audit() || (&Result{Action: Action(POLICY_ACTION_OF_PASS)}).Audit() {
+		t.Error("audit of audit and pass")
+	}
+}
@@ -2,20 +2,19 @@ package policy
 
 import (
 	"fmt"
-	"l7/pkg/addrobj"
 	"l7/pkg/base"
-	"l7/pkg/net"
-	"l7/pkg/uriobj"
+	"l7/pkg/clock"
+	"time"
 )
 
-var policyCbs PolicyCbs
+var defaultEngine *Engine
 
 func init() {
-	policyCbs.Init()
+	defaultEngine = NewEngine()
 }
 
 type PolicyOpPara struct {
-	Prio     uint8
+	Prio     uint16
 	Cidr     string
 	Workload base.WorkloadId
 	Role     base.WorkRole
@@ -25,115 +24,274 @@ type PolicyOpPara struct {
 	Type     uint8
 	Proto    uint8
 	Port     uint16
+	PortMax  uint16 // last port of a range, 0 for Port only
 	Httpath  string
+	Dst      PolicyOpDst
 }
 
+// PolicyOpSet is a set rule, every combination of its cidrs, methods, paths
+// and services is one cell and the cells are added and deleted as one rule.
+// An empty set takes the single field of PolicyOpPara, a group replaces its
+// set by the members it has when the rule is added or the group is set.
+type PolicyOpSet struct {
+	PolicyOpPara
+	Cidrs    []string
+	Methods  []base.Method
+	Httpaths []string
+	Services []base.ApiService // Type, Proto, Port and PortMax
+
+	AddrGroup string
+	UriGroup  string
+	SvcGroup  string
+}
+
+// PolicyOpDst is the destination of a rule, zero fields match any.
+type PolicyOpDst struct {
+	Cidr     string // empty for any address
+	Workload base.WorkloadId
+	Role     base.WorkRole
+	Group    base.WorkGroup
+}
+
+// Default returns the engine behind the package level functions.
+func Default() *Engine {
+	return defaultEngine
+}
+
+// PolicyLookup finds the rule of a request from c to c.Dst in the engine of
+// c.Tenant, s must come from the ApiServiceBuilderOf the same tenant. A
+// client of an unknown tenant matches nothing.
 func PolicyLookup(c *base.Client,
 	dir base.Direction,
 	method base.Method,
 	s *base.ApiService) (*RuleAttr, int) {
-	policyCbs.RLock()
-	defer policyCbs.RUnlock()
+	return PolicyLookupPath(c, dir, method, s, "")
+}
+
+// PolicyLookupPath is PolicyLookup with the request path, without one the
+// rules with uri excepts never match.
+func PolicyLookupPath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*RuleAttr, int) {
+	e, err := engineOf(c)
+	if err != nil {
+		return nil, 1
+	}
 
-	return policyCbs.Lookup(c, dir, method, s)
+	return e.LookupPath(c, dir, method, s, path)
 }
 
-// cidr format : x.x.x.x/x
-func PolicyAdd(arg *PolicyOpPara, action Action) error {
+// PolicyDecide is PolicyLookup with the default actions applied on a miss,
+// a client of an unknown tenant is dropped.
+func PolicyDecide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService) *Result {
+	return PolicyDecidePath(c, dir, method, s, "")
+}
 
-	ip, ml, err := net.ParseCidr(arg.Cidr)
+func PolicyDecidePath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) *Result {
+	e, err := engineOf(c)
 	if err != nil {
-		return fmt.Errorf("parse cidr failed,%v", err)
+		return unknownTenant()
 	}
 
-	policyCbs.Lock()
-	defer policyCbs.Unlock()
-
-	uri := uriobj.AddUri(arg.Httpath)
-	return policyCbs.Update(&RuleCell{
-		Prio:     arg.Prio,
-		Id:       base.AddrId(addrobj.GetId(ip, ml)),
-		Workload: arg.Workload,
-		Role:     arg.Role,
-		Group:    arg.Group,
-		Dir:      arg.Dir,
-		Method:   arg.Method,
-		Api: base.ApiService{
-			Type:  arg.Type,
-			Proto: arg.Proto,
-			Port:  arg.Port,
-			Uri:   base.UriId(uri),
-		},
-	}, &RuleAttr{
-		Action: action,
-	})
+	return e.DecidePath(c, dir, method, s, path)
 }
 
-func PolicyDel(arg *PolicyOpPara) error {
-	ip, ml, err := net.ParseCidr(arg.Cidr)
+// Evaluate scans path and returns the one decision of the engine of
+// c.Tenant, see Engine.Evaluate.
+func Evaluate(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*Result, error) {
+	e, err := engineOf(c)
 	if err != nil {
-		return fmt.Errorf("parse cidr failed,%v", err)
+		return nil, err
 	}
 
-	uri := uriobj.FindUri(arg.Httpath)
-	if uri == 0 {
-		return fmt.Errorf("httpath not found")
-	}
+	return e.Evaluate(c, dir, method, s, path)
+}
+
+func PolicyDefaultSet(k *DefaultKey, action Action) {
+	defaultEngine.SetDefault(k, action)
+}
+
+func PolicyDefaultDel(k *DefaultKey) {
+	defaultEngine.DelDefault(k)
+}
+
+func PolicyDefaults() map[DefaultKey]Action {
+	return defaultEngine.Defaults()
+}
+
+func PolicySetClock(c clock.Clock) {
+	defaultEngine.SetClock(c)
+}
+
+// cidr format : x.x.x.x/x
+func PolicyAdd(arg *PolicyOpPara, action Action) error {
+	return defaultEngine.Add(arg, action)
+}
+
+func PolicyAddAttr(arg *PolicyOpPara, ra *RuleAttr) error {
+	return defaultEngine.AddAttr(arg, ra)
+}
+
+// PolicyAddSet adds a set rule, the id of the new rule is set in ra.
+func PolicyAddSet(set *PolicyOpSet, ra *RuleAttr) error {
+	return defaultEngine.AddSet(set, ra)
+}
+
+// PolicyUpdateSet replaces rule id by set, the rule keeps its id and stats.
+func PolicyUpdateSet(id uint64, set *PolicyOpSet, ra *RuleAttr) error {
+	return defaultEngine.UpdateSet(id, set, ra)
+}
+
+func PolicyDelSet(set *PolicyOpSet) error {
+	return defaultEngine.DelSet(set)
+}
+
+// PolicyGroupSet adds or replaces a group, rebuilding the rules naming it.
+func PolicyGroupSet(g *Group) error {
+	return defaultEngine.SetGroup(g)
+}
 
-	policyCbs.Lock()
-	defer policyCbs.Unlock()
-
-	return policyCbs.Delete(&RuleCell{
-		Prio:     arg.Prio,
-		Id:       base.AddrId(addrobj.GetId(ip, ml)),
-		Workload: arg.Workload,
-		Role:     arg.Role,
-		Group:    arg.Group,
-		Dir:      arg.Dir,
-		Method:   arg.Method,
-		Api: base.ApiService{
-			Type:  arg.Type,
-			Proto: arg.Proto,
-			Port:  arg.Port,
-			Uri:   base.UriId(uri),
-		},
-	})
+func PolicyGroupDel(kind uint8, name string) error {
+	return defaultEngine.DelGroup(kind, name)
+}
+
+func PolicyGroups() []Group {
+	return defaultEngine.Groups()
+}
+
+func PolicyDel(arg *PolicyOpPara) error {
+	return defaultEngine.Del(arg)
+}
+
+func PolicyDelId(id uint64) error {
+	return defaultEngine.DelId(id)
 }
 
 func PolicyDeleteAll() {
-	policyCbs.Lock()
-	defer policyCbs.Unlock()
+	defaultEngine.DeleteAll()
+}
 
-	policyCbs.DeleteAll()
+func ApplyRules() error {
+	return defaultEngine.Apply()
 }
 
-func ApplyRules() {
-	policyCbs.Lock()
-	defer policyCbs.Unlock()
+func PolicyAddObserver(o Observer) {
+	defaultEngine.AddObserver(o)
+}
 
-	uriobj.Apply()
+func PolicyLens() ([]int, int) {
+	return defaultEngine.Lens()
 }
 
-func Len() string {
-	return policyCbs.Len()
+func PolicyChains() []Chain {
+	return defaultEngine.Chains()
 }
 
-func ApiServiceBuilder(l7type, proto uint8, port uint16, httpath string) ([]base.ApiService, error) {
-	var as []base.ApiService
+func PolicyScheduleTick() int {
+	return defaultEngine.ScheduleTick()
+}
+
+func PolicySchedule(interval time.Duration, stop <-chan struct{}) {
+	defaultEngine.Schedule(interval, stop)
+}
+
+func PolicyGeneration() uint64 {
+	return defaultEngine.Generation()
+}
+
+func PolicyGet(id uint64) (Rule, error) {
+	return defaultEngine.Get(id)
+}
+
+func PolicyDump() []Rule {
+	return defaultEngine.Dump()
+}
+
+func PolicyStats(id uint64) (RuleStats, error) {
+	return defaultEngine.Stats(id)
+}
+
+// PolicyAddBytes adds the n bytes of a request or an answer to the stats of
+// rule id, the caller knows the sizes the engine never sees.
+func PolicyAddBytes(id uint64, n uint64) error {
+	return defaultEngine.AddBytes(id, n)
+}
+
+func PolicyStatsReset(id uint64) error {
+	return defaultEngine.StatsReset(id)
+}
+
+func PolicyStatsResetAll() {
+	defaultEngine.StatsResetAll()
+}
 
-	r, err := uriobj.Scan([]byte(httpath))
+func PolicyIdleRules(d time.Duration) []Rule {
+	return defaultEngine.IdleRules(d)
+}
+
+func PolicyExplain(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	l7type, proto uint8,
+	port uint16,
+	httpath string) ([]Explanation, error) {
+	e, err := engineOf(c)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, v := range r {
-		as = append(as, base.ApiService{
-			Type:  l7type,
-			Proto: proto,
-			Port:  port,
-			Uri:   base.UriId(v.Id),
-		})
+	return e.Explain(c, dir, method, l7type, proto, port, httpath)
+}
+
+// PolicyShadow returns the candidate rule set of the default policy.
+func PolicyShadow() *Engine {
+	return defaultEngine.Shadow()
+}
+
+func PolicyShadowDrop() {
+	defaultEngine.DropShadow()
+}
+
+func PolicyShadowReport() ShadowReport {
+	return defaultEngine.ShadowReport()
+}
+
+func PolicyShadowReset() {
+	defaultEngine.ShadowReset()
+}
+
+func PolicyPromote() error {
+	return defaultEngine.Promote()
+}
+
+func Len() string {
+	return defaultEngine.Len()
+}
+
+func ApiServiceBuilder(l7type, proto uint8, port uint16, httpath string) ([]base.ApiService, error) {
+	return defaultEngine.ApiServices(l7type, proto, port, httpath)
+}
+
+// ApiServiceBuilderOf is ApiServiceBuilder in the engine of tenant id, the
+// uri ids of one tenant mean nothing to another.
+func ApiServiceBuilderOf(id base.TenantId, l7type, proto uint8, port uint16, httpath string) ([]base.ApiService, error) {
+	e, ok := TenantEngine(id)
+	if !ok {
+		return nil, fmt.Errorf("tenant %d not found", id)
 	}
 
-	return as, nil
+	return e.ApiServices(l7type, proto, port, httpath)
 }
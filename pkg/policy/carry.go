@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"fmt"
+)
+
+// matchKey names what rule r matches, it is the same in every engine the
+// rule is built in.
+func (r *Rule) matchKey() string {
+	if r.Set != nil {
+		return setKey(r.Set)
+	}
+
+	return setKey(&PolicyOpSet{PolicyOpPara: r.Para})
+}
+
+func setKey(set *PolicyOpSet) string {
+	return fmt.Sprintf("%v", *set)
+}
+
+// Next returns an empty engine with the quota and clock of e. The rules
+// added to it as sets take the ids of the rules of e that match alike, the
+// others new ids, so that Replace keeps the ids callers know.
+func (e *Engine) Next() *Engine {
+	e.RLock()
+	defer e.RUnlock()
+
+	n := NewEngine()
+	p := n.cbs
+	p.SetQuota(&e.cbs.quota)
+	p.SetClock(e.cbs.clock)
+	p.id = e.cbs.id
+	p.prior = make(map[string]uint64, len(e.cbs.rules))
+	for id, r := range e.cbs.rules {
+		p.prior[r.matchKey()] = id
+	}
+
+	return n
+}
+
+// nextId returns the id of a rule matching set, the one of the rule it
+// replaces if the engine comes from Next.
+func (p *PolicyCbs) nextId(set *PolicyOpSet) uint64 {
+	k := setKey(set)
+	if id, ok := p.prior[k]; ok {
+		delete(p.prior, k)
+		return id
+	}
+
+	p.id++
+	return p.id
+}
+
+// carry moves into p what the rules of live have gathered, for the rules
+// of p with the same id and match: their stats and creation time. The rate
+// limit buckets and the clock follow too, live is left without buckets.
+func (p *PolicyCbs) carry(live *PolicyCbs) {
+	for id, r := range p.rules {
+		o, ok := live.rules[id]
+		if !ok || o.matchKey() != r.matchKey() {
+			continue
+		}
+		r.Attr.Stats = o.Attr.Stats.Load()
+		r.Created = o.Created
+	}
+
+	p.SetClock(live.clock)
+	p.rl.Take(&live.rl)
+	p.prior = nil
+}
@@ -0,0 +1,186 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"sort"
+	"sync/atomic"
+)
+
+// Chain is one priority of the l3 or l7 rules. The chains are looked up from
+// the lowest Prio on, and by specificity within a chain.
+type Chain struct {
+	L3    bool
+	Prio  uint16
+	Rules int
+	Hits  uint64 // lookups decided by a rule of the chain
+}
+
+type l3Chain struct {
+	L3PolicyCbs
+	prio uint16
+	hits uint64 // read atomically
+}
+
+type l7Chain struct {
+	L7PolicyCbs
+	prio uint16
+	hits uint64 // read atomically
+}
+
+// keyIndex counts the source addresses, destinations and services the keys
+// of a chain name, a lookup skips the ones no key has instead of trying
+// every combination. It changes under the engine write lock only, lookups
+// read it unlocked.
+type keyIndex struct {
+	ids  map[base.AddrId]int
+	dsts map[DstKey]int
+	svcs map[keySvc]int
+}
+
+type keySvc struct {
+	proto         uint8
+	port, portMax uint16
+}
+
+func (x *keyIndex) init() {
+	x.ids = make(map[base.AddrId]int)
+	x.dsts = make(map[DstKey]int)
+	x.svcs = make(map[keySvc]int)
+}
+
+func (x *keyIndex) add(id base.AddrId, d DstKey, s *base.ApiService) {
+	x.ids[id]++
+	x.dsts[d]++
+	x.svcs[keySvc{s.Proto, s.Port, s.PortMax}]++
+}
+
+func (x *keyIndex) del(id base.AddrId, d DstKey, s *base.ApiService) {
+	if x.ids[id]--; x.ids[id] <= 0 {
+		delete(x.ids, id)
+	}
+	if x.dsts[d]--; x.dsts[d] <= 0 {
+		delete(x.dsts, d)
+	}
+	k := keySvc{s.Proto, s.Port, s.PortMax}
+	if x.svcs[k]--; x.svcs[k] <= 0 {
+		delete(x.svcs, k)
+	}
+}
+
+func (x *keyIndex) hasId(id base.AddrId) bool {
+	return x.ids[id] != 0
+}
+
+func (x *keyIndex) hasDst(d DstKey) bool {
+	return x.dsts[d] != 0
+}
+
+func (x *keyIndex) hasSvc(s *base.ApiService) bool {
+	return x.svcs[keySvc{s.Proto, s.Port, s.PortMax}] != 0
+}
+
+// l3Chain returns the chain of prio, created if asked to.
+func (p *PolicyCbs) l3Chain(prio uint16, create bool) *l3Chain {
+	i := sort.Search(len(p.l3), func(i int) bool { return p.l3[i].prio >= prio })
+	if i < len(p.l3) && p.l3[i].prio == prio {
+		return p.l3[i]
+	}
+	if !create {
+		return nil
+	}
+
+	v := &l3Chain{prio: prio}
+	v.Init()
+	p.l3 = append(p.l3, nil)
+	copy(p.l3[i+1:], p.l3[i:])
+	p.l3[i] = v
+
+	return v
+}
+
+func (p *PolicyCbs) l7Chain(prio uint16, create bool) *l7Chain {
+	i := sort.Search(len(p.l7), func(i int) bool { return p.l7[i].prio >= prio })
+	if i < len(p.l7) && p.l7[i].prio == prio {
+		return p.l7[i]
+	}
+	if !create {
+		return nil
+	}
+
+	v := &l7Chain{prio: prio}
+	v.Init()
+	p.l7 = append(p.l7, nil)
+	copy(p.l7[i+1:], p.l7[i:])
+	p.l7[i] = v
+
+	return v
+}
+
+// prune drops the empty chains, so that lookups skip them.
+func (p *PolicyCbs) prune() {
+	l3 := p.l3[:0]
+	for _, v := range p.l3 {
+		if v.Len() != 0 {
+			l3 = append(l3, v)
+		}
+	}
+	for i := len(l3); i < len(p.l3); i++ {
+		p.l3[i] = nil
+	}
+	p.l3 = l3
+
+	l7 := p.l7[:0]
+	for _, v := range p.l7 {
+		if v.Len() != 0 {
+			l7 = append(l7, v)
+		}
+	}
+	for i := len(l7); i < len(p.l7); i++ {
+		p.l7[i] = nil
+	}
+	p.l7 = l7
+}
+
+// Chains lists the l3 chains then the l7 ones, in lookup order.
+func (p *PolicyCbs) Chains() []Chain {
+	r := make([]Chain, 0, len(p.l3)+len(p.l7))
+	for _, v := range p.l3 {
+		r = append(r, Chain{
+			L3:    true,
+			Prio:  v.prio,
+			Rules: v.Len(),
+			Hits:  atomic.LoadUint64(&v.hits),
+		})
+	}
+	for _, v := range p.l7 {
+		r = append(r, Chain{
+			Prio:  v.prio,
+			Rules: v.Len(),
+			Hits:  atomic.LoadUint64(&v.hits),
+		})
+	}
+
+	return r
+}
+
+// chainHit counts a lookup decided by v in its chain.
+func (p *PolicyCbs) chainHit(v *Rule) {
+	if v.Cell.Workload == 0 && v.Cell.Role == 0 {
+		if l := p.l3Chain(v.Cell.Prio, false); l != nil {
+			atomic.AddUint64(&l.hits, 1)
+		}
+		return
+	}
+	if l := p.l7Chain(v.Cell.Prio, false); l != nil {
+		atomic.AddUint64(&l.hits, 1)
+	}
+}
+
+func (p *PolicyCbs) chainsReset() {
+	for _, v := range p.l3 {
+		atomic.StoreUint64(&v.hits, 0)
+	}
+	for _, v := range p.l7 {
+		atomic.StoreUint64(&v.hits, 0)
+	}
+}
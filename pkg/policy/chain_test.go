@@ -0,0 +1,53 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+func TestEachSkipsUnusedKeys(t *testing.T) {
+	e := NewEngine()
+
+	set := testSet("/a")
+	set.Cidr, set.Workload = "0.0.0.0/0", 3
+	set.Port, set.PortMax = 8000, 8100
+	set.Dst = PolicyOpDst{Workload: 7}
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(set, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &base.Client{
+		Ip:       netip.MustParseAddr("10.1.2.3"),
+		Workload: 3,
+		Dst: base.Endpoint{
+			Ip:       netip.MustParseAddr("10.9.9.9"),
+			Workload: 7,
+		},
+	}
+	as, err := e.ApiServices(base.SERVICE_OF_HTTP, 6, 8080, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	if r := e.Decide(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r.Rule == nil || r.Rule.Id != a.Id {
+		t.Fatalf("result %+v, want rule %d", r, a.Id)
+	}
+
+	// only the key of the rule is looked up
+	p := e.cbs
+	v := p.l7[0]
+	n := 0
+	k := L7Key{Workload: 3, Dir: base.L7_INGRESS, Api: as[0]}
+	ids := append(p.aoc.Lookup(c.Ip), 0)
+	k.each(&v.keys, ids, dstKeys(&c.Dst, p.dstIds(&c.Dst)), p.ports.Services(&as[0]), func(k *L7Key) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("%d keys tried, want 1", n)
+	}
+}
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"sync"
+)
+
+type DefaultCbs struct {
+	sync.RWMutex
+	db map[DefaultKey]Action
+}
+
+func (p *DefaultCbs) Init() {
+	p.db = make(map[DefaultKey]Action)
+}
+
+// Lookup walks from the most specific fallback (workload, then role) to the
+// per-direction and global ones, L7_ANY matches every direction.
+func (p *DefaultCbs) Lookup(c *base.Client, dir base.Direction) (Action, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, k := range defaultKeyEnumerators(c, dir) {
+		if v, ok := p.db[k]; ok {
+			return v, true
+		}
+	}
+
+	return Action(POLICY_ACTION_OF_UNKNOWN), false
+}
+
+func defaultKeyEnumerators(c *base.Client, dir base.Direction) []DefaultKey {
+	var r []DefaultKey
+
+	if c.Workload != 0 {
+		r = append(r, DefaultKey{Workload: c.Workload, Dir: dir})
+		r = append(r, DefaultKey{Workload: c.Workload, Dir: base.L7_ANY})
+	}
+	if c.Role != 0 {
+		r = append(r, DefaultKey{Role: c.Role, Dir: dir})
+		r = append(r, DefaultKey{Role: c.Role, Dir: base.L7_ANY})
+	}
+	r = append(r, DefaultKey{Dir: dir})
+	r = append(r, DefaultKey{Dir: base.L7_ANY})
+
+	return r
+}
+
+func (p *DefaultCbs) Update(k *DefaultKey, a Action) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.db[*k] = a
+}
+
+func (p *DefaultCbs) Delete(k *DefaultKey) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.db, *k)
+}
+
+func (p *DefaultCbs) DeleteAll() {
+	p.Lock()
+	defer p.Unlock()
+
+	for k := range p.db {
+		delete(p.db, k)
+	}
+}
+
+func (p *DefaultCbs) Dump() map[DefaultKey]Action {
+	p.RLock()
+	defer p.RUnlock()
+
+	r := make(map[DefaultKey]Action, len(p.db))
+	for k, v := range p.db {
+		r[k] = v
+	}
+
+	return r
+}
+
+func (p *DefaultCbs) Len() int {
+	p.RLock()
+	defer p.RUnlock()
+
+	return len(p.db)
+}
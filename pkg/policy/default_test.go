@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+func TestDecideDefault(t *testing.T) {
+	keys := []DefaultKey{
+		{Dir: base.L7_ANY},
+		{Dir: base.L7_EGRESS},
+		{Role: 2, Dir: base.L7_ANY},
+		{Workload: 3, Dir: base.L7_INGRESS},
+	}
+	PolicyDefaultSet(&keys[0], Action(POLICY_ACTION_OF_DROP))
+	PolicyDefaultSet(&keys[1], Action(POLICY_ACTION_OF_PASS))
+	PolicyDefaultSet(&keys[2], Action(POLICY_ACTION_OF_PASS))
+	PolicyDefaultSet(&keys[3], Action(POLICY_ACTION_OF_DROP))
+	defer func() {
+		for i := range keys {
+			PolicyDefaultDel(&keys[i])
+		}
+	}()
+	defer PolicyDeleteAll()
+
+	arg := &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/a"}
+	if err := PolicyAdd(arg, Action(POLICY_ACTION_OF_PASS)); err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	miss := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 81}
+
+	ip := netip.MustParseAddr("10.1.2.3")
+	for _, c := range []struct {
+		name   string
+		c      base.Client
+		dir    base.Direction
+		s      *base.ApiService
+		kind   uint8
+		action uint8
+	}{
+		{"rule", base.Client{Ip: ip}, base.L7_INGRESS, &as[0], POLICY_RESULT_OF_MATCH, POLICY_ACTION_OF_PASS},
+		{"any direction", base.Client{Ip: ip}, base.L7_INGRESS, miss, POLICY_RESULT_OF_DEFAULT, POLICY_ACTION_OF_DROP},
+		{"direction", base.Client{Ip: ip}, base.L7_EGRESS, miss, POLICY_RESULT_OF_DEFAULT, POLICY_ACTION_OF_PASS},
+		{"role before direction", base.Client{Ip: ip, Role: 2}, base.L7_INGRESS, miss, POLICY_RESULT_OF_DEFAULT, POLICY_ACTION_OF_PASS},
+		{"workload before role", base.Client{Ip: ip, Workload: 3, Role: 2}, base.L7_INGRESS, miss, POLICY_RESULT_OF_DEFAULT, POLICY_ACTION_OF_DROP},
+		{"workload of another direction", base.Client{Ip: ip, Workload: 3, Role: 2}, base.L7_EGRESS, miss, POLICY_RESULT_OF_DEFAULT, POLICY_ACTION_OF_PASS},
+	} {
+		r := PolicyDecide(&c.c, c.dir, base.HTTP_GET, c.s)
+		if r.Kind != c.kind || uint8(r.Action) != c.action {
+			t.Errorf("%s: kind %d action %d, want %d %d", c.name, r.Kind, r.Action, c.kind, c.action)
+		}
+		if (r.Rule != nil) != (c.kind == POLICY_RESULT_OF_MATCH) {
+			t.Errorf("%s: rule %v", c.name, r.Rule)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"sync"
+	"time"
+)
+
+// Engine is a complete policy, with its own address objects, uri patterns,
+// tables and defaults. Engines share nothing, so several of them can run
+// side by side.
+type Engine struct {
+	sync.RWMutex
+	cbs *PolicyCbs
+
+	shadow *Engine // candidate rule set, see Shadow
+	diff   ShadowDiff
+}
+
+func NewEngine() *Engine {
+	e := &Engine{cbs: new(PolicyCbs)}
+	e.cbs.Init()
+	e.diff.Init(DEFAULT_SHADOW_RING)
+
+	return e
+}
+
+func (e *Engine) Lookup(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService) (*RuleAttr, int) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Lookup(c, dir, method, s)
+}
+
+// LookupPath is Lookup with the request path the uri excepts need.
+func (e *Engine) LookupPath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*RuleAttr, int) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.LookupPath(c, dir, method, s, path)
+}
+
+// Decide is Lookup with the default actions applied on a miss.
+func (e *Engine) Decide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService) *Result {
+	return e.DecidePath(c, dir, method, s, "")
+}
+
+func (e *Engine) DecidePath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) *Result {
+	e.RLock()
+	defer e.RUnlock()
+
+	r := e.cbs.DecidePath(c, dir, method, s, path)
+	if e.shadow != nil {
+		e.compare(c, dir, method, s, path, r)
+	}
+
+	return r
+}
+
+// Evaluate scans path and returns the one decision of all the uri patterns
+// it matches: a matched rule over a default, then the most specific and
+// longest pattern, then the rule priority, then the most restrictive action.
+func (e *Engine) Evaluate(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*Result, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	r, err := e.cbs.Evaluate(c, dir, method, s, path)
+	if err != nil {
+		return nil, err
+	}
+	if e.shadow != nil {
+		e.compareEval(c, dir, method, s, r.Pattern, path, r)
+	}
+
+	return r, nil
+}
+
+// SetDefault sets the action used when no rule matches, workload and role
+// keys take precedence over the per-direction ones.
+func (e *Engine) SetDefault(k *DefaultKey, action Action) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.SetDefault(k, action)
+}
+
+func (e *Engine) DelDefault(k *DefaultKey) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.DelDefault(k)
+}
+
+func (e *Engine) Defaults() map[DefaultKey]Action {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.def.Dump()
+}
+
+// SetClock replaces the time source of rate limits and schedules, for tests.
+func (e *Engine) SetClock(c clock.Clock) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.SetClock(c)
+	if e.shadow != nil {
+		e.shadow.SetClock(c)
+	}
+}
+
+// SetQuota bounds the rules and uri patterns further adds may create, the
+// rules already added are kept.
+func (e *Engine) SetQuota(q *Quota) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.SetQuota(q)
+}
+
+func (e *Engine) Quota() Quota {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Quota()
+}
+
+// cidr format : x.x.x.x/x
+func (e *Engine) Add(arg *PolicyOpPara, action Action) error {
+	return e.AddAttr(arg, &RuleAttr{
+		Action: action,
+	})
+}
+
+// AddAttr adds a rule whose action carries parameters, e.g. the status of a
+// reject or the location of a redirect. The id of the new rule is set in ra.
+func (e *Engine) AddAttr(arg *PolicyOpPara, ra *RuleAttr) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.AddPara(arg, ra)
+}
+
+// AddSet adds a set rule, see PolicyOpSet. The rules holding one of its
+// cells are replaced as a whole.
+func (e *Engine) AddSet(set *PolicyOpSet, ra *RuleAttr) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.AddSet(set, ra)
+}
+
+// UpdateSet replaces rule id by set keeping its id and stats, see AddSet.
+func (e *Engine) UpdateSet(id uint64, set *PolicyOpSet, ra *RuleAttr) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.UpdateSet(id, set, ra)
+}
+
+// DelSet deletes the rules holding a cell of set.
+func (e *Engine) DelSet(set *PolicyOpSet) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.DelSet(set)
+}
+
+// SetGroup adds or replaces a group, the rules naming it take its new members
+// on the next apply.
+func (e *Engine) SetGroup(g *Group) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.SetGroup(g)
+}
+
+// DelGroup deletes a group no rule names.
+func (e *Engine) DelGroup(kind uint8, name string) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.DelGroup(kind, name)
+}
+
+func (e *Engine) Groups() []Group {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Groups()
+}
+
+func (e *Engine) Del(arg *PolicyOpPara) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.DelPara(arg)
+}
+
+// DelId deletes a rule by the id it got when added.
+func (e *Engine) DelId(id uint64) error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.DelId(id)
+}
+
+func (e *Engine) DeleteAll() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.DeleteAll()
+}
+
+func (e *Engine) Apply() error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.cbs.Apply()
+}
+
+// AddObserver hooks o into every decision and apply, see Observer.
+func (e *Engine) AddObserver(o Observer) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.cbs.AddObserver(o)
+}
+
+func (e *Engine) Lens() ([]int, int) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Lens()
+}
+
+// Chains lists the priority chains in lookup order, l3 first.
+func (e *Engine) Chains() []Chain {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Chains()
+}
+
+// Patterns returns the number of uri patterns.
+func (e *Engine) Patterns() int {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Patterns()
+}
+
+// ScheduleTick brings the scheduled rules in line with the clock, it returns
+// the number of expired rules removed.
+func (e *Engine) ScheduleTick() int {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.shadow != nil {
+		e.shadow.ScheduleTick()
+	}
+
+	return e.cbs.Tick(e.cbs.Now())
+}
+
+// Schedule runs ScheduleTick every interval until stop is closed.
+func (e *Engine) Schedule(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.ScheduleTick()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (e *Engine) Generation() uint64 {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Generation()
+}
+
+func (e *Engine) Get(id uint64) (Rule, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	r, ok := e.cbs.Get(id)
+	if !ok {
+		return r, fmt.Errorf("rule %d not found", id)
+	}
+
+	return r, nil
+}
+
+func (e *Engine) Dump() []Rule {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Dump()
+}
+
+func (e *Engine) Stats(id uint64) (RuleStats, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	r, ok := e.cbs.Stats(id)
+	if !ok {
+		return r, fmt.Errorf("rule %d not found", id)
+	}
+
+	return r, nil
+}
+
+// AddBytes adds the n bytes of a request or an answer to the stats of rule
+// id, the caller knows the sizes the engine never sees.
+func (e *Engine) AddBytes(id uint64, n uint64) error {
+	e.RLock()
+	defer e.RUnlock()
+
+	if !e.cbs.AddBytes(id, n) {
+		return fmt.Errorf("rule %d not found", id)
+	}
+
+	return nil
+}
+
+func (e *Engine) StatsReset(id uint64) error {
+	e.RLock()
+	defer e.RUnlock()
+
+	if !e.cbs.StatsReset(id) {
+		return fmt.Errorf("rule %d not found", id)
+	}
+
+	return nil
+}
+
+func (e *Engine) StatsResetAll() {
+	e.RLock()
+	defer e.RUnlock()
+
+	e.cbs.StatsResetAll()
+}
+
+// IdleRules reports the rules not hit during the last d, for cleanup.
+func (e *Engine) IdleRules(d time.Duration) []Rule {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Idle(e.cbs.Now().Add(-d).UnixNano())
+}
+
+func (e *Engine) Len() string {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Len()
+}
+
+func (e *Engine) ApiServices(l7type, proto uint8, port uint16, httpath string) ([]base.ApiService, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.ApiServices(l7type, proto, port, httpath)
+}
+
+// Explain shows the decision for every uri pattern httpath matches, without
+// counting hits nor taking rate limit tokens.
+func (e *Engine) Explain(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	l7type, proto uint8,
+	port uint16,
+	httpath string) ([]Explanation, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.ExplainPath(c, dir, method, l7type, proto, port, httpath)
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"l7/pkg/uriobj"
+	"net/netip"
+	"regexp"
+)
+
+// Except lists the requests a rule doesn't match although its key does, the
+// lookup goes on with the next keys as if the rule wasn't there.
+type Except struct {
+	Cidrs     []netip.Prefix // of the client
+	Methods   []base.Method
+	Uris      []string // regexes of the request path, without a path any request is excepted
+	Workloads []base.WorkloadId
+	Roles     []base.WorkRole
+	Groups    []base.WorkGroup // zero fields match any
+
+	uris []*regexp.Regexp
+}
+
+// query is a request as the except clauses see it.
+type query struct {
+	c      *base.Client
+	method base.Method
+	path   string
+
+	excepted []uint64 // rules skipped, in lookup order
+}
+
+func (e *Except) compile() error {
+	for _, v := range e.Groups {
+		if v == (base.WorkGroup{}) {
+			return fmt.Errorf("empty except group")
+		}
+	}
+
+	// as the uri patterns they carve out of, case insensitive
+	e.uris = e.uris[:0]
+	for _, v := range e.Uris {
+		re, err := regexp.Compile("(?" + uriobj.DEFAULT_UOC_FLAG + ")" + v)
+		if err != nil {
+			return fmt.Errorf("invalid except uri %q, %v", v, err)
+		}
+		e.uris = append(e.uris, re)
+	}
+
+	return nil
+}
+
+// match tells if q is one of the excepted requests.
+func (e *Except) match(q *query) bool {
+	c := q.c
+	for _, v := range e.Cidrs {
+		if v.Contains(c.Ip) {
+			return true
+		}
+	}
+	for _, v := range e.Methods {
+		if v == q.method {
+			return true
+		}
+	}
+	if len(e.uris) != 0 {
+		// a rule excepting paths can't tell a request without one
+		if q.path == "" {
+			return true
+		}
+		for _, re := range e.uris {
+			if re.MatchString(q.path) {
+				return true
+			}
+		}
+	}
+	for _, v := range e.Workloads {
+		if v == c.Workload {
+			return true
+		}
+	}
+	for _, v := range e.Roles {
+		if v == c.Role {
+			return true
+		}
+	}
+	for _, v := range e.Groups {
+		if (v.App == 0 || v.App == c.Group.App) && (v.Env == 0 || v.Env == c.Group.Env) &&
+			(v.Loc == 0 || v.Loc == c.Group.Loc) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skips tells if ra is excepted for q and records it in q, nil q excepts
+// nothing.
+func (ra *RuleAttr) skips(q *query) bool {
+	if ra.Except == nil || q == nil || !ra.Except.match(q) {
+		return false
+	}
+	for _, id := range q.excepted {
+		if id == ra.Id {
+			return true
+		}
+	}
+	q.excepted = append(q.excepted, ra.Id)
+
+	return true
+}
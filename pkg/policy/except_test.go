@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+func TestExceptUriWithoutPath(t *testing.T) {
+	e := NewEngine()
+
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS), Except: &Except{Uris: []string{"^/a/admin"}}}
+	if err := e.AddSet(testSet("/a"), a); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	e.SetDefault(&DefaultKey{Dir: base.L7_INGRESS}, Action(POLICY_ACTION_OF_DROP))
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	as, err := e.ApiServices(base.SERVICE_OF_HTTP, 6, 80, "/a/admin")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	s := &as[0]
+
+	for _, v := range []struct {
+		path     string
+		kind     uint8
+		excepted bool
+	}{
+		{"/a/x", POLICY_RESULT_OF_MATCH, false},
+		{"/a/admin", POLICY_RESULT_OF_DEFAULT, true},
+		{"/A/Admin/x", POLICY_RESULT_OF_DEFAULT, true}, // as case insensitive as the rule pattern
+		{"", POLICY_RESULT_OF_DEFAULT, true},           // fails closed
+	} {
+		r := e.DecidePath(c, base.L7_INGRESS, base.HTTP_GET, s, v.path)
+		if r.Kind != v.kind {
+			t.Errorf("path %q: result %d, want %d", v.path, r.Kind, v.kind)
+		}
+		if got := len(r.Excepted) == 1 && r.Excepted[0] == a.Id; got != v.excepted {
+			t.Errorf("path %q: excepted %v", v.path, r.Excepted)
+		}
+	}
+	if r, _ := e.Lookup(c, base.L7_INGRESS, base.HTTP_GET, s); r != nil {
+		t.Errorf("lookup without a path matched rule %d", r.Id)
+	}
+}
@@ -0,0 +1,57 @@
+package policy
+
+import "l7/pkg/base"
+
+type Explanation struct {
+	Api     base.ApiService
+	Pattern string // the uri pattern of Api.Uri
+	Result  *Result
+	Final   bool // the one Evaluate returns
+}
+
+// Explain is Decide without side effects, no hit is counted, no rate limit
+// token is taken and no observer is told.
+func (p *PolicyCbs) Explain(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService) *Result {
+	return p.resolve(c, dir, method, s, "", 0)
+}
+
+// ExplainPath shows the decision for every uri pattern httpath matches, the
+// Final one is what Evaluate returns. If none matches, the one explanation
+// is the decision without a pattern.
+func (p *PolicyCbs) ExplainPath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	l7type, proto uint8,
+	port uint16,
+	httpath string) ([]Explanation, error) {
+	as, err := p.ApiServices(l7type, proto, port, httpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(as) == 0 {
+		api := base.ApiService{Type: l7type, Proto: proto, Port: port}
+		return []Explanation{{
+			Api:    api,
+			Result: p.resolve(c, dir, method, &api, httpath, 0),
+			Final:  true,
+		}}, nil
+	}
+
+	rs, at := p.pick(c, dir, method, as, httpath)
+
+	r := make([]Explanation, 0, len(as))
+	for i := range as {
+		r = append(r, Explanation{
+			Api:     as[i],
+			Pattern: p.Pattern(as[i].Uri),
+			Result:  rs[i],
+			Final:   i == at,
+		})
+	}
+
+	return r, nil
+}
@@ -0,0 +1,327 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"l7/pkg/net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+const (
+	GROUP_OF_ADDR    uint8 = 1 + iota // cidrs
+	GROUP_OF_URI                      // uri patterns
+	GROUP_OF_SERVICE                  // services
+	GROUP_OF_MAX
+)
+
+var groupNames = [GROUP_OF_MAX]string{"unknown", "addr", "uri", "service"}
+
+func GroupName(kind uint8) string {
+	if kind >= GROUP_OF_MAX {
+		return groupNames[0]
+	}
+
+	return groupNames[kind]
+}
+
+func ParseGroupKind(s string) (uint8, error) {
+	for i := GROUP_OF_ADDR; i < GROUP_OF_MAX; i++ {
+		if strings.EqualFold(groupNames[i], s) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown group kind %q", s)
+}
+
+// Group is a named object set rules take their cidrs, uri patterns or
+// services from, only the members of its kind are used.
+type Group struct {
+	Kind     uint8
+	Name     string
+	Cidrs    []string
+	Uris     []string
+	Services []base.ApiService // Type, Proto, Port and PortMax
+}
+
+type groupKey struct {
+	kind uint8
+	name string
+}
+
+// check validates g and returns a copy holding only its members.
+func (g *Group) check() (*Group, error) {
+	if g.Name == "" {
+		return nil, fmt.Errorf("group without a name")
+	}
+
+	v := &Group{Kind: g.Kind, Name: g.Name}
+	switch g.Kind {
+	case GROUP_OF_ADDR:
+		for _, c := range g.Cidrs {
+			if _, _, err := net.ParseCidr(c); err != nil {
+				return nil, fmt.Errorf("invalid cidr %q, %v", c, err)
+			}
+		}
+		v.Cidrs = append(v.Cidrs, g.Cidrs...)
+	case GROUP_OF_URI:
+		for _, u := range g.Uris {
+			if u == "" {
+				return nil, fmt.Errorf("empty uri pattern")
+			}
+		}
+		v.Uris = append(v.Uris, g.Uris...)
+	case GROUP_OF_SERVICE:
+		for _, s := range g.Services {
+			if err := NormalizePorts(&s); err != nil {
+				return nil, err
+			}
+			v.Services = append(v.Services, base.ApiService{
+				Type:    s.Type,
+				Proto:   s.Proto,
+				Port:    s.Port,
+				PortMax: s.PortMax,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown group kind %d", g.Kind)
+	}
+	if len(v.Cidrs)+len(v.Uris)+len(v.Services) == 0 {
+		return nil, fmt.Errorf("%s group %q has no members", GroupName(g.Kind), g.Name)
+	}
+
+	return v, nil
+}
+
+func (g *Group) copy() Group {
+	return Group{
+		Kind:     g.Kind,
+		Name:     g.Name,
+		Cidrs:    append([]string(nil), g.Cidrs...),
+		Uris:     append([]string(nil), g.Uris...),
+		Services: append([]base.ApiService(nil), g.Services...),
+	}
+}
+
+// names tells if s takes its members from group k.
+func (s *PolicyOpSet) names(k groupKey) bool {
+	switch k.kind {
+	case GROUP_OF_ADDR:
+		return s.AddrGroup == k.name
+	case GROUP_OF_URI:
+		return s.UriGroup == k.name
+	case GROUP_OF_SERVICE:
+		return s.SvcGroup == k.name
+	}
+
+	return false
+}
+
+func (p *PolicyCbs) group(kind uint8, name string) (*Group, error) {
+	g, ok := p.groups[groupKey{kind, name}]
+	if !ok {
+		return nil, fmt.Errorf("%s group %q not found", GroupName(kind), name)
+	}
+
+	return g, nil
+}
+
+// members returns set with the members of the groups it names filled in.
+func (p *PolicyCbs) members(set *PolicyOpSet) (*PolicyOpSet, error) {
+	v := *set
+	if v.AddrGroup != "" {
+		g, err := p.group(GROUP_OF_ADDR, v.AddrGroup)
+		if err != nil {
+			return nil, err
+		}
+		v.Cidrs = g.Cidrs
+	}
+	if v.UriGroup != "" {
+		g, err := p.group(GROUP_OF_URI, v.UriGroup)
+		if err != nil {
+			return nil, err
+		}
+		v.Httpaths = g.Uris
+	}
+	if v.SvcGroup != "" {
+		g, err := p.group(GROUP_OF_SERVICE, v.SvcGroup)
+		if err != nil {
+			return nil, err
+		}
+		v.Services = g.Services
+	}
+
+	return &v, nil
+}
+
+// SetGroup adds or replaces a group. The rules naming it are rebuilt with the
+// new members at once, they take effect on the next apply. If one of them
+// can't be, nothing changes.
+func (p *PolicyCbs) SetGroup(g *Group) error {
+	v, err := g.check()
+	if err != nil {
+		return err
+	}
+
+	if v.Kind == GROUP_OF_URI && p.quota.Patterns > 0 {
+		n := 0
+		for _, u := range v.Uris {
+			if p.uoc.FindUri(u) == 0 {
+				n++
+			}
+		}
+		if n != 0 && p.uoc.Len()+n > p.quota.Patterns {
+			return fmt.Errorf("uri pattern quota %d exceeded", p.quota.Patterns)
+		}
+	}
+
+	k := groupKey{v.Kind, v.Name}
+	old, ok := p.groups[k]
+	p.groups[k] = v
+
+	rbs, err := p.rebuilds(k)
+	if err != nil {
+		if ok {
+			p.groups[k] = old
+		} else {
+			delete(p.groups, k)
+		}
+		return err
+	}
+	p.bump()
+
+	// the objects of the old cells are held over the rebuild, those still
+	// used keep their ids
+	for i := range rbs {
+		for j := range rbs[i].r.Cells {
+			p.hold(&rbs[i].r.Cells[j])
+		}
+	}
+	for i := range rbs {
+		p.remove(rbs[i].r.Id)
+	}
+	for i := range rbs {
+		v := &rbs[i]
+		if err := p.install(v.r.Set, v.rks, v.paras, nil, v.r.Attr, v.r.Created); err != nil {
+			return fmt.Errorf("rule %d: %v", v.r.Id, err)
+		}
+	}
+	for i := range rbs {
+		for j := range rbs[i].r.Cells {
+			p.release(&rbs[i].r.Cells[j])
+		}
+	}
+
+	return nil
+}
+
+// DelGroup deletes a group no rule names.
+func (p *PolicyCbs) DelGroup(kind uint8, name string) error {
+	if _, err := p.group(kind, name); err != nil {
+		return err
+	}
+
+	k := groupKey{kind, name}
+	if rs := p.referencing(k); len(rs) != 0 {
+		return fmt.Errorf("%s group %q is used by rule %d", GroupName(kind), name, rs[0].Id)
+	}
+	delete(p.groups, k)
+	p.bump()
+
+	return nil
+}
+
+// Groups returns every group by kind and name.
+func (p *PolicyCbs) Groups() []Group {
+	r := make([]Group, 0, len(p.groups))
+	for _, g := range p.groups {
+		r = append(r, g.copy())
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Kind != r[j].Kind {
+			return r[i].Kind < r[j].Kind
+		}
+		return r[i].Name < r[j].Name
+	})
+
+	return r
+}
+
+// referencing returns the rules naming group k by id.
+func (p *PolicyCbs) referencing(k groupKey) []*Rule {
+	var r []*Rule
+	for _, v := range p.rules {
+		if v.Set != nil && v.Set.names(k) {
+			r = append(r, v)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Id < r[j].Id })
+
+	return r
+}
+
+// rebuild is a rule naming a group with its cells as the groups stand now.
+type rebuild struct {
+	r     *Rule
+	rks   []RuleCell
+	paras []PolicyOpPara
+}
+
+// rebuilds returns the new cells of every rule naming group k without
+// changing anything. A rebuild taking a cell of another rule fails, it would
+// replace it.
+func (p *PolicyCbs) rebuilds(k groupKey) ([]rebuild, error) {
+	rs := p.referencing(k)
+	ids := make(map[uint64]bool, len(rs))
+	for _, r := range rs {
+		ids[r.Id] = true
+	}
+
+	var r []rebuild
+	taken := make(map[cellName]uint64)
+	for _, v := range rs {
+		rks, paras, err := p.cells(v.Set)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", v.Id, err)
+		}
+		for i := range rks {
+			if old := p.get(&rks[i]); old != nil && !ids[old.Id] {
+				return nil, fmt.Errorf("rule %d: would replace rule %d", v.Id, old.Id)
+			}
+			n := nameOf(&rks[i], &paras[i])
+			if id, ok := taken[n]; ok && id != v.Id {
+				return nil, fmt.Errorf("rule %d: would replace rule %d", v.Id, id)
+			}
+			taken[n] = v.Id
+		}
+		r = append(r, rebuild{r: v, rks: rks, paras: paras})
+	}
+
+	return r, nil
+}
+
+// cellName tells cells apart before install, when new address objects and
+// uri patterns have no id yet.
+type cellName struct {
+	cell     RuleCell
+	uri      string
+	src, dst netip.Prefix
+}
+
+func nameOf(rk *RuleCell, arg *PolicyOpPara) cellName {
+	v := cellName{cell: *rk, uri: arg.Httpath}
+	v.cell.Api.Uri = 0
+	if rk.Id == addrNew {
+		ip, ml, _ := net.ParseCidr(arg.Cidr)
+		v.cell.Id, v.src = 0, netip.PrefixFrom(ip, int(ml)).Masked()
+	}
+	if rk.Dst.Id == addrNew {
+		ip, ml, _ := net.ParseCidr(arg.Dst.Cidr)
+		v.cell.Dst.Id, v.dst = 0, netip.PrefixFrom(ip, int(ml)).Masked()
+	}
+
+	return v
+}
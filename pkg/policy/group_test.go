@@ -0,0 +1,51 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetGroupAtomic(t *testing.T) {
+	e := NewEngine()
+
+	if err := e.SetGroup(&Group{Kind: GROUP_OF_URI, Name: "api", Uris: []string{"/a", "/b"}}); err != nil {
+		t.Fatal(err)
+	}
+	set := testSet()
+	set.UriGroup = "api"
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(set, a); err != nil {
+		t.Fatal(err)
+	}
+	b := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := e.AddSet(testSet("/c"), b); err != nil {
+		t.Fatal(err)
+	}
+
+	// taking the cell of rule b fails and changes nothing
+	before := e.Groups()
+	if err := e.SetGroup(&Group{Kind: GROUP_OF_URI, Name: "api", Uris: []string{"/a", "/c"}}); err == nil {
+		t.Fatal("group rebuild replaced another rule")
+	}
+	if g := e.Groups(); !reflect.DeepEqual(g, before) {
+		t.Fatalf("groups %v, want %v", g, before)
+	}
+	if r, err := e.Get(a.Id); err != nil || len(r.Cells) != 2 {
+		t.Fatalf("rule %d changed, %v %v", a.Id, r.Cells, err)
+	}
+	if _, err := e.Get(b.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.SetGroup(&Group{Kind: GROUP_OF_URI, Name: "api", Uris: []string{"/a", "/d"}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := e.Get(a.Id)
+	if err != nil || len(r.Cells) != 2 {
+		t.Fatalf("rule %d not rebuilt, %v %v", a.Id, r.Cells, err)
+	}
+	// /b is used by no rule any more
+	if n := e.Patterns(); n != 3 {
+		t.Fatalf("%d patterns, want 3", n)
+	}
+}
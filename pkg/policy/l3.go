@@ -8,33 +8,51 @@ import (
 
 type L3PolicyCbs struct {
 	sync.RWMutex
-	db map[L3Key]*RuleAttr
+	db   map[L3Key]*RuleAttr
+	dsts int // keys naming a destination
+	keys keyIndex
 }
 
 func (p *L3PolicyCbs) Init() {
-	p.db = make(map[L3Key]*RuleAttr, 65536)
+	p.db = make(map[L3Key]*RuleAttr)
+	p.keys.init()
 }
 
-func (p *L3PolicyCbs) Lookup(k *L3Key) (*RuleAttr, error) {
+// Lookup counts a hit at now, a zero now only peeks. A rule excepting q is
+// missed.
+func (p *L3PolicyCbs) Lookup(k *L3Key, q *query, now int64) (*RuleAttr, error) {
 	p.RLock()
 	defer p.RUnlock()
 
 	v, ok := p.db[*k]
-	if !ok {
+	if !ok || atomic.LoadUint32(&v.inactive) != 0 || v.skips(q) {
 		return nil, fmt.Errorf("not found for %v", *k)
 	}
 
-	atomic.AddUint64(&v.Counter, 1)
-	return &RuleAttr{
-		Action:  v.Action,
-		Counter: v.Counter,
-	}, nil
+	if now != 0 {
+		v.Stats.hit(k.Dir, now)
+	}
+	return v.copy(), nil
+}
+
+// get returns the stored attr itself, the caller holds the PolicyCbs lock.
+func (p *L3PolicyCbs) get(k *L3Key) *RuleAttr {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.db[*k]
 }
 
 func (p *L3PolicyCbs) Update(k *L3Key, v *RuleAttr) {
 	p.Lock()
 	defer p.Unlock()
 
+	if _, ok := p.db[*k]; !ok {
+		if k.Dst != (DstKey{}) {
+			p.dsts++
+		}
+		p.keys.add(k.Id, k.Dst, &k.Api)
+	}
 	p.db[*k] = v
 }
 
@@ -42,6 +60,12 @@ func (p *L3PolicyCbs) Delete(k *L3Key) {
 	p.Lock()
 	defer p.Unlock()
 
+	if _, ok := p.db[*k]; ok {
+		if k.Dst != (DstKey{}) {
+			p.dsts--
+		}
+		p.keys.del(k.Id, k.Dst, &k.Api)
+	}
 	delete(p.db, *k)
 }
 
@@ -52,6 +76,8 @@ func (p *L3PolicyCbs) DeleteAll() {
 	for k := range p.db {
 		delete(p.db, k)
 	}
+	p.dsts = 0
+	p.keys.init()
 }
 
 func (p *L3PolicyCbs) Len() int {
@@ -60,3 +86,11 @@ func (p *L3PolicyCbs) Len() int {
 
 	return len(p.db)
 }
+
+// Dsts tells if a key names a destination, if not lookups skip them.
+func (p *L3PolicyCbs) Dsts() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.dsts != 0
+}
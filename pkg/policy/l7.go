@@ -7,33 +7,55 @@ import (
 
 type L7PolicyCbs struct {
 	sync.RWMutex
-	db map[L7Key]*RuleAttr
+	db    map[L7Key]*RuleAttr
+	addrs int // keys naming a source cidr
+	dsts  int // keys naming a destination
+	keys  keyIndex
 }
 
 func (p *L7PolicyCbs) Init() {
-	p.db = make(map[L7Key]*RuleAttr, 65536)
+	p.db = make(map[L7Key]*RuleAttr)
+	p.keys.init()
 }
 
-func (p *L7PolicyCbs) Lookup(k *L7Key) (*RuleAttr, int) {
+// Lookup counts a hit at now, a zero now only peeks. A rule excepting q is
+// missed.
+func (p *L7PolicyCbs) Lookup(k *L7Key, q *query, now int64) (*RuleAttr, int) {
 	p.RLock()
 	defer p.RUnlock()
 
 	v, ok := p.db[*k]
-	if !ok {
+	if !ok || atomic.LoadUint32(&v.inactive) != 0 || v.skips(q) {
 		return nil, 1
 	}
 
-	atomic.AddUint64(&v.Counter, 1)
-	return &RuleAttr{
-		Action:  v.Action,
-		Counter: v.Counter,
-	}, 0
+	if now != 0 {
+		v.Stats.hit(k.Dir, now)
+	}
+	return v.copy(), 0
+}
+
+// get returns the stored attr itself, the caller holds the PolicyCbs lock.
+func (p *L7PolicyCbs) get(k *L7Key) *RuleAttr {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.db[*k]
 }
 
 func (p *L7PolicyCbs) Update(k *L7Key, v *RuleAttr) {
 	p.Lock()
 	defer p.Unlock()
 
+	if _, ok := p.db[*k]; !ok {
+		if k.Id != 0 {
+			p.addrs++
+		}
+		if k.Dst != (DstKey{}) {
+			p.dsts++
+		}
+		p.keys.add(k.Id, k.Dst, &k.Api)
+	}
 	p.db[*k] = v
 }
 
@@ -41,6 +63,15 @@ func (p *L7PolicyCbs) Delete(k *L7Key) {
 	p.Lock()
 	defer p.Unlock()
 
+	if _, ok := p.db[*k]; ok {
+		if k.Id != 0 {
+			p.addrs--
+		}
+		if k.Dst != (DstKey{}) {
+			p.dsts--
+		}
+		p.keys.del(k.Id, k.Dst, &k.Api)
+	}
 	delete(p.db, *k)
 }
 
@@ -51,6 +82,8 @@ func (p *L7PolicyCbs) DeleteAll() {
 	for k := range p.db {
 		delete(p.db, k)
 	}
+	p.addrs, p.dsts = 0, 0
+	p.keys.init()
 }
 
 func (p *L7PolicyCbs) Len() int {
@@ -59,3 +92,20 @@ func (p *L7PolicyCbs) Len() int {
 
 	return len(p.db)
 }
+
+// Addrs tells if a key names a source cidr, if not lookups skip the address
+// objects.
+func (p *L7PolicyCbs) Addrs() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.addrs != 0
+}
+
+// Dsts tells if a key names a destination, if not lookups skip them.
+func (p *L7PolicyCbs) Dsts() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.dsts != 0
+}
@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+// TestIdentityCidr has identity rules match on their source cidr, the
+// identity keys in order and for each the longest cidr first.
+func TestIdentityCidr(t *testing.T) {
+	defer PolicyDeleteAll()
+
+	for _, v := range []struct {
+		cidr     string
+		workload base.WorkloadId
+		role     base.WorkRole
+		action   uint8
+	}{
+		{"0.0.0.0/0", 0, 2, POLICY_ACTION_OF_DROP},
+		{"10.0.0.0/8", 0, 2, POLICY_ACTION_OF_PASS},
+		{"10.1.0.0/16", 0, 2, POLICY_ACTION_OF_AUDIT},
+		{"0.0.0.0/0", 7, 0, POLICY_ACTION_OF_MTLS},
+		{"172.16.0.0/12", 8, 0, POLICY_ACTION_OF_PASS},
+	} {
+		arg := &PolicyOpPara{Cidr: v.cidr, Workload: v.workload, Role: v.role, Dir: base.L7_INGRESS,
+			Method: base.HTTP_GET, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/api"}
+		if err := PolicyAdd(arg, Action(v.action)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ApplyRules()
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/api")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		c      base.Client
+		method base.Method
+		action uint8 // unknown for a miss
+	}{
+		{"longest cidr", base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Role: 2}, base.HTTP_GET, POLICY_ACTION_OF_AUDIT},
+		{"shorter cidr", base.Client{Ip: netip.MustParseAddr("10.2.3.4"), Role: 2}, base.HTTP_GET, POLICY_ACTION_OF_PASS},
+		{"any address", base.Client{Ip: netip.MustParseAddr("192.168.0.1"), Role: 2}, base.HTTP_GET, POLICY_ACTION_OF_DROP},
+		{"workload before role", base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Workload: 7, Role: 2}, base.HTTP_GET, POLICY_ACTION_OF_MTLS},
+		{"workload in its cidr", base.Client{Ip: netip.MustParseAddr("172.16.0.1"), Workload: 8}, base.HTTP_GET, POLICY_ACTION_OF_PASS},
+		{"workload outside its cidr", base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Workload: 8}, base.HTTP_GET, POLICY_ACTION_OF_UNKNOWN},
+		{"without an identity", base.Client{Ip: netip.MustParseAddr("10.1.2.3")}, base.HTTP_GET, POLICY_ACTION_OF_UNKNOWN},
+		{"other method", base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Role: 2}, base.HTTP_POST, POLICY_ACTION_OF_UNKNOWN},
+	} {
+		var a uint8
+		if r, _ := PolicyLookup(&c.c, base.L7_INGRESS, c.method, &as[0]); r != nil {
+			a = uint8(r.Action)
+		}
+		if a != c.action {
+			t.Errorf("%s: action %s, want %s", c.name, Action(a), Action(c.action))
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/net"
+	"reflect"
+	"regexp/syntax"
+	"sort"
+)
+
+const (
+	LINT_OF_SHADOWED  uint8 = 1 + iota // Rule never fires, Other always matches first
+	LINT_OF_DUPLICATE                  // shadowed by a rule doing the same
+	LINT_OF_CONFLICT                   // same precedence, different actions
+	LINT_OF_OVERLAP                    // both patterns match one path, best effort
+	LINT_OF_PARTIAL                    // Rule holds part of the cells of Other, see OverlapError
+	LINT_OF_MAX
+)
+
+var lintNames = [LINT_OF_MAX]string{"unknown", "shadowed", "duplicate", "conflict", "overlap", "partial"}
+
+func LintName(kind uint8) string {
+	if kind >= LINT_OF_MAX {
+		return lintNames[0]
+	}
+
+	return lintNames[kind]
+}
+
+type Finding struct {
+	Kind         uint8
+	Rule         uint64 // 0 for an overlap
+	Other        uint64
+	Pattern      string
+	OtherPattern string
+}
+
+// Lint checks the rule set statically, the uri patterns must be applied.
+// Scheduled rules and rules with excepts may be shadowed but never shadow
+// others.
+func (e *Engine) Lint() []Finding {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.cbs.Lint()
+}
+
+func (p *PolicyCbs) Lint() []Finding {
+	var r []Finding
+
+	overlaps := p.overlaps()
+	r = append(r, overlaps...)
+
+	ids := make([]uint64, 0, len(p.rules))
+	for id := range p.rules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		v := p.rules[id]
+		if w, same := p.shadowing(v); w != nil {
+			kind := LINT_OF_SHADOWED
+			if same {
+				kind = LINT_OF_DUPLICATE
+			}
+			r = append(r, Finding{Kind: kind, Rule: id, Other: w.Id})
+		}
+	}
+
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			ra, rb := p.rules[a], p.rules[b]
+			if ra.Attr.Action == rb.Attr.Action {
+				continue
+			}
+			ca, cb := p.rivalCells(ra, rb, overlaps)
+			if ca == nil {
+				continue
+			}
+			r = append(r, Finding{
+				Kind:         LINT_OF_CONFLICT,
+				Rule:         a,
+				Other:        b,
+				Pattern:      p.Pattern(ca.Api.Uri),
+				OtherPattern: p.Pattern(cb.Api.Uri),
+			})
+		}
+	}
+
+	return r
+}
+
+// shadowing returns the rule winning the first cell of v when other rules
+// win every cell of v, same tells if they all do what v does.
+func (p *PolicyCbs) shadowing(v *Rule) (w *RuleAttr, same bool) {
+	same = true
+	for i := range v.Cells {
+		o := p.firstMatch(v, i)
+		if o == nil || o == v.Attr {
+			return nil, false
+		}
+		if w == nil {
+			w = o
+		}
+		same = same && sameDoing(o, v.Attr)
+	}
+
+	return w, same
+}
+
+func sameDoing(a, b *RuleAttr) bool {
+	return a.Action == b.Action &&
+		reflect.DeepEqual(a.Reject, b.Reject) &&
+		reflect.DeepEqual(a.Redirect, b.Redirect) &&
+		reflect.DeepEqual(a.RateLimit, b.RateLimit)
+}
+
+// lint stand-ins for the values a wildcard of the rule may take, no rule
+// names them.
+const (
+	lintAnyMethod base.Method   = 0xff
+	lintAnyUri    base.UriId    = ^base.UriId(0)
+	lintAnyGroup  uint64        = ^uint64(0)
+	lintAnyRole   base.WorkRole = ^base.WorkRole(0)
+)
+
+// firstMatch replays the lookup of a request matching cell i of v, with every
+// wildcard of the cell set to a value no rule names. As the enumerators order
+// keys by shape only, the winner is the same for every request the cell
+// matches.
+func (p *PolicyCbs) firstMatch(v *Rule, i int) *RuleAttr {
+	rk := &v.Cells[i]
+
+	method := rk.Method
+	if method == 0 {
+		method = lintAnyMethod
+	}
+	api := rk.Api
+	if api.Uri == 0 {
+		api.Uri = lintAnyUri
+	}
+
+	ds := p.lintDsts(v)
+	svcs := p.lintServices(rk)
+	if rk.Workload == 0 && rk.Role == 0 {
+		return p.l3FirstMatch(v, i, method, &api, ds, svcs)
+	}
+
+	c := base.Client{Workload: rk.Workload, Role: rk.Role, Group: rk.Group}
+	if c.Workload == 0 {
+		for _, g := range []*uint64{&c.Group.App, &c.Group.Env, &c.Group.Loc} {
+			if *g == 0 {
+				*g = lintAnyGroup
+			}
+		}
+	}
+
+	ks := l7KeyEnumerators(&L7Key{
+		Workload: c.Workload,
+		Role:     c.Role,
+		Group:    c.Group,
+		Dir:      rk.Dir,
+		Method:   method,
+		Api:      api,
+	})
+	ids := anyAddr
+	if rk.Id != 0 {
+		ids = append(p.coveringIds(v.para(i).Cidr), 0)
+	}
+	for _, l := range p.l7 {
+		for j := range ks {
+			var r *RuleAttr
+			if ks[j].each(&l.keys, ids, ds, svcs, func(k *L7Key) bool {
+				r = l.get(k)
+				return r != nil && (r == v.Attr || (r.Schedule == nil && r.Except == nil))
+			}) {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+// l3FirstMatch is l3Match for any address of the cidr of cell i of v.
+func (p *PolicyCbs) l3FirstMatch(v *Rule, i int,
+	method base.Method,
+	api *base.ApiService,
+	ds []DstKey,
+	svcs []base.ApiService) *RuleAttr {
+	ids := p.coveringIds(v.para(i).Cidr)
+	for _, l := range p.l3 {
+		for _, id := range ids {
+			for _, k := range l3KeyEnumerators(&L3Key{
+				Id:     id,
+				Dir:    v.Cells[i].Dir,
+				Method: method,
+				Api:    *api,
+			}) {
+				var r *RuleAttr
+				if k.each(&l.keys, ds, svcs, func(k *L3Key) bool {
+					r = l.get(k)
+					return r != nil && (r == v.Attr || (r.Schedule == nil && r.Except == nil))
+				}) {
+					return r
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// lintDsts are the destination keys of a request to any destination v
+// matches, its wildcards set to values no rule names.
+func (p *PolicyCbs) lintDsts(v *Rule) []DstKey {
+	dst := &v.Cell.Dst
+	if *dst == (DstKey{}) {
+		return anyDst
+	}
+
+	d := base.Endpoint{Workload: dst.Workload, Role: dst.Role, Group: dst.Group}
+	if d.Workload == 0 {
+		if d.Role == 0 {
+			d.Role = lintAnyRole
+		}
+		if d.Group == (base.WorkGroup{}) {
+			d.Group = base.WorkGroup{App: lintAnyGroup, Loc: lintAnyGroup, Env: lintAnyGroup}
+		}
+	}
+	ids := anyAddr
+	if dst.Id != 0 {
+		ids = append(p.coveringIds(v.Para.Dst.Cidr), 0)
+	}
+
+	return dstKeys(&d, ids)
+}
+
+// lintServices are the services of a request on any port rk matches, the
+// port ranges holding all of its own.
+func (p *PolicyCbs) lintServices(rk *RuleCell) []base.ApiService {
+	s := &rk.Api
+	if s.PortMax == 0 {
+		return p.ports.Services(s)
+	}
+
+	return p.ports.covering(s.Type, s.Proto, s.Port, s.PortMax, false)
+}
+
+// coveringIds returns the address objects of the cidrs holding all of cidr,
+// the longest first.
+func (p *PolicyCbs) coveringIds(cidr string) []base.AddrId {
+	var r []base.AddrId
+
+	ip, ml, err := net.ParseCidr(cidr)
+	if err != nil {
+		return nil
+	}
+
+	for m := int(ml); m >= 0; m-- {
+		if id, ok := p.aoc.FindId(ip, uint8(m)); ok {
+			r = append(r, id)
+		}
+	}
+
+	return r
+}
+
+// rivalCells returns the first cells of a and b that are rivals, nil if there
+// are none.
+func (p *PolicyCbs) rivalCells(a, b *Rule, overlaps []Finding) (*RuleCell, *RuleCell) {
+	for i := range a.Cells {
+		for j := range b.Cells {
+			if p.rivals(&a.Cells[i], &b.Cells[j], overlaps) {
+				return &a.Cells[i], &b.Cells[j]
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// rivals tells if a request can match both a and b at the same precedence,
+// so that only the enumerator order picks the winner.
+func (p *PolicyCbs) rivals(a, b *RuleCell, overlaps []Finding) bool {
+	if a.Dir != b.Dir || a.Api.Type != b.Api.Type || a.Api.Proto != b.Api.Proto ||
+		a.Api.Port != b.Api.Port || a.Api.PortMax != b.Api.PortMax {
+		return false
+	}
+
+	l3 := a.Workload == 0 && a.Role == 0
+	if l3 != (b.Workload == 0 && b.Role == 0) {
+		return false
+	}
+	if a.Prio != b.Prio || a.Id != b.Id || a.Dst != b.Dst {
+		return false
+	}
+	if !l3 {
+		// workload rules naming a role or a group only match the exact key
+		if (a.Workload != 0) != (b.Workload != 0) || a.Workload != b.Workload || a.Role != b.Role {
+			return false
+		}
+		if a.Workload != 0 && (a.Role != 0 || a.Group != base.WorkGroup{} || b.Group != base.WorkGroup{}) {
+			return false
+		}
+	}
+
+	if !fits(uint64(a.Method), uint64(b.Method)) || !fits(a.Group.App, b.Group.App) ||
+		!fits(a.Group.Env, b.Group.Env) || !fits(a.Group.Loc, b.Group.Loc) {
+		return false
+	}
+	if !fits(uint64(a.Api.Uri), uint64(b.Api.Uri)) && !overlapping(overlaps, p.Pattern(a.Api.Uri), p.Pattern(b.Api.Uri)) {
+		return false
+	}
+
+	return tier(a) == tier(b)
+}
+
+func fits(a, b uint64) bool {
+	return a == 0 || b == 0 || a == b
+}
+
+func overlapping(overlaps []Finding, a, b string) bool {
+	for _, o := range overlaps {
+		if (o.Pattern == a && o.OtherPattern == b) || (o.Pattern == b && o.OtherPattern == a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tier is the precedence of a rule among the keys of one request, method
+// and uri first then the group.
+func tier(rk *RuleCell) [2]int {
+	var t [2]int
+
+	for _, v := range []uint64{uint64(rk.Method), uint64(rk.Api.Uri)} {
+		if v != 0 {
+			t[0]++
+		}
+	}
+	for _, v := range []uint64{rk.Group.App, rk.Group.Env, rk.Group.Loc} {
+		if v != 0 {
+			t[1]++
+		}
+	}
+
+	return t
+}
+
+// overlaps finds the uri pattern pairs matching together, by scanning
+// sample paths built from every pattern. It is best effort, not an
+// intersection of the patterns: a pair matching together only on paths
+// unlike the samples of both, as /api/.* and /.*/admin, is missed.
+func (p *PolicyCbs) overlaps() []Finding {
+	var r []Finding
+
+	seen := make(map[[2]uint]bool)
+	for uri, id := range p.uoc.Um {
+		for _, s := range samples(uri) {
+			ms, err := p.uoc.Scan([]byte(s))
+			if err != nil {
+				continue
+			}
+			for _, m := range ms {
+				o := uint(m.Id)
+				if o == id || o == 0 || p.uoc.GetUri(o) == "" {
+					continue
+				}
+				k := [2]uint{id, o}
+				if o < id {
+					k = [2]uint{o, id}
+				}
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				r = append(r, Finding{
+					Kind:         LINT_OF_OVERLAP,
+					Pattern:      p.uoc.GetUri(k[0]),
+					OtherPattern: p.uoc.GetUri(k[1]),
+				})
+			}
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Pattern != r[j].Pattern {
+			return r[i].Pattern < r[j].Pattern
+		}
+		return r[i].OtherPattern < r[j].OtherPattern
+	})
+
+	return r
+}
+
+// samples returns paths matched by pattern, the shortest one and one with
+// every repetition taken once.
+func samples(pattern string) []string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+
+	return []string{sample(re, 0), sample(re, 1)}
+}
+
+func sample(re *syntax.Regexp, rep int) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCharClass:
+		return string(classRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return "_"
+	case syntax.OpCapture:
+		return sample(re.Sub[0], rep)
+	case syntax.OpStar, syntax.OpQuest:
+		return repeat(re.Sub[0], rep, rep)
+	case syntax.OpPlus:
+		return repeat(re.Sub[0], 1, rep)
+	case syntax.OpRepeat:
+		n := re.Min
+		if rep > n && (re.Max == -1 || rep <= re.Max) {
+			n = rep
+		}
+		return repeat(re.Sub[0], n, n)
+	case syntax.OpConcat:
+		var s string
+		for _, v := range re.Sub {
+			s += sample(v, rep)
+		}
+		return s
+	case syntax.OpAlternate:
+		return sample(re.Sub[rep%len(re.Sub)], rep)
+	}
+
+	return ""
+}
+
+func repeat(re *syntax.Regexp, min, rep int) string {
+	if rep < min {
+		rep = min
+	}
+
+	var s string
+	for i := 0; i < rep; i++ {
+		s += sample(re, 0)
+	}
+
+	return s
+}
+
+// classRune picks a printable rune of the class ranges.
+func classRune(ranges []rune) rune {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < 'a' && hi >= 'a' {
+			return 'a'
+		}
+		if lo < '0' && hi >= '0' {
+			return '0'
+		}
+		if lo > ' ' {
+			return lo
+		}
+	}
+	if len(ranges) > 0 {
+		return ranges[0]
+	}
+
+	return 'x'
+}
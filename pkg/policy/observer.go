@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"time"
+)
+
+type LookupEvent struct {
+	Client   *base.Client
+	Dir      base.Direction
+	Method   base.Method
+	Api      *base.ApiService
+	Path     string // raw request path, empty if unknown
+	Pattern  string // uri pattern of Api.Uri
+	L3       bool   // looked up by address rather than identity
+	Result   *Result
+	Duration time.Duration
+}
+
+// Observer is told about every decision and rule apply, it is called
+// synchronously and must not block nor call back into the policy.
+type Observer interface {
+	OnLookup(ev *LookupEvent)
+	OnApply(d time.Duration, err error)
+}
+
+func (p *PolicyCbs) AddObserver(o Observer) {
+	p.obs = append(p.obs, o)
+}
+
+func (p *PolicyCbs) notifyLookup(ev *LookupEvent) {
+	for _, o := range p.obs {
+		o.OnLookup(ev)
+	}
+}
+
+// observed tells the observers about decision r of a lookup that began at
+// begin, pattern is the uri pattern it was taken for.
+func (p *PolicyCbs) observed(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path, pattern string,
+	r *Result,
+	begin time.Time) {
+	p.notifyLookup(&LookupEvent{
+		Client:   c,
+		Dir:      dir,
+		Method:   method,
+		Api:      s,
+		Path:     path,
+		Pattern:  pattern,
+		L3:       c.Workload == 0 && c.Role == 0,
+		Result:   r,
+		Duration: time.Since(begin),
+	})
+}
+
+func (p *PolicyCbs) notifyApply(d time.Duration, err error) {
+	for _, o := range p.obs {
+		o.OnApply(d, err)
+	}
+}
@@ -4,24 +4,81 @@ import (
 	"fmt"
 	"l7/pkg/addrobj"
 	"l7/pkg/base"
+	"l7/pkg/clock"
+	"l7/pkg/net"
+	"l7/pkg/ratelimit"
 	"l7/pkg/uriobj"
+	"net/netip"
+	"sort"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// PolicyCbs is one rule set, its Engine locks it.
 type PolicyCbs struct {
-	sync.RWMutex
-
-	l3 [POLICY_CHAIN_PRIO_OF_MAX]*L3PolicyCbs
-	l7 L7PolicyCbs
+	l3     []*l3Chain // by ascending prio
+	l7     []*l7Chain // by ascending prio
+	def    DefaultCbs
+	rl     ratelimit.Limiter
+	sched  SchedCbs
+	clock  clock.Clock
+	rules  map[uint64]*Rule // all rules by id
+	id     uint64           // last assigned rule id
+	gen    uint64           // bumped by every change, read atomically
+	obs    []Observer
+	quota  Quota
+	ports  PortIndex           // port ranges of the rules
+	groups map[groupKey]*Group // named objects of the set rules
+	prior  map[string]uint64   // ids to keep by match, see Engine.Next
+
+	aoc      addrobj.AddrObjCbs
+	uoc      uriobj.UriObjCbs
+	addrRefs map[base.AddrId]int // rule cells using each address object
+	uriRefs  map[base.UriId]int  // rule cells using each uri pattern
 }
 
+// Init leaves every table empty, they grow with the rules so that an engine
+// costs little until it is filled. There is one per tenant, shadow and
+// reload.
 func (p *PolicyCbs) Init() {
-	for i := 0; uint8(i) < POLICY_CHAIN_PRIO_OF_MAX; i++ {
-		p.l3[i] = new(L3PolicyCbs)
-		p.l3[i].Init()
+	p.aoc.Init()
+	p.uoc.Init(uriobj.DEFAULT_UOC_FLAG, 0)
+	p.addrRefs = make(map[base.AddrId]int)
+	p.uriRefs = make(map[base.UriId]int)
+
+	p.def.Init()
+	p.ports.Init()
+	p.sched.Init()
+	p.rules = make(map[uint64]*Rule)
+	p.groups = make(map[groupKey]*Group)
+	p.clock = clock.SysClock{}
+	p.rl.Init(p.clock, ratelimit.DEFAULT_RL_IDLE)
+}
+
+func (p *PolicyCbs) SetClock(c clock.Clock) {
+	p.clock = c
+	p.rl.SetClock(c)
+}
+
+func (p *PolicyCbs) Now() time.Time {
+	return p.clock.Now()
+}
+
+// Lens returns the rule count of every l3 chain, in lookup order, and of
+// all the l7 chains.
+func (p *PolicyCbs) Lens() ([]int, int) {
+	l3 := make([]int, 0, len(p.l3))
+	for _, v := range p.l3 {
+		l3 = append(l3, v.Len())
 	}
-	p.l7.Init()
+
+	l7 := 0
+	for _, v := range p.l7 {
+		l7 += v.Len()
+	}
+
+	return l3, l7
 }
 
 func (p *PolicyCbs) Len() string {
@@ -29,76 +86,525 @@ func (p *PolicyCbs) Len() string {
 
 	fmt.Fprintf(&sb, "policy-len: l3(")
 	for _, v := range p.l3 {
-		fmt.Fprintf(&sb, " %d", v.Len())
+		fmt.Fprintf(&sb, " %d:%d", v.prio, v.Len())
+	}
+	fmt.Fprintf(&sb, " ), l7(")
+	for _, v := range p.l7 {
+		fmt.Fprintf(&sb, " %d:%d", v.prio, v.Len())
 	}
-	fmt.Fprintf(&sb, " ), l7( %d )", p.l7.Len())
+	fmt.Fprintf(&sb, " )")
 
 	return sb.String()
 }
 
+// Generation identifies the current rule set, it changes with every update.
+func (p *PolicyCbs) Generation() uint64 {
+	return atomic.LoadUint64(&p.gen)
+}
+
+func (p *PolicyCbs) bump() {
+	atomic.AddUint64(&p.gen, 1)
+}
+
+func (p *PolicyCbs) Get(id uint64) (Rule, bool) {
+	r, ok := p.rules[id]
+	if !ok {
+		return Rule{}, false
+	}
+
+	return r.dump(), true
+}
+
+// Dump returns a copy of every rule ordered by id.
+func (p *PolicyCbs) Dump() []Rule {
+	r := make([]Rule, 0, len(p.rules))
+	for _, v := range p.rules {
+		r = append(r, v.dump())
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Id < r[j].Id })
+
+	return r
+}
+
 func (p *PolicyCbs) Lookup(c *base.Client,
 	dir base.Direction,
 	method base.Method,
 	s *base.ApiService) (*RuleAttr, int) {
+	return p.LookupPath(c, dir, method, s, "")
+}
+
+// LookupPath is Lookup with the request path the uri excepts need. A rate
+// limit rule whose bucket is empty comes back with the drop action. The
+// observers see a miss as a default without action, the caller decides it.
+func (p *PolicyCbs) LookupPath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*RuleAttr, int) {
+	begin := time.Now()
+	r, n := p.match(c, dir, method, s, &query{c: c, method: method, path: path}, p.Now().UnixNano())
+
+	res := &Result{Kind: POLICY_RESULT_OF_DEFAULT, Action: Action(POLICY_ACTION_OF_UNKNOWN)}
+	if r != nil {
+		res = &Result{Kind: POLICY_RESULT_OF_MATCH, Action: r.Action, Rule: r}
+		p.throttle(c, res)
+		p.count(res)
+	}
+	if len(p.obs) != 0 {
+		p.observed(c, dir, method, s, path, p.Pattern(s.Uri), res, begin)
+	}
+	if res.Throttled {
+		r.Action = res.Action
+	}
+
+	return r, n
+}
+
+func (p *PolicyCbs) match(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	q *query,
+	now int64) (*RuleAttr, int) {
 	if c.Workload == 0 && c.Role == 0 {
-		return p.l3Match(c, dir, method, s)
+		return p.l3Match(c, dir, method, s, q, now)
+	}
+
+	return p.l7Match(c, dir, method, s, q, now)
+}
+
+func (p *PolicyCbs) Decide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService) *Result {
+	return p.DecidePath(c, dir, method, s, "")
+}
+
+// DecidePath is Decide passing the raw request path on to the observers.
+func (p *PolicyCbs) DecidePath(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) *Result {
+	if len(p.obs) == 0 {
+		return p.decide(c, dir, method, s, path)
 	}
 
-	return p.l7Match(c, dir, method, s)
+	begin := time.Now()
+	r := p.decide(c, dir, method, s, path)
+	p.observed(c, dir, method, s, path, p.Pattern(s.Uri), r, begin)
+
+	return r
 }
 
+func (p *PolicyCbs) decide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) *Result {
+	res := p.resolve(c, dir, method, s, path, p.Now().UnixNano())
+	p.throttle(c, res)
+	p.count(res)
+
+	return res
+}
+
+// Evaluate scans path and returns the one decision of all the uri patterns
+// it matches, see candidate.precedes. Only s.Type, s.Proto and s.Port are
+// used.
+func (p *PolicyCbs) Evaluate(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string) (*Result, error) {
+	begin := time.Now()
+	r, api, err := p.evaluate(c, dir, method, s, path, p.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	p.throttle(c, r)
+	p.count(r)
+
+	if len(p.obs) != 0 {
+		p.observed(c, dir, method, api, path, r.Pattern, r, begin)
+	}
+
+	return r, nil
+}
+
+// resolve finds the matched rule or the default, path and now as in match.
+func (p *PolicyCbs) resolve(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string,
+	now int64) *Result {
+	q := &query{c: c, method: method, path: path}
+	if r, _ := p.match(c, dir, method, s, q, now); r != nil {
+		return &Result{
+			Kind:     POLICY_RESULT_OF_MATCH,
+			Action:   r.Action,
+			Rule:     r,
+			Excepted: q.excepted,
+		}
+	}
+
+	a, _ := p.def.Lookup(c, dir)
+	return &Result{
+		Kind:     POLICY_RESULT_OF_DEFAULT,
+		Action:   a,
+		Excepted: q.excepted,
+	}
+}
+
+// throttle takes a token for a rate limit rule, the request is dropped when
+// its bucket is empty.
+func (p *PolicyCbs) throttle(c *base.Client, res *Result) {
+	if r := res.Rule; r != nil && uint8(r.Action) == POLICY_ACTION_OF_RATELIMIT && r.RateLimit != nil {
+		k := ratelimit.ClientKey(r.Id, r.RateLimit.Key, c)
+		if !p.rl.Allow(&k, r.RateLimit.Rate, r.RateLimit.Burst) {
+			res.Action = Action(POLICY_ACTION_OF_DROP)
+			res.Throttled = true
+		}
+	}
+}
+
+// Apply recompiles the uri patterns so that new rules can be matched.
+func (p *PolicyCbs) Apply() error {
+	begin := time.Now()
+	err := p.uoc.ReGenerateRse()
+	p.notifyApply(time.Since(begin), err)
+	if err == nil {
+		p.bump()
+	}
+
+	return err
+}
+
+// Update adds a rule of one cell under a new id, see insert.
 func (p *PolicyCbs) Update(rk *RuleCell, ra *RuleAttr) error {
-	if rk.Workload == 0 && rk.Role == 0 {
-		return p.l3Update(rk.Prio, rk.Id, rk.Dir, rk.Method, &rk.Api, ra)
+	rks := []RuleCell{*rk}
+	olds, err := p.covered(rks, 0)
+	if err != nil {
+		return err
+	}
+
+	p.id++
+	ra.Id = p.id
+
+	return p.insert(rks, olds, ra, p.Now().UnixNano())
+}
+
+// Add is Update keeping the parameters the rule was added with.
+func (p *PolicyCbs) Add(arg *PolicyOpPara, rk *RuleCell, ra *RuleAttr) error {
+	if err := p.Update(rk, ra); err != nil {
+		return err
+	}
+	p.rules[ra.Id].Para = *arg
+
+	return nil
+}
+
+// AddPara registers the address and uri objects of arg and adds the rule,
+// the id of the new rule is set in ra.
+func (p *PolicyCbs) AddPara(arg *PolicyOpPara, ra *RuleAttr) error {
+	return p.AddSet(&PolicyOpSet{PolicyOpPara: *arg}, ra)
+}
+
+// checkQuota fails when the cells rks of paras, replacing olds rules, would
+// add a rule or uri patterns beyond the quota.
+func (p *PolicyCbs) checkQuota(rks []RuleCell, paras []PolicyOpPara, olds int) error {
+	if p.quota.Patterns > 0 {
+		seen := make(map[string]bool)
+		for i := range rks {
+			if rks[i].Api.Uri == 0 {
+				seen[paras[i].Httpath] = true
+			}
+		}
+		if len(seen) != 0 && p.uoc.Len()+len(seen) > p.quota.Patterns {
+			return fmt.Errorf("uri pattern quota %d exceeded", p.quota.Patterns)
+		}
+	}
+	if p.quota.Rules > 0 && len(p.rules)-olds >= p.quota.Rules {
+		return fmt.Errorf("rule quota %d exceeded", p.quota.Rules)
+	}
+
+	return nil
+}
+
+func (p *PolicyCbs) SetQuota(q *Quota) {
+	p.quota = *q
+}
+
+func (p *PolicyCbs) Quota() Quota {
+	return p.quota
+}
+
+// addrNew is the address object of a cell whose cidr has none yet, register
+// allocates it.
+const addrNew = ^base.AddrId(0)
+
+// cell builds the rule cell of arg, with the address objects of its cidrs
+// looked up but not allocated.
+func (p *PolicyCbs) cell(arg *PolicyOpPara, uri uint) (*RuleCell, error) {
+	ip, ml, err := net.ParseCidr(arg.Cidr)
+	if err != nil {
+		return nil, fmt.Errorf("parse cidr failed,%v", err)
 	}
 
-	return p.l7Update(rk.Workload, rk.Role, rk.Group, rk.Dir, rk.Method, &rk.Api, ra)
+	rk := paraCell(arg, p.addrId(arg, ip, ml), uri)
+	if err := NormalizePorts(&rk.Api); err != nil {
+		return nil, err
+	}
+	if arg.Dst.Cidr != "" {
+		ip, ml, err := net.ParseCidr(arg.Dst.Cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parse dst cidr failed,%v", err)
+		}
+		if ml != 0 {
+			rk.Dst.Id = p.findId(ip, ml)
+		}
+	}
+
+	return rk, nil
 }
 
+// addrId returns the address object of the cidr of arg. An identity rule
+// from any address has none, so that it matches whatever the client ip.
+func (p *PolicyCbs) addrId(arg *PolicyOpPara, ip netip.Addr, ml uint8) base.AddrId {
+	if ml == 0 && (arg.Workload != 0 || arg.Role != 0) {
+		return 0
+	}
+
+	return p.findId(ip, ml)
+}
+
+func (p *PolicyCbs) findId(ip netip.Addr, ml uint8) base.AddrId {
+	if id, ok := p.aoc.FindId(ip, ml); ok {
+		return id
+	}
+
+	return addrNew
+}
+
+// register allocates the address objects and the uri pattern of rk, the cell
+// of arg, and sets their ids.
+func (p *PolicyCbs) register(rk *RuleCell, arg *PolicyOpPara) {
+	rk.Api.Uri = base.UriId(p.uoc.AddUri(arg.Httpath))
+	if rk.Id != 0 {
+		ip, ml, _ := net.ParseCidr(arg.Cidr)
+		rk.Id = p.aoc.GetId(ip, ml)
+	}
+	if rk.Dst.Id != 0 {
+		ip, ml, _ := net.ParseCidr(arg.Dst.Cidr)
+		rk.Dst.Id = p.aoc.GetId(ip, ml)
+	}
+}
+
+// hold counts rk as a user of its address objects and uri pattern.
+func (p *PolicyCbs) hold(rk *RuleCell) {
+	for _, id := range [2]base.AddrId{rk.Id, rk.Dst.Id} {
+		if id != 0 {
+			p.addrRefs[id]++
+		}
+	}
+	if rk.Api.Uri != 0 {
+		p.uriRefs[rk.Api.Uri]++
+	}
+}
+
+// release undoes hold, the objects no cell uses any more are deleted and no
+// longer count against the quota. A deleted pattern stays compiled until the
+// next apply but has no rule left.
+func (p *PolicyCbs) release(rk *RuleCell) {
+	for _, id := range [2]base.AddrId{rk.Id, rk.Dst.Id} {
+		if id == 0 {
+			continue
+		}
+		if p.addrRefs[id]--; p.addrRefs[id] <= 0 {
+			delete(p.addrRefs, id)
+			p.aoc.DelById(id)
+		}
+	}
+	if id := rk.Api.Uri; id != 0 {
+		if p.uriRefs[id]--; p.uriRefs[id] <= 0 {
+			delete(p.uriRefs, id)
+			p.uoc.DelUri(p.uoc.GetUri(uint(id)))
+		}
+	}
+}
+
+func paraCell(arg *PolicyOpPara, id base.AddrId, uri uint) *RuleCell {
+	return &RuleCell{
+		Prio:     arg.Prio,
+		Id:       id,
+		Workload: arg.Workload,
+		Role:     arg.Role,
+		Group:    arg.Group,
+		Dir:      arg.Dir,
+		Method:   arg.Method,
+		Api: base.ApiService{
+			Type:    arg.Type,
+			Proto:   arg.Proto,
+			Port:    arg.Port,
+			PortMax: arg.PortMax,
+			Uri:     base.UriId(uri),
+		},
+		Dst: DstKey{
+			Workload: arg.Dst.Workload,
+			Role:     arg.Dst.Role,
+			Group:    arg.Dst.Group,
+		},
+	}
+}
+
+// DelPara deletes the rule added with the same arg.
+func (p *PolicyCbs) DelPara(arg *PolicyOpPara) error {
+	return p.DelSet(&PolicyOpSet{PolicyOpPara: *arg})
+}
+
+func (p *PolicyCbs) DelId(id uint64) error {
+	if _, ok := p.rules[id]; !ok {
+		return fmt.Errorf("rule %d not found", id)
+	}
+	p.remove(id)
+
+	return nil
+}
+
+// ApiServices builds one service per uri pattern httpath matches, in the
+// order of the first match of each.
+func (p *PolicyCbs) ApiServices(l7type, proto uint8, port uint16, httpath string) ([]base.ApiService, error) {
+	var as []base.ApiService
+
+	r, err := p.uoc.Scan([]byte(httpath))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint64]bool, len(r))
+	for _, v := range r {
+		if seen[v.Id] {
+			continue
+		}
+		seen[v.Id] = true
+		as = append(as, base.ApiService{
+			Type:  l7type,
+			Proto: proto,
+			Port:  port,
+			Uri:   base.UriId(v.Id),
+		})
+	}
+
+	return as, nil
+}
+
+// Pattern returns the uri pattern of a uri id.
+func (p *PolicyCbs) Pattern(id base.UriId) string {
+	return p.uoc.GetUri(uint(id))
+}
+
+func (p *PolicyCbs) Patterns() int {
+	return p.uoc.Len()
+}
+
+func (p *PolicyCbs) SetDefault(k *DefaultKey, a Action) {
+	p.def.Update(k, a)
+	p.bump()
+}
+
+func (p *PolicyCbs) DelDefault(k *DefaultKey) {
+	p.def.Delete(k)
+	p.bump()
+}
+
+// Delete deletes the rule holding rk, with all of its cells.
 func (p *PolicyCbs) Delete(rk *RuleCell) error {
+	if ra := p.get(rk); ra != nil {
+		p.remove(ra.Id)
+	}
+	p.bump()
+
+	return nil
+}
+
+// get returns the stored attr of the rule, nil if there is none.
+func (p *PolicyCbs) get(rk *RuleCell) *RuleAttr {
 	if rk.Workload == 0 && rk.Role == 0 {
-		if rk.Prio >= POLICY_CHAIN_PRIO_OF_MAX {
-			return fmt.Errorf("too big prio for deleting rule")
+		if v := p.l3Chain(rk.Prio, false); v != nil {
+			return v.get(rk.l3Key())
 		}
-		p.l3[rk.Prio].Delete(&L3Key{
-			Id:     rk.Id,
-			Dir:    rk.Dir,
-			Method: rk.Method,
-			Api:    rk.Api,
-		})
 		return nil
 	}
 
-	p.l7.Delete(&L7Key{
+	if v := p.l7Chain(rk.Prio, false); v != nil {
+		return v.get(rk.l7Key())
+	}
+	return nil
+}
+
+func (rk *RuleCell) l3Key() *L3Key {
+	return &L3Key{
+		Id:     rk.Id,
+		Dir:    rk.Dir,
+		Method: rk.Method,
+		Api:    rk.Api,
+		Dst:    rk.Dst,
+	}
+}
+
+func (rk *RuleCell) l7Key() *L7Key {
+	return &L7Key{
+		Id:       rk.Id,
 		Workload: rk.Workload,
 		Role:     rk.Role,
 		Group:    rk.Group,
 		Dir:      rk.Dir,
 		Method:   rk.Method,
 		Api:      rk.Api,
-	})
-	return nil
+		Dst:      rk.Dst,
+	}
 }
 
 func (p *PolicyCbs) DeleteAll() {
-	for _, l := range p.l3[:] {
-		l.DeleteAll()
+	p.bump()
+	p.sched.DeleteAll()
+	for k := range p.rules {
+		delete(p.rules, k)
 	}
-	addrobj.DeleteAll()
 
-	p.l7.DeleteAll()
-	uriobj.DeleteAllUri()
-	uriobj.Apply()
+	p.l3, p.l7 = nil, nil
+	p.ports.DeleteAll()
+	p.aoc.DeleteAll()
+	p.addrRefs = make(map[base.AddrId]int)
+	p.uriRefs = make(map[base.UriId]int)
+
+	p.uoc.DeleteAllUri()
+	p.uoc.ReGenerateRse()
 }
 
 func (p *PolicyCbs) l3Match(c *base.Client,
 	dir base.Direction,
 	method base.Method,
-	s *base.ApiService) (*RuleAttr, int) {
+	s *base.ApiService,
+	q *query,
+	now int64) (*RuleAttr, int) {
 
-	for _, v := range p.l3[:] {
-		ids := addrobj.Lookup(c.Ip)
+	var dsts []DstKey
+	ids := p.aoc.Lookup(c.Ip)
+	svcs := p.ports.Services(s)
+	for _, v := range p.l3 {
+		ds := anyDst
+		if v.Dsts() {
+			if dsts == nil {
+				dsts = dstKeys(&c.Dst, p.dstIds(&c.Dst))
+			}
+			ds = dsts
+		}
 		for _, id := range ids {
+			if !v.keys.hasId(id) {
+				continue
+			}
 			for _, k := range l3KeyEnumerators(&L3Key{
 				Id:     base.AddrId(id),
 				Dir:    dir,
@@ -110,7 +616,14 @@ func (p *PolicyCbs) l3Match(c *base.Client,
 					Uri:   s.Uri,
 				},
 			}) {
-				if r, _ := v.Lookup(&k); r != nil {
+				var r *RuleAttr
+				if k.each(&v.keys, ds, svcs, func(k *L3Key) bool {
+					r, _ = v.Lookup(k, q, now)
+					return r != nil
+				}) {
+					if now != 0 {
+						atomic.AddUint64(&v.hits, 1)
+					}
 					return r, 0
 				}
 			}
@@ -142,24 +655,160 @@ func l3KeyEnumerators(l3k *L3Key) []L3Key {
 func (p *PolicyCbs) l7Match(c *base.Client,
 	dir base.Direction,
 	method base.Method,
-	s *base.ApiService) (*RuleAttr, int) {
+	s *base.ApiService,
+	q *query,
+	now int64) (*RuleAttr, int) {
 
-	for _, v := range l7KeyEnumerators(&L7Key{
+	if len(p.l7) == 0 {
+		return nil, 1
+	}
+
+	ks := l7KeyEnumerators(&L7Key{
 		Workload: c.Workload,
 		Role:     c.Role,
 		Group:    c.Group,
 		Dir:      dir,
 		Method:   method,
 		Api:      *s,
-	}) {
-		if r, _ := p.l7.Lookup(&v); r != nil {
-			return r, 0
+	})
+	// identity and source address together, the identity keys in order and
+	// for each the longest cidr first down to any address, then the
+	// destinations the same way and the port ranges
+	var (
+		ids  []base.AddrId
+		dsts []DstKey
+	)
+	svcs := p.ports.Services(s)
+	for _, v := range p.l7 {
+		as := anyAddr
+		if v.Addrs() {
+			if ids == nil {
+				ids = append(p.aoc.Lookup(c.Ip), 0)
+			}
+			as = ids
+		}
+		ds := anyDst
+		if v.Dsts() {
+			if dsts == nil {
+				dsts = dstKeys(&c.Dst, p.dstIds(&c.Dst))
+			}
+			ds = dsts
+		}
+		for i := range ks {
+			var r *RuleAttr
+			if ks[i].each(&v.keys, as, ds, svcs, func(k *L7Key) bool {
+				r, _ = v.Lookup(k, q, now)
+				return r != nil
+			}) {
+				if now != 0 {
+					atomic.AddUint64(&v.hits, 1)
+				}
+				return r, 0
+			}
 		}
 	}
 
 	return nil, 1
 }
 
+// each calls f with k set to every destination of ds and service of svcs,
+// in lookup order, until f returns true. The ones no key of x names are
+// skipped.
+func (k *L3Key) each(x *keyIndex, ds []DstKey, svcs []base.ApiService, f func(k *L3Key) bool) bool {
+	for _, d := range ds {
+		if !x.hasDst(d) {
+			continue
+		}
+		k.Dst = d
+		for i := range svcs {
+			if !x.hasSvc(&svcs[i]) {
+				continue
+			}
+			k.Api.Proto, k.Api.Port, k.Api.PortMax = svcs[i].Proto, svcs[i].Port, svcs[i].PortMax
+			if f(k) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// each is L3Key.each, every address of ids x names first.
+func (k *L7Key) each(x *keyIndex, ids []base.AddrId, ds []DstKey, svcs []base.ApiService, f func(k *L7Key) bool) bool {
+	for _, id := range ids {
+		if !x.hasId(id) {
+			continue
+		}
+		k.Id = id
+		for _, d := range ds {
+			if !x.hasDst(d) {
+				continue
+			}
+			k.Dst = d
+			for i := range svcs {
+				if !x.hasSvc(&svcs[i]) {
+					continue
+				}
+				k.Api.Proto, k.Api.Port, k.Api.PortMax = svcs[i].Proto, svcs[i].Port, svcs[i].PortMax
+				if f(k) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+var (
+	anyAddr = []base.AddrId{0}
+	anyDst  = []DstKey{{}}
+)
+
+// dstIds returns the address objects holding the ip of d, the longest cidr
+// first and any address last.
+func (p *PolicyCbs) dstIds(d *base.Endpoint) []base.AddrId {
+	if !d.Ip.IsValid() {
+		return anyAddr
+	}
+
+	return append(p.aoc.Lookup(d.Ip), 0)
+}
+
+// dstKeys enumerates the destination keys of d like l7KeyEnumerators does
+// the client ones, a workload or else its role and group, then for each of
+// them the address objects ids.
+func dstKeys(d *base.Endpoint, ids []base.AddrId) []DstKey {
+	var ks []DstKey
+
+	if d.Workload != 0 {
+		ks = append(ks, DstKey{Workload: d.Workload})
+	} else {
+		group := d.Group != base.WorkGroup{}
+		if d.Role != 0 && group {
+			ks = append(ks, DstKey{Role: d.Role, Group: d.Group})
+		}
+		if d.Role != 0 {
+			ks = append(ks, DstKey{Role: d.Role})
+		}
+		if group {
+			ks = append(ks, DstKey{Group: d.Group})
+		}
+	}
+	ks = append(ks, DstKey{})
+
+	r := make([]DstKey, 0, len(ks)*len(ids))
+	for _, k := range ks {
+		for _, id := range ids {
+			k.Id = id
+			r = append(r, k)
+		}
+	}
+
+	return r
+}
+
 func l7KeyEnumerators(l7k *L7Key) []L7Key {
 	var r []L7Key
 
@@ -259,41 +908,44 @@ func appendL7kRole(sl []L7Key, l7k *L7Key, role base.WorkRole, app, env, loc uin
 	return sl
 }
 
-func (p *PolicyCbs) l3Update(prio uint8,
+func (p *PolicyCbs) l3Update(prio uint16,
 	id base.AddrId,
 	dir base.Direction,
 	method base.Method,
 	s *base.ApiService,
+	dst *DstKey,
 	ra *RuleAttr) error {
-	if prio >= POLICY_CHAIN_PRIO_OF_MAX {
-		return fmt.Errorf("too big policy priority(%d)", prio)
-	}
-
-	p.l3[prio].Update(&L3Key{
+	p.l3Chain(prio, true).Update(&L3Key{
 		Id:     id,
 		Dir:    dir,
 		Method: method,
 		Api:    *s,
+		Dst:    *dst,
 	}, ra)
 
 	return nil
 }
 
-func (p *PolicyCbs) l7Update(workload base.WorkloadId,
+func (p *PolicyCbs) l7Update(prio uint16,
+	id base.AddrId,
+	workload base.WorkloadId,
 	role base.WorkRole,
 	group base.WorkGroup,
 	dir base.Direction,
 	method base.Method,
 	s *base.ApiService,
+	dst *DstKey,
 	ra *RuleAttr) error {
 
-	p.l7.Update(&L7Key{
+	p.l7Chain(prio, true).Update(&L7Key{
+		Id:       id,
 		Workload: workload,
 		Role:     role,
 		Group:    group,
 		Dir:      dir,
 		Method:   method,
 		Api:      *s,
+		Dst:      *dst,
 	}, ra)
 
 	return nil
@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestLookupThrottled has the lookup and the decision take the tokens of one
+// rate limit bucket.
+func TestLookupThrottled(t *testing.T) {
+	fc := clock.NewFakeClock(time.Unix(1700000000, 0))
+	PolicySetClock(fc)
+	defer PolicySetClock(clock.SysClock{})
+	defer PolicyDeleteAll()
+
+	arg := &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/a"}
+	ra := &RuleAttr{Action: Action(POLICY_ACTION_OF_RATELIMIT), RateLimit: &RateLimitPara{Rate: 1, Burst: 2}}
+	if err := PolicyAddAttr(arg, ra); err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	lookup := func() uint8 {
+		r, _ := PolicyLookup(c, base.L7_INGRESS, base.HTTP_GET, &as[0])
+		if r == nil {
+			t.Fatal("lookup missed")
+		}
+		return uint8(r.Action)
+	}
+	if a := lookup(); a != POLICY_ACTION_OF_RATELIMIT {
+		t.Errorf("first lookup action %d", a)
+	}
+	if r := PolicyDecide(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r.Throttled {
+		t.Error("second request throttled")
+	}
+	if a := lookup(); a != POLICY_ACTION_OF_DROP {
+		t.Errorf("lookup past the burst action %d, want drop", a)
+	}
+
+	fc.Advance(time.Second)
+	if a := lookup(); a != POLICY_ACTION_OF_RATELIMIT {
+		t.Errorf("lookup after the refill action %d", a)
+	}
+}
+
+func TestQuotaReleased(t *testing.T) {
+	e := NewEngine()
+	e.SetQuota(&Quota{Rules: 1, Patterns: 2})
+
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(testSet("/a", "/b"), a); err != nil {
+		t.Fatal(err)
+	}
+
+	set := testSet("/c")
+	set.Cidr = "192.168.0.0/16"
+	if err := e.AddSet(set, &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err == nil {
+		t.Fatal("rule beyond the quota added")
+	}
+	if n := e.cbs.aoc.Len(); n != 1 {
+		t.Fatalf("%d address objects after a rejected add, want 1", n)
+	}
+
+	if err := e.DelId(a.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := e.cbs.aoc.Len(), e.Patterns(); n != 0 || m != 0 {
+		t.Fatalf("%d address objects and %d patterns left, want none", n, m)
+	}
+
+	// the quota freed takes the rule rejected before
+	if err := e.AddSet(set, &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedObjectsKept(t *testing.T) {
+	e := NewEngine()
+
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(testSet("/a"), a); err != nil {
+		t.Fatal(err)
+	}
+	b := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := e.AddSet(testSet("/b"), b); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaced by a rule of the same cell, the pattern is still used
+	c := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := e.AddSet(testSet("/a"), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DelId(b.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := e.cbs.aoc.Len(), e.Patterns(); n != 1 || m != 1 {
+		t.Fatalf("%d address objects and %d patterns, want 1 and 1", n, m)
+	}
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	as, err := e.ApiServices(1, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	// an update moving the rule to another pattern frees the old one
+	if err := e.UpdateSet(c.Id, testSet("/d"), c); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := e.cbs.aoc.Len(), e.Patterns(); n != 1 || m != 1 {
+		t.Fatalf("%d address objects and %d patterns after an update, want 1 and 1", n, m)
+	}
+}
+
+func TestNewEngineSmall(t *testing.T) {
+	const n = 16
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	es := make([]*Engine, n)
+	for i := range es {
+		es[i] = NewEngine()
+	}
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(es)
+
+	// one per tenant, shadow and reload, an empty engine must stay cheap
+	per := (after.TotalAlloc - before.TotalAlloc) / n
+	t.Logf("an empty engine allocates %d bytes", per)
+	if per > 64<<10 {
+		t.Errorf("an empty engine allocates %d bytes, want 64k at most", per)
+	}
+}
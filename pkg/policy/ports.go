@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"sort"
+)
+
+// portRange is a port range some rules use, either of a protocol or of
+// base.PROTO_OF_ANY.
+type portRange struct {
+	proto  uint8
+	lo, hi uint16
+	refs   int // rules using it
+}
+
+// PortIndex keeps the port ranges of the rules per type and protocol, so
+// that a lookup only tries the ranges holding its port.
+type PortIndex struct {
+	db map[[2]uint8][]*portRange // sorted by lo
+}
+
+func (p *PortIndex) Init() {
+	p.db = make(map[[2]uint8][]*portRange)
+}
+
+func (p *PortIndex) Add(s *base.ApiService) {
+	k := [2]uint8{s.Type, s.Proto}
+	rs := p.db[k]
+
+	i := sort.Search(len(rs), func(i int) bool {
+		return rs[i].lo > s.Port || (rs[i].lo == s.Port && rs[i].hi >= s.PortMax)
+	})
+	if i < len(rs) && rs[i].lo == s.Port && rs[i].hi == s.PortMax {
+		rs[i].refs++
+		return
+	}
+
+	rs = append(rs, nil)
+	copy(rs[i+1:], rs[i:])
+	rs[i] = &portRange{proto: s.Proto, lo: s.Port, hi: s.PortMax, refs: 1}
+	p.db[k] = rs
+}
+
+func (p *PortIndex) Delete(s *base.ApiService) {
+	k := [2]uint8{s.Type, s.Proto}
+	rs := p.db[k]
+
+	for i, v := range rs {
+		if v.lo != s.Port || v.hi != s.PortMax {
+			continue
+		}
+		if v.refs--; v.refs == 0 {
+			rs = append(rs[:i], rs[i+1:]...)
+		}
+		break
+	}
+
+	if len(rs) == 0 {
+		delete(p.db, k)
+	} else {
+		p.db[k] = rs
+	}
+}
+
+func (p *PortIndex) DeleteAll() {
+	for k := range p.db {
+		delete(p.db, k)
+	}
+}
+
+// Services returns the variants of s the rules may name, s itself first then
+// the ranges holding its port from the narrowest on. Only Proto, Port and
+// PortMax of the variants are meaningful.
+func (p *PortIndex) Services(s *base.ApiService) []base.ApiService {
+	return p.covering(s.Type, s.Proto, s.Port, s.Port, true)
+}
+
+// covering returns the ranges holding all of lo-hi for proto, led by the
+// exact port lo if asked for.
+func (p *PortIndex) covering(l7type, proto uint8, lo, hi uint16, exact bool) []base.ApiService {
+	r := make([]base.ApiService, 0, 1)
+	if exact {
+		r = append(r, base.ApiService{Type: l7type, Proto: proto, Port: lo})
+	}
+	if len(p.db) == 0 {
+		return r
+	}
+
+	var ms []*portRange
+	for _, k := range [][2]uint8{{l7type, proto}, {l7type, base.PROTO_OF_ANY}} {
+		for _, v := range p.db[k] {
+			if v.lo > lo {
+				break
+			}
+			if v.hi >= hi {
+				ms = append(ms, v)
+			}
+		}
+		if proto == base.PROTO_OF_ANY {
+			break
+		}
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		a, b := ms[i], ms[j]
+		if a.hi-a.lo != b.hi-b.lo {
+			return a.hi-a.lo < b.hi-b.lo
+		}
+		if a.proto != b.proto {
+			return a.proto != base.PROTO_OF_ANY
+		}
+		return a.lo < b.lo
+	})
+	for _, v := range ms {
+		r = append(r, base.ApiService{Type: l7type, Proto: v.proto, Port: v.lo, PortMax: v.hi})
+	}
+
+	return r
+}
+
+// NormalizePorts checks the port range of a rule service. A one port range
+// of a protocol is the port itself, any protocol always takes a range.
+func NormalizePorts(s *base.ApiService) error {
+	if s.PortMax != 0 && s.PortMax < s.Port {
+		return fmt.Errorf("invalid port range %d-%d", s.Port, s.PortMax)
+	}
+
+	if s.Proto == base.PROTO_OF_ANY {
+		if s.PortMax == 0 {
+			if s.Port == 0 {
+				return fmt.Errorf("any protocol needs a port")
+			}
+			s.PortMax = s.Port
+		}
+		return nil
+	}
+	if s.PortMax == s.Port {
+		s.PortMax = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+func portPara(proto uint8, port, portMax uint16) *PolicyOpPara {
+	return &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP,
+		Proto: proto, Port: port, PortMax: portMax, Httpath: "/a"}
+}
+
+// TestPortRanges has a request take the exact port first, then the
+// narrowest range holding it, of its protocol before any protocol.
+func TestPortRanges(t *testing.T) {
+	defer PolicyDeleteAll()
+
+	for _, v := range []struct {
+		proto         uint8
+		port, portMax uint16
+		action        uint8
+	}{
+		{6, 8000, 8999, POLICY_ACTION_OF_PASS},
+		{6, 8500, 8599, POLICY_ACTION_OF_DROP},
+		{base.PROTO_OF_ANY, 8000, 9999, POLICY_ACTION_OF_AUDIT},
+		{6, 8550, 0, POLICY_ACTION_OF_MTLS},
+		{base.PROTO_OF_ANY, 53, 0, POLICY_ACTION_OF_DROP},
+		{6, 200, 299, POLICY_ACTION_OF_PASS},
+		{base.PROTO_OF_ANY, 200, 299, POLICY_ACTION_OF_DROP},
+	} {
+		if err := PolicyAdd(portPara(v.proto, v.port, v.portMax), Action(v.action)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ApplyRules()
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	lookup := func(proto uint8, port uint16) uint8 {
+		as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, proto, port, "/a")
+		if err != nil || len(as) != 1 {
+			t.Fatalf("services %v, %v", as, err)
+		}
+		if r, _ := PolicyLookup(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r != nil {
+			return uint8(r.Action)
+		}
+		return POLICY_ACTION_OF_UNKNOWN
+	}
+
+	for _, v := range []struct {
+		name   string
+		proto  uint8
+		port   uint16
+		action uint8
+	}{
+		{"range", 6, 8100, POLICY_ACTION_OF_PASS},
+		{"narrower range", 6, 8551, POLICY_ACTION_OF_DROP},
+		{"exact port", 6, 8550, POLICY_ACTION_OF_MTLS},
+		{"any protocol", 6, 9500, POLICY_ACTION_OF_AUDIT},
+		{"other protocol", 17, 8100, POLICY_ACTION_OF_AUDIT},
+		{"other protocol in a narrower range", 17, 8551, POLICY_ACTION_OF_AUDIT},
+		{"any protocol port", 17, 53, POLICY_ACTION_OF_DROP},
+		{"protocol before any protocol", 6, 250, POLICY_ACTION_OF_PASS},
+		{"any protocol of the same range", 17, 250, POLICY_ACTION_OF_DROP},
+		{"past the ranges", 6, 10000, POLICY_ACTION_OF_UNKNOWN},
+	} {
+		if a := lookup(v.proto, v.port); a != v.action {
+			t.Errorf("%s: %d/%d action %s, want %s", v.name, v.proto, v.port, Action(a), Action(v.action))
+		}
+	}
+
+	if err := PolicyDel(portPara(6, 8500, 8599)); err != nil {
+		t.Fatal(err)
+	}
+	if a := lookup(6, 8551); a != POLICY_ACTION_OF_PASS {
+		t.Errorf("action %s after deleting the narrower range, want pass", Action(a))
+	}
+}
+
+func TestPortRangeInvalid(t *testing.T) {
+	defer PolicyDeleteAll()
+
+	for _, arg := range []*PolicyOpPara{
+		portPara(6, 9000, 8000),
+		portPara(base.PROTO_OF_ANY, 0, 0),
+	} {
+		if err := PolicyAdd(arg, Action(POLICY_ACTION_OF_DROP)); err == nil {
+			t.Errorf("added proto %d ports %d-%d", arg.Proto, arg.Port, arg.PortMax)
+		}
+	}
+}
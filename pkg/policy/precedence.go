@@ -0,0 +1,167 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"math"
+	"regexp/syntax"
+)
+
+// how restrictive every action is, the most restrictive wins a tie
+var actionWeights = [POLICY_ACTION_OF_MAX]uint8{
+	POLICY_ACTION_OF_UNKNOWN:   0,
+	POLICY_ACTION_OF_PASS:      1,
+	POLICY_ACTION_OF_AUDIT:     2,
+	POLICY_ACTION_OF_RATELIMIT: 3,
+	POLICY_ACTION_OF_REDIRECT:  4,
+	POLICY_ACTION_OF_MTLS:      5,
+	POLICY_ACTION_OF_REJECT:    6,
+	POLICY_ACTION_OF_DROP:      7,
+}
+
+func (a Action) weight() uint8 {
+	if uint8(a) >= POLICY_ACTION_OF_MAX {
+		return 0
+	}
+
+	return actionWeights[a]
+}
+
+// specificity is the number of literal characters every match of pattern
+// holds, 0 if it doesn't parse.
+func specificity(pattern string) int {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+
+	return literals(re)
+}
+
+func literals(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return literals(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min * literals(re.Sub[0])
+	case syntax.OpConcat:
+		n := 0
+		for _, v := range re.Sub {
+			n += literals(v)
+		}
+		return n
+	case syntax.OpAlternate:
+		n := -1
+		for _, v := range re.Sub {
+			if m := literals(v); n < 0 || m < n {
+				n = m
+			}
+		}
+		return n
+	}
+
+	return 0
+}
+
+type candidate struct {
+	api  base.ApiService
+	res  *Result
+	spec int
+	plen int
+	prio int
+}
+
+func (p *PolicyCbs) candidate(api *base.ApiService, res *Result) *candidate {
+	pattern := p.Pattern(api.Uri)
+	v := &candidate{
+		api:  *api,
+		res:  res,
+		spec: specificity(pattern),
+		plen: len(pattern),
+		prio: math.MaxUint16 + 1,
+	}
+	if res.Rule != nil {
+		if r, ok := p.rules[res.Rule.Id]; ok {
+			v.prio = int(r.Cell.Prio)
+		}
+	}
+
+	return v
+}
+
+// precedes tells if a decides over b when one path matches both patterns:
+// a matched rule over a default, then the most specific and longest
+// pattern, then the rule priority, then the most restrictive action.
+func (a *candidate) precedes(b *candidate) bool {
+	if (a.res.Rule != nil) != (b.res.Rule != nil) {
+		return a.res.Rule != nil
+	}
+	if a.spec != b.spec {
+		return a.spec > b.spec
+	}
+	if a.plen != b.plen {
+		return a.plen > b.plen
+	}
+	if a.prio != b.prio {
+		return a.prio < b.prio
+	}
+	if wa, wb := a.res.Action.weight(), b.res.Action.weight(); wa != wb {
+		return wa > wb
+	}
+
+	return a.api.Uri < b.api.Uri
+}
+
+// pick resolves every service and returns the results with the index of
+// the one deciding, -1 if as is empty.
+func (p *PolicyCbs) pick(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	as []base.ApiService,
+	path string) ([]*Result, int) {
+	var best *candidate
+
+	rs := make([]*Result, 0, len(as))
+	at := -1
+	for i := range as {
+		v := p.candidate(&as[i], p.resolve(c, dir, method, &as[i], path, 0))
+		if best == nil || v.precedes(best) {
+			best, at = v, i
+		}
+		rs = append(rs, v.res)
+	}
+
+	return rs, at
+}
+
+// evaluate scans path and returns the one decision of the patterns it
+// matches, with the hit of the deciding rule counted at now if not 0.
+func (p *PolicyCbs) evaluate(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string,
+	now int64) (*Result, *base.ApiService, error) {
+	as, err := p.ApiServices(s.Type, s.Proto, s.Port, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rs, at := p.pick(c, dir, method, as, path)
+	if at < 0 {
+		api := &base.ApiService{Type: s.Type, Proto: s.Proto, Port: s.Port}
+		return p.resolve(c, dir, method, api, path, now), api, nil
+	}
+
+	r := rs[at]
+	if now != 0 && r.Rule != nil {
+		if v, ok := p.rules[r.Rule.Id]; ok {
+			v.Attr.Stats.hit(dir, now)
+			p.chainHit(v)
+		}
+	}
+	r.Pattern = p.Pattern(as[at].Uri)
+
+	return r, &as[at], nil
+}
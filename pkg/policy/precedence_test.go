@@ -0,0 +1,46 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"net/netip"
+	"testing"
+)
+
+// TestEvaluateCounts has Evaluate count the hit of the rule it decides by,
+// also when the path matches no pattern and a cell for any uri decides.
+func TestEvaluateCounts(t *testing.T) {
+	e := defaultEngine
+	defer PolicyDeleteAll()
+
+	a := &PolicyOpPara{Cidr: "10.0.0.0/8", Workload: 5, Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "^/a"}
+	ra := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := PolicyAddAttr(a, ra); err != nil {
+		t.Fatal(err)
+	}
+	any := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	e.Lock()
+	err := e.cbs.Update(&RuleCell{Workload: 5, Dir: base.L7_INGRESS, Api: base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}}, any)
+	e.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Workload: 5}
+	s := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}
+	for _, v := range []struct {
+		path string
+		id   uint64
+	}{
+		{"/a", ra.Id},
+		{"/b", any.Id},
+	} {
+		r, err := Evaluate(c, base.L7_INGRESS, base.HTTP_GET, s, v.path)
+		if err != nil || r.Rule == nil || r.Rule.Id != v.id {
+			t.Fatalf("%s: result %+v, %v", v.path, r, err)
+		}
+		if st, _ := PolicyStats(v.id); st.Hits != 1 {
+			t.Errorf("%s: %d hits, want 1", v.path, st.Hits)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type schedEntry struct {
+	cell RuleCell
+	attr *RuleAttr
+}
+
+// SchedCbs tracks the rules carrying a schedule, Tick flips them in and out
+// of service and removes the expired ones.
+type SchedCbs struct {
+	sync.Mutex
+	db map[uint64]*schedEntry
+}
+
+func (s *SchedCbs) Init() {
+	s.db = make(map[uint64]*schedEntry)
+}
+
+func (s *SchedCbs) Add(rk *RuleCell, ra *RuleAttr, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	setActive(ra, ra.Schedule.Active(now))
+	s.db[ra.Id] = &schedEntry{cell: *rk, attr: ra}
+}
+
+func (s *SchedCbs) DeleteAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	for k := range s.db {
+		delete(s.db, k)
+	}
+}
+
+func (s *SchedCbs) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.db)
+}
+
+func setActive(ra *RuleAttr, active bool) {
+	if active {
+		atomic.StoreUint32(&ra.inactive, 0)
+	} else {
+		atomic.StoreUint32(&ra.inactive, 1)
+	}
+}
+
+// Tick evaluates every scheduled rule at now, it returns the number of
+// expired rules removed. The caller holds the PolicyCbs write lock.
+func (p *PolicyCbs) Tick(now time.Time) int {
+	p.sched.Lock()
+	defer p.sched.Unlock()
+
+	n := 0
+	for id, e := range p.sched.db {
+		// replaced or deleted since it was scheduled
+		if p.get(&e.cell) != e.attr {
+			delete(p.sched.db, id)
+			continue
+		}
+
+		if e.attr.Schedule.Expired(now) {
+			p.Delete(&e.cell)
+			delete(p.sched.db, id)
+			n++
+			continue
+		}
+
+		setActive(e.attr, e.attr.Schedule.Active(now))
+	}
+
+	return n
+}
@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"l7/pkg/schedule"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestScheduleTick flips a rule with a window in and out of service and
+// removes it once past its end.
+func TestScheduleTick(t *testing.T) {
+	t0 := time.Date(2023, 11, 14, 8, 0, 0, 0, time.UTC)
+	fc := clock.NewFakeClock(t0)
+	PolicySetClock(fc)
+	defer PolicySetClock(clock.SysClock{})
+	defer PolicyDeleteAll()
+
+	w, err := schedule.ParseWindow("09:00-17:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/a"}
+	ra := &RuleAttr{
+		Action:   Action(POLICY_ACTION_OF_DROP),
+		Schedule: &schedule.Schedule{Windows: []schedule.Window{w}, NotAfter: t0.Add(48 * time.Hour)},
+	}
+	if err := PolicyAddAttr(arg, ra); err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	live := func() bool {
+		r, _ := PolicyLookup(c, base.L7_INGRESS, base.HTTP_GET, &as[0])
+		return r != nil
+	}
+	tick := func(d time.Duration) int {
+		fc.Set(t0.Add(d))
+		return PolicyScheduleTick()
+	}
+
+	if live() {
+		t.Error("rule live before its window")
+	}
+	if n := tick(time.Hour); n != 0 || !live() {
+		t.Errorf("9:00: %d removed, live %v", n, live())
+	}
+	if n := tick(9 * time.Hour); n != 0 || live() {
+		t.Errorf("17:00: %d removed, live %v", n, live())
+	}
+	if n := tick(25 * time.Hour); n != 0 || !live() {
+		t.Errorf("next day 9:00: %d removed, live %v", n, live())
+	}
+
+	// past the end it goes, whatever the window
+	if n := tick(49 * time.Hour); n != 1 || live() {
+		t.Errorf("expired: %d removed, live %v", n, live())
+	}
+	if n := tick(50 * time.Hour); n != 0 {
+		t.Errorf("%d removed again", n)
+	}
+}
@@ -0,0 +1,340 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+)
+
+// expand returns the parameters of every cell of s, each combination once.
+// The groups of s must be filled in already.
+func (s *PolicyOpSet) expand() []PolicyOpPara {
+	cidrs, methods, paths, svcs := s.Cidrs, s.Methods, s.Httpaths, s.Services
+	if len(cidrs) == 0 {
+		cidrs = []string{s.Cidr}
+	}
+	if len(methods) == 0 {
+		methods = []base.Method{s.Method}
+	}
+	if len(paths) == 0 {
+		paths = []string{s.Httpath}
+	}
+	if len(svcs) == 0 {
+		svcs = []base.ApiService{{Type: s.Type, Proto: s.Proto, Port: s.Port, PortMax: s.PortMax}}
+	}
+
+	var r []PolicyOpPara
+	seen := make(map[PolicyOpPara]bool)
+	for _, c := range cidrs {
+		for _, m := range methods {
+			for _, h := range paths {
+				for _, a := range svcs {
+					v := s.PolicyOpPara
+					v.Cidr, v.Method, v.Httpath = c, m, h
+					v.Type, v.Proto, v.Port, v.PortMax = a.Type, a.Proto, a.Port, a.PortMax
+					if !seen[v] {
+						seen[v] = true
+						r = append(r, v)
+					}
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+// isSet tells if s names more than the single fields.
+func (s *PolicyOpSet) isSet() bool {
+	return len(s.Cidrs) != 0 || len(s.Methods) != 0 || len(s.Httpaths) != 0 || len(s.Services) != 0 ||
+		s.AddrGroup != "" || s.UriGroup != "" || s.SvcGroup != ""
+}
+
+// AddSet registers the address and uri objects of every cell of set and adds
+// them as one rule, the id of the new rule is set in ra.
+func (p *PolicyCbs) AddSet(set *PolicyOpSet, ra *RuleAttr) error {
+	if err := ra.check(); err != nil {
+		return err
+	}
+
+	rks, paras, err := p.cells(set)
+	if err != nil {
+		return err
+	}
+	olds, err := p.covered(rks, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := p.checkQuota(rks, paras, len(olds)); err != nil {
+		return err
+	}
+
+	attr := &RuleAttr{
+		Action:    ra.Action,
+		Reject:    ra.Reject,
+		Redirect:  ra.Redirect,
+		RateLimit: ra.RateLimit,
+		Except:    ra.Except,
+		Schedule:  ra.Schedule,
+	}
+
+	attr.Id = p.nextId(set)
+	if err := p.install(set, rks, paras, olds, attr, p.Now().UnixNano()); err != nil {
+		return err
+	}
+	ra.Id = attr.Id
+
+	return nil
+}
+
+// UpdateSet replaces the cells and attributes of rule id by those of set
+// and ra, the rule keeps its id, stats and creation time. The other rules
+// holding one of the cells are replaced as in AddSet.
+func (p *PolicyCbs) UpdateSet(id uint64, set *PolicyOpSet, ra *RuleAttr) error {
+	old, ok := p.rules[id]
+	if !ok {
+		return fmt.Errorf("rule %d not found", id)
+	}
+	if err := ra.check(); err != nil {
+		return err
+	}
+
+	rks, paras, err := p.cells(set)
+	if err != nil {
+		return err
+	}
+	olds, err := p.covered(rks, id)
+	if err != nil {
+		return err
+	}
+	olds = append(olds, id)
+
+	if err := p.checkQuota(rks, paras, len(olds)); err != nil {
+		return err
+	}
+
+	attr := &RuleAttr{
+		Id:        id,
+		Action:    ra.Action,
+		Stats:     old.Attr.Stats.Load(),
+		Reject:    ra.Reject,
+		Redirect:  ra.Redirect,
+		RateLimit: ra.RateLimit,
+		Except:    ra.Except,
+		Schedule:  ra.Schedule,
+	}
+	if err := p.install(set, rks, paras, olds, attr, old.Created); err != nil {
+		return err
+	}
+	ra.Id = id
+
+	return nil
+}
+
+// cells returns the cells of set and their parameters, the uri of a cell is
+// 0 if its pattern is new and its address objects addrNew if new, nothing is
+// allocated until install.
+func (p *PolicyCbs) cells(set *PolicyOpSet) ([]RuleCell, []PolicyOpPara, error) {
+	v, err := p.members(set)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paras := v.expand()
+	rks := make([]RuleCell, 0, len(paras))
+	for i := range paras {
+		rk, err := p.cell(&paras[i], p.uoc.FindUri(paras[i].Httpath))
+		if err != nil {
+			return nil, nil, err
+		}
+		rks = append(rks, *rk)
+	}
+
+	return rks, paras, nil
+}
+
+// install registers the objects of rks and adds them as rule ra.Id in
+// place of the rules olds, set is kept if it names more than one cell.
+func (p *PolicyCbs) install(set *PolicyOpSet, rks []RuleCell, paras []PolicyOpPara, olds []uint64, ra *RuleAttr, created int64) error {
+	// cidrs written differently may still be one cell
+	seen := make(map[RuleCell]bool)
+	n := 0
+	for i := range rks {
+		p.register(&rks[i], &paras[i])
+		if !seen[rks[i]] {
+			seen[rks[i]] = true
+			rks[n], paras[n] = rks[i], paras[i]
+			n++
+		}
+	}
+	rks, paras = rks[:n], paras[:n]
+
+	if err := p.insert(rks, olds, ra, created); err != nil {
+		return err
+	}
+
+	r := p.rules[ra.Id]
+	r.Para = paras[0]
+	if set.isSet() {
+		s := *set
+		s.Cidrs = append([]string(nil), set.Cidrs...)
+		s.Methods = append([]base.Method(nil), set.Methods...)
+		s.Httpaths = append([]string(nil), set.Httpaths...)
+		s.Services = append([]base.ApiService(nil), set.Services...)
+		r.Set = &s
+		r.paras = paras
+	}
+
+	return nil
+}
+
+// DelSet deletes the rules holding a cell of set.
+func (p *PolicyCbs) DelSet(set *PolicyOpSet) error {
+	v, err := p.members(set)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, arg := range v.expand() {
+		uri := p.uoc.FindUri(arg.Httpath)
+		if uri == 0 {
+			continue
+		}
+		found = true
+
+		rk, err := p.cell(&arg, uri)
+		if err != nil {
+			return err
+		}
+		p.Delete(rk)
+	}
+	if !found {
+		return fmt.Errorf("httpath not found")
+	}
+
+	return nil
+}
+
+// OverlapError rejects a rule holding some but not all of the cells of rule
+// Other, replacing Other would silently drop the rest of it.
+type OverlapError struct {
+	Other  uint64
+	Shared int // cells of Other the rule holds too
+	Cells  int // cells of Other
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("rule holds %d of the %d cells of rule %d", e.Shared, e.Cells, e.Other)
+}
+
+// covered returns the rules other than self holding a cell of rks, in the
+// order of rks. Each must have all of its cells in rks, a rule only replaces
+// the rules it covers whole.
+func (p *PolicyCbs) covered(rks []RuleCell, self uint64) ([]uint64, error) {
+	in := make(map[RuleCell]bool, len(rks))
+	for i := range rks {
+		in[rks[i]] = true
+	}
+
+	var r []uint64
+	seen := make(map[uint64]bool)
+	for i := range rks {
+		old := p.get(&rks[i])
+		if old == nil || old.Id == self || seen[old.Id] {
+			continue
+		}
+		seen[old.Id] = true
+
+		v, ok := p.rules[old.Id]
+		if !ok {
+			continue
+		}
+		n := 0
+		for j := range v.Cells {
+			if in[v.Cells[j]] {
+				n++
+			}
+		}
+		if n != len(v.Cells) {
+			return nil, &OverlapError{Other: old.Id, Shared: n, Cells: len(v.Cells)}
+		}
+		r = append(r, old.Id)
+	}
+
+	return r, nil
+}
+
+// insert adds the cells rks as rule ra.Id in place of the rules olds, see
+// covered.
+func (p *PolicyCbs) insert(rks []RuleCell, olds []uint64, ra *RuleAttr, created int64) error {
+	// held first, objects shared with olds must outlive them
+	for i := range rks {
+		p.hold(&rks[i])
+	}
+	for _, id := range olds {
+		p.remove(id)
+	}
+
+	for i := range rks {
+		rk := &rks[i]
+
+		var err error
+		if rk.Workload == 0 && rk.Role == 0 {
+			err = p.l3Update(rk.Prio, rk.Id, rk.Dir, rk.Method, &rk.Api, &rk.Dst, ra)
+		} else {
+			err = p.l7Update(rk.Prio, rk.Id, rk.Workload, rk.Role, rk.Group, rk.Dir, rk.Method, &rk.Api, &rk.Dst, ra)
+		}
+		if err != nil {
+			return err
+		}
+		if rk.Api.PortMax != 0 {
+			p.ports.Add(&rk.Api)
+		}
+	}
+
+	p.bump()
+	p.rules[ra.Id] = &Rule{
+		Id:      ra.Id,
+		Cell:    rks[0],
+		Cells:   rks,
+		Attr:    ra,
+		Created: created,
+	}
+
+	if ra.Schedule != nil {
+		p.sched.Add(&rks[0], ra, p.Now())
+	}
+
+	return nil
+}
+
+// remove takes every cell of rule id out of its chain.
+func (p *PolicyCbs) remove(id uint64) {
+	r, ok := p.rules[id]
+	if !ok {
+		return
+	}
+	delete(p.rules, id)
+
+	for i := range r.Cells {
+		rk := &r.Cells[i]
+		p.release(rk)
+		if p.get(rk) != r.Attr {
+			continue
+		}
+		if rk.Api.PortMax != 0 {
+			p.ports.Delete(&rk.Api)
+		}
+
+		if rk.Workload == 0 && rk.Role == 0 {
+			if v := p.l3Chain(rk.Prio, false); v != nil {
+				v.Delete(rk.l3Key())
+			}
+		} else if v := p.l7Chain(rk.Prio, false); v != nil {
+			v.Delete(rk.l7Key())
+		}
+	}
+	p.prune()
+	p.bump()
+}
@@ -0,0 +1,83 @@
+package policy
+
+import (
+	"errors"
+	"l7/pkg/base"
+	"testing"
+)
+
+func testSet(paths ...string) *PolicyOpSet {
+	return &PolicyOpSet{
+		PolicyOpPara: PolicyOpPara{
+			Cidr:  "10.0.0.0/8",
+			Dir:   base.L7_INGRESS,
+			Type:  base.SERVICE_OF_HTTP,
+			Proto: 6,
+			Port:  80,
+		},
+		Httpaths: paths,
+	}
+}
+
+func TestAddSetPartialOverlap(t *testing.T) {
+	e := NewEngine()
+
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(testSet("/a", "/b"), a); err != nil {
+		t.Fatal(err)
+	}
+
+	var oe *OverlapError
+	err := e.AddSet(testSet("/b", "/c"), &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)})
+	if !errors.As(err, &oe) || oe.Other != a.Id || oe.Shared != 1 || oe.Cells != 2 {
+		t.Fatalf("partial overlap added, err %v", err)
+	}
+	if r, err := e.Get(a.Id); err != nil || len(r.Cells) != 2 {
+		t.Fatalf("rule %d lost cells, %v %v", a.Id, r.Cells, err)
+	}
+
+	// a rule covering every cell of another one replaces it
+	b := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := e.AddSet(testSet("/a", "/b", "/c"), b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get(a.Id); err == nil {
+		t.Fatalf("covered rule %d kept", a.Id)
+	}
+	if rs := e.Dump(); len(rs) != 1 || rs[0].Id != b.Id {
+		t.Fatalf("rules %v, want only %d", rs, b.Id)
+	}
+}
+
+func TestUpdateSet(t *testing.T) {
+	e := NewEngine()
+
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	b := &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}
+	if err := e.AddSet(testSet("/a"), a); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSet(testSet("/b"), b); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddBytes(a.Id, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// taking the cell of b replaces it, a keeps its id and stats
+	ra := &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}
+	if err := e.UpdateSet(a.Id, testSet("/a", "/b"), ra); err != nil {
+		t.Fatal(err)
+	}
+	rs := e.Dump()
+	if len(rs) != 1 || rs[0].Id != a.Id || ra.Id != a.Id || uint8(rs[0].Attr.Action) != POLICY_ACTION_OF_PASS || len(rs[0].Cells) != 2 {
+		t.Fatalf("rules %+v", rs)
+	}
+	if st, _ := e.Stats(a.Id); st.Bytes != 10 {
+		t.Errorf("stats %+v", st)
+	}
+
+	if err := e.UpdateSet(b.Id, testSet("/c"), ra); err == nil {
+		t.Error("replaced rule updated")
+	}
+}
@@ -0,0 +1,259 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_SHADOW_RING = 1024
+)
+
+// Mismatch is a decision the shadow set disagrees with, both results carry
+// the matched rule if any.
+type Mismatch struct {
+	Time    int64
+	Client  base.Client
+	Dir     base.Direction
+	Method  base.Method
+	Pattern string
+	Path    string
+	Live    Result
+	Shadow  Result
+}
+
+type ShadowReport struct {
+	Lookups    uint64
+	Diffs      uint64
+	Mismatches []Mismatch // the last ones, oldest first
+}
+
+// Rate is the share of lookups the shadow set decided otherwise.
+func (r *ShadowReport) Rate() float64 {
+	if r.Lookups == 0 {
+		return 0
+	}
+
+	return float64(r.Diffs) / float64(r.Lookups)
+}
+
+// ShadowDiff counts the shadow lookups and keeps the last mismatches.
+type ShadowDiff struct {
+	sync.Mutex
+	lookups uint64 // read atomically
+	diffs   uint64
+	size    int
+	ring    []Mismatch // made by the first mismatch
+	next    int
+	full    bool
+}
+
+func (d *ShadowDiff) Init(size int) {
+	d.size = size
+}
+
+func (d *ShadowDiff) record(m *Mismatch) {
+	atomic.AddUint64(&d.lookups, 1)
+	if m == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.diffs++
+	if d.ring == nil {
+		d.ring = make([]Mismatch, d.size)
+	}
+	d.ring[d.next] = *m
+	d.next++
+	if d.next == len(d.ring) {
+		d.next = 0
+		d.full = true
+	}
+}
+
+func (d *ShadowDiff) Reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	atomic.StoreUint64(&d.lookups, 0)
+	d.diffs = 0
+	d.next = 0
+	d.full = false
+}
+
+func (d *ShadowDiff) Report() ShadowReport {
+	d.Lock()
+	defer d.Unlock()
+
+	r := ShadowReport{
+		Lookups: atomic.LoadUint64(&d.lookups),
+		Diffs:   d.diffs,
+	}
+	if d.full {
+		r.Mismatches = append(r.Mismatches, d.ring[d.next:]...)
+	}
+	r.Mismatches = append(r.Mismatches, d.ring[:d.next]...)
+
+	return r
+}
+
+// intended is the action before rate limiting, a throttled request
+// agrees with any rate limit rule.
+func (r *Result) intended() Action {
+	if r.Throttled {
+		return Action(POLICY_ACTION_OF_RATELIMIT)
+	}
+
+	return r.Action
+}
+
+// compare decides s in the shadow set too and records a mismatch with live.
+// The uri is carried over by pattern so both sets decide on the same one,
+// Evaluate compares whole scans in compareEval. The caller holds e.
+func (e *Engine) compare(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	path string,
+	live *Result) {
+	pattern := e.cbs.Pattern(s.Uri)
+
+	sh := e.shadow
+	sh.RLock()
+	defer sh.RUnlock()
+
+	ss := *s
+	ss.Uri = base.UriId(sh.cbs.uoc.FindUri(pattern))
+
+	now := sh.cbs.Now().UnixNano()
+	e.record(c, dir, method, pattern, path, live, sh.cbs.resolve(c, dir, method, &ss, path, now), now)
+}
+
+// compareEval is compare for Evaluate, the shadow set scans path with its
+// own patterns. pattern is the one live was decided on.
+func (e *Engine) compareEval(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	s *base.ApiService,
+	pattern, path string,
+	live *Result) {
+	sh := e.shadow
+	sh.RLock()
+	defer sh.RUnlock()
+
+	now := sh.cbs.Now().UnixNano()
+	r, _, err := sh.cbs.evaluate(c, dir, method, s, path, now)
+	if err != nil {
+		return
+	}
+	e.record(c, dir, method, pattern, path, live, r, now)
+}
+
+func (e *Engine) record(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	pattern, path string,
+	live, shadow *Result,
+	now int64) {
+	if shadow.Action == live.intended() {
+		e.diff.record(nil)
+		return
+	}
+
+	e.diff.record(&Mismatch{
+		Time:    now,
+		Client:  *c,
+		Dir:     dir,
+		Method:  method,
+		Pattern: pattern,
+		Path:    path,
+		Live:    *live,
+		Shadow:  *shadow,
+	})
+}
+
+// Shadow returns the candidate rule set, created empty on first use. It is
+// filled with the usual Add and Apply, evaluated on every Decide of e and
+// never enforced.
+func (e *Engine) Shadow() *Engine {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.shadow == nil {
+		e.shadow = NewEngine()
+		e.shadow.cbs.SetClock(e.cbs.clock)
+		e.diff.Reset()
+	}
+
+	return e.shadow
+}
+
+func (e *Engine) DropShadow() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.shadow = nil
+	e.diff.Reset()
+}
+
+func (e *Engine) ShadowReport() ShadowReport {
+	return e.diff.Report()
+}
+
+func (e *Engine) ShadowReset() {
+	e.diff.Reset()
+}
+
+// Promote makes the shadow set live at once. The observers and the quota
+// stay with e and the replaced set becomes the shadow, so promoting again
+// rolls back.
+func (e *Engine) Promote() error {
+	e.Lock()
+	defer e.Unlock()
+
+	sh := e.shadow
+	if sh == nil {
+		return fmt.Errorf("no shadow policy")
+	}
+
+	e.swap(sh)
+	e.diff.Reset()
+
+	return nil
+}
+
+// Replace makes the rule set of n live at once and leaves the replaced one in
+// n. The observers and the quota stay with e, the shadow set is kept. The
+// rules of n that kept their id, see Next, go on with their stats and rate
+// limit buckets.
+func (e *Engine) Replace(n *Engine) {
+	e.Lock()
+	defer e.Unlock()
+
+	n.Lock()
+	n.cbs.carry(e.cbs)
+	n.Unlock()
+	e.swap(n)
+}
+
+// swap exchanges the rule sets of e and n, the caller holds the lock of e.
+func (e *Engine) swap(n *Engine) {
+	n.Lock()
+	defer n.Unlock()
+
+	live, cand := e.cbs, n.cbs
+	live.obs, cand.obs = cand.obs, live.obs
+	live.quota, cand.quota = cand.quota, live.quota
+
+	gen := live.Generation()
+	if g := cand.Generation(); g > gen {
+		gen = g
+	}
+	atomic.StoreUint64(&cand.gen, gen+1)
+
+	e.cbs, n.cbs = cand, live
+}
@@ -0,0 +1,190 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestShadowMismatch(t *testing.T) {
+	e := NewEngine()
+	if err := e.AddSet(testSet("^/a"), &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := e.Shadow()
+	if err := sh.AddSet(testSet("^/a"), &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	as, err := e.ApiServices(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	if r := e.DecidePath(c, base.L7_INGRESS, base.HTTP_GET, &as[0], "/a"); uint8(r.Action) != POLICY_ACTION_OF_PASS {
+		t.Fatalf("live action %v, want pass", r.Action)
+	}
+
+	rp := e.ShadowReport()
+	if rp.Lookups != 1 || rp.Diffs != 1 || len(rp.Mismatches) != 1 {
+		t.Fatalf("report %+v, want one mismatch", rp)
+	}
+	m := rp.Mismatches[0]
+	if m.Pattern != "^/a" || m.Path != "/a" || uint8(m.Shadow.Action) != POLICY_ACTION_OF_DROP {
+		t.Fatalf("mismatch %+v", m)
+	}
+
+	if err := e.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if r := e.DecidePath(c, base.L7_INGRESS, base.HTTP_GET, &as[0], "/a"); uint8(r.Action) != POLICY_ACTION_OF_DROP {
+		t.Fatalf("promoted action %v, want drop", r.Action)
+	}
+}
+
+// TestShadowOwnPatterns has Evaluate scan the path with the shadow patterns.
+func TestShadowOwnPatterns(t *testing.T) {
+	e := NewEngine()
+	if err := e.AddSet(testSet("^/a"), &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shadow set drops a path the live set has no pattern for
+	sh := e.Shadow()
+	if err := sh.AddSet(testSet("^/a"), &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.AddSet(testSet("^/a/admin"), &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	s := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}
+	r, err := e.Evaluate(c, base.L7_INGRESS, base.HTTP_GET, s, "/a/admin")
+	if err != nil || uint8(r.Action) != POLICY_ACTION_OF_PASS {
+		t.Fatalf("live action %v, %v, want pass", r, err)
+	}
+
+	rp := e.ShadowReport()
+	if rp.Lookups != 1 || len(rp.Mismatches) != 1 {
+		t.Fatalf("report %+v, want one mismatch", rp)
+	}
+	m := rp.Mismatches[0]
+	if m.Pattern != "^/a" || uint8(m.Shadow.Action) != POLICY_ACTION_OF_DROP || m.Shadow.Pattern != "^/a/admin" {
+		t.Fatalf("mismatch %+v", m)
+	}
+}
+
+func TestShadowIdentical(t *testing.T) {
+	e := NewEngine()
+	sh := e.Shadow()
+	for _, v := range []*Engine{e, sh} {
+		if err := v.AddSet(testSet("^/a"), &RuleAttr{Action: Action(POLICY_ACTION_OF_PASS)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.AddSet(testSet("^/a/b"), &RuleAttr{Action: Action(POLICY_ACTION_OF_DROP)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every pattern of the path decided alone, by both sets
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	as, err := e.ApiServices(base.SERVICE_OF_HTTP, 6, 80, "/a/b")
+	if err != nil || len(as) != 2 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	for i := range as {
+		e.DecidePath(c, base.L7_INGRESS, base.HTTP_GET, &as[i], "/a/b")
+	}
+	if _, err := e.Evaluate(c, base.L7_INGRESS, base.HTTP_GET, &as[0], "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rp := e.ShadowReport(); rp.Lookups != 3 || rp.Diffs != 0 {
+		t.Fatalf("report %+v, want no diffs", rp)
+	}
+}
+
+// TestReplaceKeeps rebuilds a rule set from Next, the rules that stay keep
+// their ids, stats, rate limit buckets and the clock.
+func TestReplaceKeeps(t *testing.T) {
+	fc := clock.NewFakeClock(time.Unix(1700000000, 0))
+	e := NewEngine()
+	e.SetClock(fc)
+
+	add := func(e *Engine, path string, a uint8) uint64 {
+		ra := &RuleAttr{Action: Action(a)}
+		if a == POLICY_ACTION_OF_RATELIMIT {
+			ra.RateLimit = &RateLimitPara{Rate: 1, Burst: 1}
+		}
+		if err := e.AddSet(testSet(path), ra); err != nil {
+			t.Fatal(err)
+		}
+		return ra.Id
+	}
+	a := add(e, "^/a", POLICY_ACTION_OF_RATELIMIT)
+	b := add(e, "^/b", POLICY_ACTION_OF_DROP)
+	if err := e.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	s := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}
+	throttled := func(path string) bool {
+		r, err := e.Evaluate(c, base.L7_INGRESS, base.HTTP_GET, s, path)
+		if err != nil || r.Rule == nil {
+			t.Fatalf("%s: result %+v, %v", path, r, err)
+		}
+		return r.Throttled
+	}
+	if throttled("/a") || !throttled("/a") || throttled("/b") {
+		t.Fatal("throttled before the swap")
+	}
+
+	// in another order, with a new rule first
+	n := e.Next()
+	nc := add(n, "^/c", POLICY_ACTION_OF_DROP)
+	nb := add(n, "^/b", POLICY_ACTION_OF_DROP)
+	na := add(n, "^/a", POLICY_ACTION_OF_RATELIMIT)
+	if err := n.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if na != a || nb != b || nc <= b {
+		t.Fatalf("ids %d %d %d, were %d %d", na, nb, nc, a, b)
+	}
+	e.Replace(n)
+
+	if st, _ := e.Stats(a); st.Hits != 2 || st.Actions[POLICY_ACTION_OF_DROP] != 1 {
+		t.Errorf("stats of /a %+v", st)
+	}
+	if st, _ := e.Stats(b); st.Hits != 1 {
+		t.Errorf("stats of /b %+v", st)
+	}
+
+	// the bucket of /a is still empty and refills on the fake clock
+	if !throttled("/a") {
+		t.Error("bucket of /a refilled by the swap")
+	}
+	fc.Advance(time.Second)
+	if throttled("/a") {
+		t.Error("bucket of /a not refilled")
+	}
+}
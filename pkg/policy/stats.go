@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"sync/atomic"
+)
+
+func (s *RuleStats) hit(dir base.Direction, now int64) {
+	atomic.AddUint64(&s.Hits, 1)
+	if int(dir) < len(s.DirHits) {
+		atomic.AddUint64(&s.DirHits[dir], 1)
+	}
+
+	atomic.CompareAndSwapInt64(&s.FirstHit, 0, now)
+	for {
+		last := atomic.LoadInt64(&s.LastHit)
+		if last >= now || atomic.CompareAndSwapInt64(&s.LastHit, last, now) {
+			break
+		}
+	}
+}
+
+// decided counts a decision by its final action.
+func (s *RuleStats) decided(a Action) {
+	if uint8(a) < POLICY_ACTION_OF_MAX {
+		atomic.AddUint64(&s.Actions[a], 1)
+	}
+}
+
+// Load returns a consistent-enough snapshot, every field is read atomically.
+func (s *RuleStats) Load() RuleStats {
+	var r RuleStats
+
+	r.Hits = atomic.LoadUint64(&s.Hits)
+	r.FirstHit = atomic.LoadInt64(&s.FirstHit)
+	r.LastHit = atomic.LoadInt64(&s.LastHit)
+	for i := range s.DirHits {
+		r.DirHits[i] = atomic.LoadUint64(&s.DirHits[i])
+	}
+	for i := range s.Actions {
+		r.Actions[i] = atomic.LoadUint64(&s.Actions[i])
+	}
+	r.Bytes = atomic.LoadUint64(&s.Bytes)
+
+	return r
+}
+
+func (s *RuleStats) Reset() {
+	atomic.StoreUint64(&s.Hits, 0)
+	atomic.StoreInt64(&s.FirstHit, 0)
+	atomic.StoreInt64(&s.LastHit, 0)
+	for i := range s.DirHits {
+		atomic.StoreUint64(&s.DirHits[i], 0)
+	}
+	for i := range s.Actions {
+		atomic.StoreUint64(&s.Actions[i], 0)
+	}
+	atomic.StoreUint64(&s.Bytes, 0)
+}
+
+func (ra *RuleAttr) copy() *RuleAttr {
+	st := ra.Stats.Load()
+
+	return &RuleAttr{
+		Id:      ra.Id,
+		Action:  ra.Action,
+		Stats:   st,
+		Counter: st.Hits,
+
+		Reject:    ra.Reject,
+		Redirect:  ra.Redirect,
+		RateLimit: ra.RateLimit,
+		Except:    ra.Except,
+		Schedule:  ra.Schedule,
+	}
+}
+
+func (p *PolicyCbs) Stats(id uint64) (RuleStats, bool) {
+	r, ok := p.rules[id]
+	if !ok {
+		return RuleStats{}, false
+	}
+
+	return r.Attr.Stats.Load(), true
+}
+
+// AddBytes adds n bytes to the traffic of rule id.
+func (p *PolicyCbs) AddBytes(id uint64, n uint64) bool {
+	r, ok := p.rules[id]
+	if !ok {
+		return false
+	}
+
+	atomic.AddUint64(&r.Attr.Stats.Bytes, n)
+	return true
+}
+
+// count records the final action of res on its rule.
+func (p *PolicyCbs) count(res *Result) {
+	if res.Rule == nil {
+		return
+	}
+	if r, ok := p.rules[res.Rule.Id]; ok {
+		r.Attr.Stats.decided(res.Action)
+	}
+}
+
+func (p *PolicyCbs) StatsReset(id uint64) bool {
+	r, ok := p.rules[id]
+	if !ok {
+		return false
+	}
+
+	r.Attr.Stats.Reset()
+	return true
+}
+
+func (p *PolicyCbs) StatsResetAll() {
+	for _, r := range p.rules {
+		r.Attr.Stats.Reset()
+	}
+	p.chainsReset()
+}
+
+// Idle returns the rules not hit since before, including the ones created
+// before it and never hit at all.
+func (p *PolicyCbs) Idle(before int64) []Rule {
+	var r []Rule
+
+	for _, v := range p.rules {
+		last := atomic.LoadInt64(&v.Attr.Stats.LastHit)
+		if last == 0 {
+			last = v.Created
+		}
+		if last < before {
+			r = append(r, v.dump())
+		}
+	}
+
+	return r
+}
+
+func (r *Rule) dump() Rule {
+	v := *r
+	v.Attr = r.Attr.copy()
+
+	return v
+}
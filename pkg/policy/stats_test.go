@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStatsActionsAndBytes(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	fc := clock.NewFakeClock(t0)
+	PolicySetClock(fc)
+	defer PolicySetClock(clock.SysClock{})
+	defer PolicyDeleteAll()
+
+	arg := &PolicyOpPara{Cidr: "10.0.0.0/8", Dir: base.L7_INGRESS, Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80, Httpath: "/a"}
+	a := &RuleAttr{Action: Action(POLICY_ACTION_OF_RATELIMIT), RateLimit: &RateLimitPara{Rate: 1, Burst: 2}}
+	if err := PolicyAddAttr(arg, a); err != nil {
+		t.Fatal(err)
+	}
+	ApplyRules()
+	id := PolicyDump()[0].Id
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	as, err := ApiServiceBuilder(base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	// the third in the same instant is over the burst
+	for i := 0; i < 3; i++ {
+		PolicyDecide(c, base.L7_INGRESS, base.HTTP_GET, &as[0])
+	}
+	// a minute later the bucket is full again, lookups count too
+	fc.Advance(time.Minute)
+	if r, _ := PolicyLookup(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r == nil {
+		t.Fatal("lookup missed")
+	}
+	if err := PolicyAddBytes(id, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := PolicyAddBytes(id+1, 100); err == nil {
+		t.Error("bytes added to a missing rule")
+	}
+
+	st, err := PolicyStats(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Hits != 4 || st.Actions[POLICY_ACTION_OF_RATELIMIT] != 3 || st.Actions[POLICY_ACTION_OF_DROP] != 1 {
+		t.Errorf("hits %d, actions %v", st.Hits, st.Actions)
+	}
+	if st.FirstHit != t0.UnixNano() || st.LastHit != t0.Add(time.Minute).UnixNano() {
+		t.Errorf("first hit %d, last hit %d", st.FirstHit, st.LastHit)
+	}
+	if st.Bytes != 100 {
+		t.Errorf("bytes %d, want 100", st.Bytes)
+	}
+	if rs := PolicyDump(); len(rs) != 1 || rs[0].Attr.Counter != st.Hits {
+		t.Errorf("rules %+v", rs)
+	}
+
+	// idle once nothing hit it for longer than asked
+	if rs := PolicyIdleRules(time.Minute); len(rs) != 0 {
+		t.Errorf("%d idle rules right after a hit", len(rs))
+	}
+	fc.Advance(2 * time.Minute)
+	if rs := PolicyIdleRules(time.Minute); len(rs) != 1 {
+		t.Errorf("%d idle rules, want 1", len(rs))
+	}
+
+	if err := PolicyStatsReset(id); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := PolicyStats(id); st != (RuleStats{}) {
+		t.Errorf("stats not reset, %+v", st)
+	}
+}
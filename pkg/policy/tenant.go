@@ -0,0 +1,43 @@
+package policy
+
+import (
+	"fmt"
+	"l7/pkg/base"
+)
+
+// tenantEngine finds the engine of a tenant other than the default one, set
+// by package tenant. Without it only the default tenant exists.
+var tenantEngine = func(base.TenantId) (*Engine, bool) { return nil, false }
+
+// SetTenants routes the package level lookups of a client to the engine f
+// finds for its tenant, tenant 0 is always the default engine. It is meant
+// to be called once at init.
+func SetTenants(f func(base.TenantId) (*Engine, bool)) {
+	tenantEngine = f
+}
+
+// TenantEngine returns the engine of tenant id.
+func TenantEngine(id base.TenantId) (*Engine, bool) {
+	if id == 0 {
+		return defaultEngine, true
+	}
+
+	return tenantEngine(id)
+}
+
+// engineOf returns the engine of the tenant of c, or an error if the tenant
+// doesn't exist.
+func engineOf(c *base.Client) (*Engine, error) {
+	e, ok := TenantEngine(c.Tenant)
+	if !ok {
+		return nil, fmt.Errorf("tenant %d not found", c.Tenant)
+	}
+
+	return e, nil
+}
+
+// unknownTenant is the decision for a client of an unknown tenant, it is
+// dropped.
+func unknownTenant() *Result {
+	return &Result{Kind: POLICY_RESULT_OF_DEFAULT, Action: Action(POLICY_ACTION_OF_DROP)}
+}
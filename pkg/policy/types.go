@@ -1,29 +1,126 @@
 package policy
 
-import "l7/pkg/base"
+import (
+	"l7/pkg/base"
+	"l7/pkg/schedule"
+)
 
 const (
 	POLICY_ACTION_OF_UNKNOWN uint8 = iota
 	POLICY_ACTION_OF_PASS
 	POLICY_ACTION_OF_DROP
+	POLICY_ACTION_OF_AUDIT     // pass and log
+	POLICY_ACTION_OF_REJECT    // answer with RejectPara
+	POLICY_ACTION_OF_RATELIMIT // pass within RateLimitPara
+	POLICY_ACTION_OF_REDIRECT  // answer with RedirectPara
+	POLICY_ACTION_OF_MTLS      // pass only with a verified client cert
+	POLICY_ACTION_OF_MAX
 )
 
+// well known chains, any uint16 is a priority and lower ones go first
 const (
-	POLICY_CHAIN_PRIO_OF_HIGH uint8 = iota
+	POLICY_CHAIN_PRIO_OF_HIGH uint16 = iota
 	POLICY_CHAIN_PRIO_OF_MEDIUM
 	POLICY_CHAIN_PRIO_OF_LOW
-	POLICY_CHAIN_PRIO_OF_MAX
+)
+
+const (
+	POLICY_RESULT_OF_MATCH uint8 = iota
+	POLICY_RESULT_OF_DEFAULT
 )
 
 type Action uint8
 
+type RejectPara struct {
+	Status uint16
+	Body   string
+}
+
+type RedirectPara struct {
+	Status   uint16
+	Location string
+}
+
+type RateLimitPara struct {
+	Rate  uint32 // tokens per second
+	Burst uint32
+	Key   uint8 // ratelimit.RATELIMIT_KEY_OF_xxx, the client identity of the buckets
+}
+
+// Quota bounds the size of a policy, 0 is unlimited.
+type Quota struct {
+	Rules    int
+	Patterns int // uri patterns
+}
+
+type RuleStats struct {
+	Hits     uint64
+	FirstHit int64 // unix nano, 0 if never hit
+	LastHit  int64
+	DirHits  [base.L7_EGRESS + 1]uint64
+	Actions  [POLICY_ACTION_OF_MAX]uint64 // decisions by final action, a throttled request is a drop
+	Bytes    uint64                       // as reported by AddBytes
+}
+
 type RuleAttr struct {
-	Action  Action
+	Id     uint64
+	Action Action
+	Stats  RuleStats // updated atomically, read it through Load
+
+	// Deprecated: Counter is Stats.Hits as of the copy, use Stats instead.
 	Counter uint64
+
+	Reject    *RejectPara
+	Redirect  *RedirectPara
+	RateLimit *RateLimitPara
+
+	Except   *Except            // nil excepts nothing
+	Schedule *schedule.Schedule // nil means always active
+	inactive uint32             // set by the scheduler out of the schedule
+}
+
+// Result is the final decision of a lookup, either a matched rule or the
+// default action of the client/direction when nothing matched.
+type Result struct {
+	Kind      uint8
+	Action    Action
+	Rule      *RuleAttr // nil when Kind is POLICY_RESULT_OF_DEFAULT
+	Throttled bool      // dropped by the rate limit of Rule
+	Pattern   string    // the deciding uri pattern, set by Evaluate
+	Excepted  []uint64  // rules whose key matched but whose excepts skipped them
+}
+
+// Rule is a rule as it was added, Attr is a copy taken at dump time.
+type Rule struct {
+	Id      uint64
+	Para    PolicyOpPara // of the first cell
+	Set     *PolicyOpSet // nil unless added as a set
+	Cell    RuleCell     // the first cell
+	Cells   []RuleCell   // every cell, one unless a set
+	Attr    *RuleAttr
+	Created int64 // unix nano
+
+	paras []PolicyOpPara // of each cell of a set
+}
+
+// para returns the parameters of cell i.
+func (r *Rule) para(i int) *PolicyOpPara {
+	if i < len(r.paras) {
+		return &r.paras[i]
+	}
+
+	return &r.Para
+}
+
+// DefaultKey selects a fallback action, zero fields act as wildcards.
+type DefaultKey struct {
+	Workload base.WorkloadId
+	Role     base.WorkRole
+	Dir      base.Direction
 }
 
 type RuleCell struct {
-	Prio     uint8
+	Prio     uint16 // chain, lower first
 	Id       base.AddrId
 	Workload base.WorkloadId
 	Role     base.WorkRole
@@ -31,15 +128,27 @@ type RuleCell struct {
 	Dir      base.Direction
 	Method   base.Method
 	Api      base.ApiService
+	Dst      DstKey
+}
+
+// DstKey is the destination side of a key, zero fields match any. Its group
+// only matches as a whole.
+type DstKey struct {
+	Id       base.AddrId
+	Workload base.WorkloadId
+	Role     base.WorkRole
+	Group    base.WorkGroup
 }
 
 type L7Key struct {
+	Id       base.AddrId // source cidr, 0 for any address
 	Workload base.WorkloadId
 	Role     base.WorkRole
 	Group    base.WorkGroup
 	Dir      base.Direction
 	Method   base.Method
 	Api      base.ApiService
+	Dst      DstKey
 }
 
 type L3Key struct {
@@ -47,4 +156,5 @@ type L3Key struct {
 	Dir    base.Direction
 	Method base.Method
 	Api    base.ApiService
+	Dst    DstKey
 }
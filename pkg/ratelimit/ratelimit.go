@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RL_SHARDS = 64
+	DEFAULT_RL_IDLE   = 5 * time.Minute
+)
+
+const (
+	RATELIMIT_KEY_OF_IP uint8 = iota
+	RATELIMIT_KEY_OF_WORKLOAD
+	RATELIMIT_KEY_OF_ROLE
+	RATELIMIT_KEY_OF_MAX
+)
+
+type Key struct {
+	Rule     uint64
+	Ip       netip.Addr
+	Workload base.WorkloadId
+	Role     base.WorkRole
+}
+
+// ClientKey builds the bucket key of a rule, only the client field selected
+// by kind takes part in it.
+func ClientKey(rule uint64, kind uint8, c *base.Client) Key {
+	k := Key{Rule: rule}
+
+	switch kind {
+	case RATELIMIT_KEY_OF_WORKLOAD:
+		k.Workload = c.Workload
+	case RATELIMIT_KEY_OF_ROLE:
+		k.Role = c.Role
+	default:
+		k.Ip = c.Ip
+	}
+
+	return k
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type shard struct {
+	sync.Mutex
+	db    map[Key]*bucket
+	sweep time.Time // last idle sweep
+}
+
+type Limiter struct {
+	clock  clock.Clock
+	idle   time.Duration
+	shards [DEFAULT_RL_SHARDS]shard
+}
+
+func (l *Limiter) Init(c clock.Clock, idle time.Duration) {
+	l.clock, l.idle = c, idle
+	for i := range l.shards {
+		l.shards[i].db = make(map[Key]*bucket)
+		l.shards[i].sweep = c.Now()
+	}
+}
+
+func (l *Limiter) SetClock(c clock.Clock) {
+	for i := range l.shards {
+		l.shards[i].Lock()
+	}
+	defer func() {
+		for i := range l.shards {
+			l.shards[i].Unlock()
+		}
+	}()
+
+	l.clock = c
+}
+
+// Take moves the buckets of o into l, o is left with none.
+func (l *Limiter) Take(o *Limiter) {
+	for i := range l.shards {
+		s, f := &l.shards[i], &o.shards[i]
+		s.Lock()
+		f.Lock()
+		s.db, f.db = f.db, make(map[Key]*bucket)
+		s.sweep = f.sweep
+		f.Unlock()
+		s.Unlock()
+	}
+}
+
+// Allow takes one token from the bucket of k, the bucket refills at rate
+// tokens per second up to burst (at least one).
+func (l *Limiter) Allow(k *Key, rate, burst uint32) bool {
+	s := &l.shards[k.hash()%DEFAULT_RL_SHARDS]
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := l.clock.Now()
+	if now.Sub(s.sweep) >= l.idle {
+		s.evict(now, l.idle)
+	}
+
+	max := float64(burst)
+	if max < 1 {
+		max = 1
+	}
+
+	b, ok := s.db[*k]
+	if !ok {
+		b = &bucket{tokens: max, last: now}
+		s.db[*k] = b
+	}
+
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * float64(rate)
+		if b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func (s *shard) evict(now time.Time, idle time.Duration) int {
+	n := 0
+	for k, b := range s.db {
+		if now.Sub(b.last) >= idle {
+			delete(s.db, k)
+			n++
+		}
+	}
+	s.sweep = now
+
+	return n
+}
+
+// Evict drops every bucket untouched for the idle time, it returns the
+// number of dropped buckets.
+func (l *Limiter) Evict() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		n += s.evict(l.clock.Now(), l.idle)
+		s.Unlock()
+	}
+
+	return n
+}
+
+func (l *Limiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		n += len(s.db)
+		s.Unlock()
+	}
+
+	return n
+}
+
+// fnv-1a over the key fields
+func (k *Key) hash() uint64 {
+	h := uint64(14695981039346656037)
+	mix := func(v uint64) {
+		for i := 0; i < 8; i++ {
+			h ^= v & 0xff
+			h *= 1099511628211
+			v >>= 8
+		}
+	}
+
+	mix(k.Rule)
+	for _, b := range k.Ip.As16() {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	mix(uint64(k.Workload))
+	mix(uint64(k.Role))
+
+	return h
+}
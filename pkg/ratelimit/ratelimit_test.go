@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/clock"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newLimiter() (*Limiter, *clock.FakeClock) {
+	fc := clock.NewFakeClock(time.Unix(1700000000, 0))
+	l := new(Limiter)
+	l.Init(fc, DEFAULT_RL_IDLE)
+
+	return l, fc
+}
+
+// allowed takes n tokens from the bucket of k and returns how many it got.
+func allowed(l *Limiter, k *Key, n int, rate, burst uint32) int {
+	got := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(k, rate, burst) {
+			got++
+		}
+	}
+
+	return got
+}
+
+func TestBurst(t *testing.T) {
+	l, _ := newLimiter()
+	k := Key{Rule: 1, Ip: netip.MustParseAddr("10.1.2.3")}
+
+	if n := allowed(l, &k, 5, 1, 3); n != 3 {
+		t.Errorf("%d allowed, want the burst of 3", n)
+	}
+	// a burst of 0 still lets one through
+	k.Rule = 2
+	if n := allowed(l, &k, 2, 1, 0); n != 1 {
+		t.Errorf("%d allowed with no burst, want 1", n)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l, fc := newLimiter()
+	k := Key{Rule: 1, Ip: netip.MustParseAddr("10.1.2.3")}
+
+	if n := allowed(l, &k, 3, 2, 2); n != 2 {
+		t.Fatalf("%d allowed, want 2", n)
+	}
+
+	// two tokens a second, one is back after half a second
+	fc.Advance(500 * time.Millisecond)
+	if n := allowed(l, &k, 2, 2, 2); n != 1 {
+		t.Errorf("%d allowed after 500ms, want 1", n)
+	}
+
+	// never more than the burst however long it waits
+	fc.Advance(4 * time.Minute)
+	if n := allowed(l, &k, 5, 2, 2); n != 2 {
+		t.Errorf("%d allowed after 4m, want 2", n)
+	}
+}
+
+func TestKeyIsolation(t *testing.T) {
+	l, _ := newLimiter()
+	a := &base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Workload: 7}
+	b := &base.Client{Ip: netip.MustParseAddr("10.1.2.4"), Workload: 7}
+
+	// by ip, each client has its bucket, and each rule
+	ka, kb := ClientKey(1, RATELIMIT_KEY_OF_IP, a), ClientKey(1, RATELIMIT_KEY_OF_IP, b)
+	kr := ClientKey(2, RATELIMIT_KEY_OF_IP, a)
+	if allowed(l, &ka, 2, 1, 1) != 1 || allowed(l, &kb, 1, 1, 1) != 1 || allowed(l, &kr, 1, 1, 1) != 1 {
+		t.Error("buckets by ip shared")
+	}
+
+	// by workload, the clients of one workload share it
+	ka, kb = ClientKey(3, RATELIMIT_KEY_OF_WORKLOAD, a), ClientKey(3, RATELIMIT_KEY_OF_WORKLOAD, b)
+	if ka != kb || allowed(l, &ka, 1, 1, 1) != 1 || allowed(l, &kb, 1, 1, 1) != 0 {
+		t.Error("bucket by workload not shared")
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	l, fc := newLimiter()
+	k := Key{Rule: 1, Ip: netip.MustParseAddr("10.1.2.3")}
+	l.Allow(&k, 1, 1)
+
+	fc.Advance(DEFAULT_RL_IDLE / 2)
+	if n := l.Evict(); n != 0 || l.Len() != 1 {
+		t.Errorf("%d evicted, %d left before the idle time", n, l.Len())
+	}
+	fc.Advance(DEFAULT_RL_IDLE)
+	if n := l.Evict(); n != 1 || l.Len() != 0 {
+		t.Errorf("%d evicted, %d left after the idle time", n, l.Len())
+	}
+}
@@ -0,0 +1,283 @@
+package reload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RELOAD_INTERVAL = 2 * time.Second
+	DEFAULT_RELOAD_DEBOUNCE = time.Second
+)
+
+// WATCHER_OF_xxx is how Run learns of changes.
+const (
+	WATCHER_OF_POLL    = "poll"
+	WATCHER_OF_INOTIFY = "inotify"
+)
+
+type Config struct {
+	Path     string        // a policy file, or a directory of *.json files merged by name
+	Interval time.Duration // polling period, DEFAULT_RELOAD_INTERVAL if 0
+	Debounce time.Duration // quiet time after a change, DEFAULT_RELOAD_DEBOUNCE if 0
+
+	Lock sync.Locker // held while the new set is swapped in, nil for none
+}
+
+// Status is what the loads left behind, the last error is cleared by the
+// next good load.
+type Status struct {
+	Path       string     `json:"path"`
+	Generation uint64     `json:"generation"` // made live by the last good load
+	Digest     string     `json:"digest,omitempty"`
+	Loaded     *time.Time `json:"loaded,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Failed     *time.Time `json:"failed,omitempty"`
+	Loads      uint64     `json:"loads"`
+	Failures   uint64     `json:"failures"`
+
+	Watcher   string `json:"watcher,omitempty"`    // set by Run, WATCHER_OF_xxx
+	ReadError string `json:"read_error,omitempty"` // the files couldn't be read at the last look
+}
+
+// Reloader keeps an engine in line with its policy files. Their directory is
+// watched with inotify where there is one, and polled anyway, which also
+// catches what a watch misses like the directory itself replaced. A change
+// is loaded once the files stayed the same for the debounce time. A load
+// builds a new rule set aside and swaps it in whole, a bad file leaves the
+// running policy untouched.
+type Reloader struct {
+	conf Config
+	e    *policy.Engine
+
+	mu   sync.Mutex // serializes loads, guards st and seen
+	st   Status
+	seen string // digest of the last load tried
+}
+
+func New(e *policy.Engine, conf Config) *Reloader {
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_RELOAD_INTERVAL
+	}
+	if conf.Debounce <= 0 {
+		conf.Debounce = DEFAULT_RELOAD_DEBOUNCE
+	}
+
+	return &Reloader{conf: conf, e: e, st: Status{Path: conf.Path}}
+}
+
+func (r *Reloader) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.st
+}
+
+// Load reads the policy files and makes them live now.
+func (r *Reloader) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ss, digest, err := snapshot(r.conf.Path)
+	if err == nil {
+		r.seen = digest
+
+		var f *spec.File
+		if f, err = parse(ss); err == nil {
+			err = r.swap(f)
+		}
+	}
+
+	now := time.Now()
+	if err != nil {
+		r.st.Error, r.st.Failed = err.Error(), &now
+		r.st.Failures++
+		return err
+	}
+
+	r.st.Generation = r.e.Generation()
+	r.st.Digest, r.st.Loaded = digest, &now
+	r.st.Error, r.st.Failed = "", nil
+	r.st.Loads++
+
+	return nil
+}
+
+// swap makes the rule set of f live, see spec.File.Swap.
+func (r *Reloader) swap(f *spec.File) error {
+	return f.Swap(r.e, r.conf.Lock)
+}
+
+// Run follows the files until stop is closed.
+func (r *Reloader) Run(stop <-chan struct{}) {
+	t := time.NewTicker(r.conf.Interval)
+	defer t.Stop()
+
+	var events <-chan struct{}
+	r.watching(WATCHER_OF_POLL, nil)
+	if w, err := newWatcher(r.conf.Path); err != nil {
+		fmt.Fprintln(os.Stderr, "reload: polling only,", err)
+	} else {
+		defer w.close()
+		events = w.C
+		r.watching(WATCHER_OF_INOTIFY, nil)
+	}
+
+	var (
+		pending string
+		since   time.Time
+		settle  <-chan time.Time // after the last event
+		settled bool             // quiet since the last event for the debounce time
+	)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				r.watching(WATCHER_OF_POLL, nil)
+				continue
+			}
+			// every event pushes the load back by the debounce time
+			settle = time.After(r.conf.Debounce)
+			continue
+		case <-settle:
+			settle, settled = nil, true
+		}
+
+		_, digest, err := snapshot(r.conf.Path)
+		r.watching("", err)
+		if err != nil {
+			// missing mid update, looked at again on the next tick
+			settled = false
+			continue
+		}
+
+		r.mu.Lock()
+		seen := r.seen
+		r.mu.Unlock()
+		if digest == seen {
+			pending, settled = "", false
+			continue
+		}
+
+		now := time.Now()
+		if !settled {
+			if digest != pending {
+				pending, since = digest, now
+				continue
+			}
+			if now.Sub(since) < r.conf.Debounce {
+				continue
+			}
+		}
+
+		pending, settled = "", false
+		if err := r.Load(); err != nil {
+			fmt.Fprintln(os.Stderr, "reload:", err)
+		}
+	}
+}
+
+// watching records the watcher if not empty, and the read error of the last
+// look at the files.
+func (r *Reloader) watching(watcher string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if watcher != "" {
+		r.st.Watcher = watcher
+		return
+	}
+	r.st.ReadError = ""
+	if err != nil {
+		r.st.ReadError = err.Error()
+	}
+}
+
+// source is the content of one policy file.
+type source struct {
+	name string
+	b    []byte
+}
+
+// snapshot reads the policy files at path and returns them with their
+// digest.
+func snapshot(path string) ([]source, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	names := []string{path}
+	if fi.IsDir() {
+		if names, err = files(path); err != nil {
+			return nil, "", err
+		}
+		if len(names) == 0 {
+			return nil, "", fmt.Errorf("no policy files in %s", path)
+		}
+	}
+
+	var ss []source
+	h := sha256.New()
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", filepath.Base(name), len(b))
+		h.Write(b)
+		ss = append(ss, source{name: name, b: b})
+	}
+
+	return ss, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parse merges the policy files in order.
+func parse(ss []source) (*spec.File, error) {
+	f := &spec.File{Rules: []spec.Rule{}}
+	for _, s := range ss {
+		v, err := spec.Parse(bytes.NewReader(s.b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.name, err)
+		}
+		f.Groups = append(f.Groups, v.Groups...)
+		f.Defaults = append(f.Defaults, v.Defaults...)
+		f.Rules = append(f.Rules, v.Rules...)
+	}
+
+	return f, nil
+}
+
+// files returns the *.json files of dir by name, the hidden ones left out.
+func files(dir string) ([]string, error) {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []string
+	for _, e := range es {
+		n := e.Name()
+		if strings.HasPrefix(n, ".") || filepath.Ext(n) != ".json" {
+			continue
+		}
+		r = append(r, filepath.Join(dir, n))
+	}
+	sort.Strings(r)
+
+	return r, nil
+}
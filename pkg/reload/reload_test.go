@@ -0,0 +1,140 @@
+package reload
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	goodPolicy = `{"rules": [{"cidr": "10.0.0.0/8", "dir": "ingress", "port": 80, "path": "/a", "action": "drop"}]}`
+	twoPolicy  = `{"rules": [{"cidr": "10.0.0.0/8", "dir": "ingress", "port": 80, "path": "/a", "action": "drop"},
+		{"cidr": "10.0.0.0/8", "dir": "ingress", "port": 80, "path": "/b", "action": "pass"}]}`
+	badPolicy = `{"rules": [{"cidr": "10.0.0.0/8", "dir": "ingress", "port": 80, "path": "/a", "action": "nope"}]}`
+)
+
+func write(t *testing.T, path, s string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually waits for ok for up to two seconds.
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	for end := time.Now().Add(2 * time.Second); !ok(); {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBadFileKeepsPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write(t, path, goodPolicy)
+
+	e := policy.NewEngine()
+	r := New(e, Config{Path: path})
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	gen := e.Generation()
+
+	write(t, path, badPolicy)
+	if err := r.Load(); err == nil {
+		t.Fatal("bad file loaded")
+	}
+	if n := len(e.Dump()); n != 1 || e.Generation() != gen {
+		t.Errorf("policy touched, %d rules, generation %d, was %d", n, e.Generation(), gen)
+	}
+	st := r.Status()
+	if st.Error == "" || st.Failures != 1 || st.Loads != 1 || st.Generation != gen {
+		t.Errorf("status %+v", st)
+	}
+}
+
+// TestReloadKeepsStats reloads a file with one more rule, the rule that
+// stays keeps its id and stats.
+func TestReloadKeepsStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write(t, path, goodPolicy)
+
+	e := policy.NewEngine()
+	r := New(e, Config{Path: path})
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	id := e.Dump()[0].Id
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3")}
+	s := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}
+	if res, err := e.Evaluate(c, base.L7_INGRESS, base.HTTP_GET, s, "/a"); err != nil || res.Rule == nil || res.Rule.Id != id {
+		t.Fatalf("result %+v, %v", res, err)
+	}
+
+	write(t, path, twoPolicy)
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	rs := e.Dump()
+	if len(rs) != 2 || rs[0].Id != id || rs[1].Id == id {
+		t.Fatalf("rules %+v, /a was %d", rs, id)
+	}
+	if st, err := e.Stats(id); err != nil || st.Hits != 1 {
+		t.Errorf("stats %+v, %v", st, err)
+	}
+}
+
+func TestRunReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	write(t, path, goodPolicy)
+
+	e := policy.NewEngine()
+	r := New(e, Config{Path: dir, Interval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond})
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	eventually(t, "the watcher", func() bool { return r.Status().Watcher != "" })
+
+	write(t, path, twoPolicy)
+	eventually(t, "the reload", func() bool { return len(e.Dump()) == 2 })
+
+	// a bad file is recorded and the running policy stays
+	write(t, path, badPolicy)
+	eventually(t, "the failure", func() bool { return r.Status().Failures == 1 })
+	if n := len(e.Dump()); n != 2 {
+		t.Errorf("bad file changed the policy, %d rules", n)
+	}
+
+	// so is a directory that can't be read
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the read error", func() bool { return r.Status().ReadError != "" })
+
+	write(t, path, goodPolicy)
+	eventually(t, "the recovery", func() bool {
+		st := r.Status()
+		return st.ReadError == "" && st.Error == "" && len(e.Dump()) == 1
+	})
+}
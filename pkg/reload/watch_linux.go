@@ -0,0 +1,60 @@
+//go:build linux
+
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// INOTIFY_MASK covers writes, renames and the symlink swaps of mounted
+// ConfigMaps in the watched directory.
+const INOTIFY_MASK = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watcher wakes C on any change in the directory of path, or in path itself
+// if it is a directory.
+type watcher struct {
+	C <-chan struct{}
+	f *os.File
+}
+
+func newWatcher(path string) (*watcher, error) {
+	dir := path
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		dir = filepath.Dir(path)
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, INOTIFY_MASK); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	// a non blocking fd goes to the runtime poller, Close wakes the reader
+	f := os.NewFile(uintptr(fd), "inotify")
+	c := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			if _, err := f.Read(b); err != nil {
+				close(c)
+				return
+			}
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return &watcher{C: c, f: f}, nil
+}
+
+func (w *watcher) close() {
+	w.f.Close()
+}
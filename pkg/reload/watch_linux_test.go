@@ -0,0 +1,30 @@
+//go:build linux
+
+package reload
+
+import (
+	"l7/pkg/policy"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write(t, path, goodPolicy)
+
+	// polled once an hour, only the watch can catch the change in time
+	e := policy.NewEngine()
+	r := New(e, Config{Path: path, Interval: time.Hour, Debounce: 20 * time.Millisecond})
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(stop)
+	eventually(t, "the watcher", func() bool { return r.Status().Watcher == WATCHER_OF_INOTIFY })
+
+	write(t, path, twoPolicy)
+	eventually(t, "the reload", func() bool { return len(e.Dump()) == 2 })
+}
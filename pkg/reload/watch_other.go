@@ -0,0 +1,15 @@
+//go:build !linux
+
+package reload
+
+import "fmt"
+
+type watcher struct {
+	C <-chan struct{}
+}
+
+func newWatcher(path string) (*watcher, error) {
+	return nil, fmt.Errorf("no file watcher on this system")
+}
+
+func (w *watcher) close() {}
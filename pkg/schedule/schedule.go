@@ -0,0 +1,177 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily time range, End before Start spans midnight.
+type Window struct {
+	Days  uint8         // bit i for time.Weekday(i), 0 means every day
+	Start time.Duration // offset from midnight
+	End   time.Duration
+}
+
+type Schedule struct {
+	NotBefore time.Time // zero means no lower bound
+	NotAfter  time.Time // zero means no upper bound
+	Loc       *time.Location
+	Windows   []Window // empty means always inside the bounds
+}
+
+func (w *Window) onDay(d time.Weekday) bool {
+	return w.Days == 0 || w.Days&(1<<uint(d)) != 0
+}
+
+func (w *Window) Contains(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.Start < w.End {
+		return w.onDay(t.Weekday()) && tod >= w.Start && tod < w.End
+	}
+
+	// spans midnight, the part after it belongs to the previous day
+	if tod >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	return tod < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+func (s *Schedule) Active(t time.Time) bool {
+	if s.Expired(t) || (!s.NotBefore.IsZero() && t.Before(s.NotBefore)) {
+		return false
+	}
+
+	if len(s.Windows) == 0 {
+		return true
+	}
+
+	if s.Loc != nil {
+		t = t.In(s.Loc)
+	}
+	for i := range s.Windows {
+		if s.Windows[i].Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired reports a schedule that will never be active again.
+func (s *Schedule) Expired(t time.Time) bool {
+	return !s.NotAfter.IsZero() && !t.Before(s.NotAfter)
+}
+
+// ParseWindow parses "[days ]hh:mm-hh:mm", days is a comma list of day names
+// or ranges like "mon-fri" or "sat,sun".
+func ParseWindow(s string) (Window, error) {
+	var w Window
+
+	f := strings.Fields(strings.ToLower(s))
+	switch len(f) {
+	case 1:
+	case 2:
+		for _, d := range strings.Split(f[0], ",") {
+			m, err := parseDays(d)
+			if err != nil {
+				return w, err
+			}
+			w.Days |= m
+		}
+		f = f[1:]
+	default:
+		return w, fmt.Errorf("invalid window %q", s)
+	}
+
+	r := strings.Split(f[0], "-")
+	if len(r) != 2 {
+		return w, fmt.Errorf("invalid time range %q", f[0])
+	}
+
+	var err error
+	if w.Start, err = parseClock(r[0]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(r[1]); err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("empty time range %q", f[0])
+	}
+
+	return w, nil
+}
+
+func parseDays(s string) (uint8, error) {
+	r := strings.Split(s, "-")
+
+	from, ok := dayNames[r[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q", r[0])
+	}
+	if len(r) == 1 {
+		return 1 << uint(from), nil
+	}
+
+	to, ok := dayNames[r[1]]
+	if len(r) != 2 || !ok {
+		return 0, fmt.Errorf("invalid day range %q", s)
+	}
+
+	var m uint8
+	for d := from; ; d = (d + 1) % 7 {
+		m |= 1 << uint(d)
+		if d == to {
+			break
+		}
+	}
+
+	return m, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s != "24:00" {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		return 24 * time.Hour, nil
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+var dayShort = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// String formats w the way ParseWindow reads it.
+func (w Window) String() string {
+	var days []string
+	for d := 0; d < 7; d++ {
+		if w.Days&(1<<uint(d)) != 0 {
+			days = append(days, dayShort[d])
+		}
+	}
+
+	r := fmt.Sprintf("%02d:%02d-%02d:%02d",
+		int(w.Start.Hours()), int(w.Start.Minutes())%60,
+		int(w.End.Hours()), int(w.End.Minutes())%60)
+	if len(days) == 0 {
+		return r
+	}
+
+	return strings.Join(days, ",") + " " + r
+}
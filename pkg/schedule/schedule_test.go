@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func TestParseWindow(t *testing.T) {
+	for _, v := range []struct {
+		s    string
+		days uint8
+		ok   bool
+	}{
+		{"09:00-17:00", 0, true},
+		{"mon-fri 09:00-17:00", 0x3e, true},
+		{"fri-mon 22:00-02:00", 0x63, true},
+		{"sat,sun 00:00-24:00", 0x41, true},
+		{"09:00-09:00", 0, false},
+		{"xyz 09:00-10:00", 0, false},
+		{"mon 9-10", 0, false},
+		{"mon tue 09:00-10:00", 0, false},
+	} {
+		w, err := ParseWindow(v.s)
+		if (err == nil) != v.ok || (v.ok && w.Days != v.days) {
+			t.Errorf("%q: days %#x, %v", v.s, w.Days, err)
+		}
+	}
+}
+
+// TestWindowMidnight checks that the hours after midnight of a window
+// spanning it belong to the day it started.
+func TestWindowMidnight(t *testing.T) {
+	w, err := ParseWindow("fri 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		t  string
+		in bool
+	}{
+		{"2023-11-17T23:00:00Z", true},  // friday
+		{"2023-11-18T01:00:00Z", true},  // saturday, from friday
+		{"2023-11-18T23:00:00Z", false}, // saturday
+		{"2023-11-17T01:00:00Z", false}, // friday, from thursday
+	} {
+		if got := w.Contains(at(v.t)); got != v.in {
+			t.Errorf("%s: in %v", v.t, got)
+		}
+	}
+}
+
+func TestActiveZone(t *testing.T) {
+	w, _ := ParseWindow("09:00-17:00")
+	s := &Schedule{Windows: []Window{w}, Loc: time.FixedZone("UTC+9", 9*3600)}
+
+	// 10:00 and 19:00 there
+	if !s.Active(at("2023-11-14T01:00:00Z")) || s.Active(at("2023-11-14T10:00:00Z")) {
+		t.Error("windows not read in the schedule zone")
+	}
+	s.Loc = nil
+	if !s.Active(at("2023-11-14T10:00:00Z")) {
+		t.Error("windows not read in the zone of the time without one")
+	}
+}
+
+func TestBounds(t *testing.T) {
+	s := &Schedule{NotBefore: at("2023-11-14T00:00:00Z"), NotAfter: at("2023-11-15T00:00:00Z")}
+
+	for _, v := range []struct {
+		t               string
+		active, expired bool
+	}{
+		{"2023-11-13T23:59:59Z", false, false},
+		{"2023-11-14T00:00:00Z", true, false},
+		{"2023-11-14T23:59:59Z", true, false},
+		{"2023-11-15T00:00:00Z", false, true},
+	} {
+		if a, e := s.Active(at(v.t)), s.Expired(at(v.t)); a != v.active || e != v.expired {
+			t.Errorf("%s: active %v, expired %v", v.t, a, e)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/reload"
+	"l7/pkg/spec"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+	DEFAULT_BODY_LIMIT       = 4 << 20
+
+	HEADER_GENERATION = "X-Policy-Generation"
+)
+
+// Server is the management api of the default policy. Changes are
+// serialized and may carry an If-Match generation to detect lost updates.
+type Server struct {
+	sync.Mutex
+	mux    *http.ServeMux
+	reload *reload.Reloader // nil unless the policy comes from files
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+type addBody struct {
+	Generation uint64 `json:"generation"`
+	Id         uint64 `json:"id"`
+}
+
+// New builds the api, metrics is mounted on /metrics when not nil.
+func New(metrics http.Handler) *Server {
+	s := &Server{mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("/v1/rules", s.rules)
+	s.mux.HandleFunc("/v1/rules/", s.rule)
+	s.mux.HandleFunc("/v1/apply", s.apply)
+	s.mux.HandleFunc("/v1/defaults", s.defaults)
+	s.mux.HandleFunc("/v1/groups", s.groups)
+	s.mux.HandleFunc("/v1/dump", s.dump)
+	s.mux.HandleFunc("/v1/stats", s.stats)
+	s.mux.HandleFunc("/v1/stats/", s.stats)
+	s.mux.HandleFunc("/v1/idle", s.idle)
+	s.mux.HandleFunc("/v1/chains", s.chains)
+	s.mux.HandleFunc("/v1/explain", s.explain)
+	s.mux.HandleFunc("/v1/shadow", s.shadow)
+	s.mux.HandleFunc("/v1/shadow/promote", s.promote)
+	s.mux.HandleFunc("/v1/reload", s.reloadStatus)
+	if metrics != nil {
+		s.mux.Handle("/metrics", metrics)
+	}
+
+	return s
+}
+
+// SetReloader serves the status of r on /v1/reload, r must hold s while it
+// swaps a new rule set in.
+func (s *Server) SetReloader(r *reload.Reloader) {
+	s.reload = r
+}
+
+// Handle mounts h on pattern next to the api.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is done, then shuts down
+// gracefully.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, l)
+}
+
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	hs := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- hs.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), DEFAULT_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	return hs.Shutdown(sctx)
+}
+
+// writeHeader stamps every answer with the generation it was built from.
+func writeHeader(w http.ResponseWriter, status int) {
+	w.Header().Set(HEADER_GENERATION, strconv.FormatUint(policy.PolicyGeneration(), 10))
+	w.WriteHeader(status)
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	writeHeader(w, status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, &errorBody{Error: err.Error()})
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, DEFAULT_BODY_LIMIT))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body, %v", err))
+		return false
+	}
+
+	return true
+}
+
+func notAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
+
+// begin locks s for a change, it fails with 412 when the request expects
+// another generation. The caller unlocks s when it returns true.
+func (s *Server) begin(w http.ResponseWriter, r *http.Request) bool {
+	s.Lock()
+
+	m := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if m == "" || m == "*" {
+		return true
+	}
+
+	gen, err := strconv.ParseUint(m, 10, 64)
+	if err != nil {
+		s.Unlock()
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid If-Match %q", m))
+		return false
+	}
+
+	if cur := policy.PolicyGeneration(); gen != cur {
+		s.Unlock()
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("generation is %d, not %d", cur, gen))
+		return false
+	}
+
+	return true
+}
+
+func ruleId(w http.ResponseWriter, s string) (uint64, bool) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rule id %q", s))
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (s *Server) rules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rs := []spec.Rule{}
+		for _, v := range policy.PolicyDump() {
+			rs = append(rs, spec.FromPolicy(&v))
+		}
+		writeJson(w, http.StatusOK, rs)
+
+	case http.MethodPost:
+		var v spec.Rule
+		if !readJson(w, r, &v) {
+			return
+		}
+		set, ra, err := v.Policy()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if err := policy.PolicyAddSet(set, ra); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJson(w, http.StatusCreated, &addBody{
+			Generation: policy.PolicyGeneration(),
+			Id:         ra.Id,
+		})
+
+	case http.MethodDelete:
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		policy.PolicyDeleteAll()
+		writeHeader(w, http.StatusNoContent)
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *Server) rule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleId(w, strings.TrimPrefix(r.URL.Path, "/v1/rules/"))
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		v, err := policy.PolicyGet(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJson(w, http.StatusOK, spec.FromPolicy(&v))
+
+	case http.MethodPut:
+		var v spec.Rule
+		if !readJson(w, r, &v) {
+			return
+		}
+		set, ra, err := v.Policy()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if _, err := policy.PolicyGet(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := policy.PolicyUpdateSet(id, set, ra); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJson(w, http.StatusOK, &addBody{
+			Generation: policy.PolicyGeneration(),
+			Id:         id,
+		})
+
+	case http.MethodDelete:
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if err := policy.PolicyDelId(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeHeader(w, http.StatusNoContent)
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (s *Server) apply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+
+	if !s.begin(w, r) {
+		return
+	}
+	defer s.Unlock()
+
+	if err := policy.ApplyRules(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeHeader(w, http.StatusNoContent)
+}
+
+func (s *Server) defaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, spec.Dump().Defaults)
+
+	case http.MethodPost, http.MethodDelete:
+		var v spec.Default
+		if !readJson(w, r, &v) {
+			return
+		}
+		if r.Method == http.MethodDelete && v.Action == "" {
+			v.Action = "unknown"
+		}
+		k, a, err := v.Policy()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if r.Method == http.MethodPost {
+			policy.PolicyDefaultSet(k, a)
+		} else {
+			policy.PolicyDefaultDel(k)
+		}
+		writeHeader(w, http.StatusNoContent)
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// groups serves the named groups, POST adds or replaces one and rebuilds the
+// rules naming it, DELETE takes the kind and name of an unused one.
+func (s *Server) groups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		gs := []spec.NamedGroup{}
+		for _, g := range policy.PolicyGroups() {
+			gs = append(gs, spec.FromGroup(&g))
+		}
+		writeJson(w, http.StatusOK, gs)
+
+	case http.MethodPost, http.MethodDelete:
+		var v spec.NamedGroup
+		if !readJson(w, r, &v) {
+			return
+		}
+
+		var (
+			g    *policy.Group
+			kind uint8
+			err  error
+		)
+		if r.Method == http.MethodPost {
+			g, err = v.Policy()
+		} else {
+			kind, err = policy.ParseGroupKind(v.Kind)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if r.Method == http.MethodPost {
+			err = policy.PolicyGroupSet(g)
+		} else {
+			err = policy.PolicyGroupDel(kind, v.Name)
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeHeader(w, http.StatusNoContent)
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *Server) dump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeJson(w, http.StatusOK, spec.Dump())
+}
+
+// stats serves GET /v1/stats[/id] and POST /v1/stats[/id]/reset.
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/stats"), "/")
+
+	reset := p == "reset" || strings.HasSuffix(p, "/reset")
+	if reset {
+		p = strings.TrimSuffix(strings.TrimSuffix(p, "reset"), "/")
+	}
+
+	var id uint64
+	if p != "" {
+		var ok bool
+		if id, ok = ruleId(w, p); !ok {
+			return
+		}
+	}
+
+	if reset {
+		if r.Method != http.MethodPost {
+			notAllowed(w, http.MethodPost)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		if id == 0 {
+			policy.PolicyStatsResetAll()
+		} else if err := policy.PolicyStatsReset(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeHeader(w, http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+
+	if id != 0 {
+		st, err := policy.PolicyStats(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJson(w, http.StatusOK, spec.FromStats(id, &st))
+		return
+	}
+
+	ss := []spec.Stats{}
+	for _, v := range policy.PolicyDump() {
+		ss = append(ss, spec.FromStats(v.Id, &v.Attr.Stats))
+	}
+	writeJson(w, http.StatusOK, ss)
+}
+
+// idle serves GET /v1/idle?days=N, the rules not hit during the last N days.
+func (s *Server) idle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+
+	days, err := strconv.ParseUint(r.URL.Query().Get("days"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid days"))
+		return
+	}
+
+	rs := []spec.Rule{}
+	for _, v := range policy.PolicyIdleRules(time.Duration(days) * 24 * time.Hour) {
+		rs = append(rs, spec.FromPolicy(&v))
+	}
+	writeJson(w, http.StatusOK, rs)
+}
+
+func (s *Server) chains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+
+	cs := []spec.Chain{}
+	for _, v := range policy.PolicyChains() {
+		cs = append(cs, spec.FromChain(&v))
+	}
+	writeJson(w, http.StatusOK, cs)
+}
+
+func (s *Server) explain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+
+	var v spec.Request
+	if !readJson(w, r, &v) {
+		return
+	}
+
+	es, err := v.Explain()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJson(w, http.StatusOK, es)
+}
+
+// shadow serves the candidate rule set: GET reports the mismatches, PUT
+// replaces it with a policy file and DELETE drops it.
+func (s *Server) shadow(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rep := policy.PolicyShadowReport()
+		writeJson(w, http.StatusOK, spec.FromShadowReport(&rep))
+
+	case http.MethodPut:
+		var f spec.File
+		if !readJson(w, r, &f) {
+			return
+		}
+		if err := f.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		policy.PolicyShadowDrop()
+		sh := policy.PolicyShadow()
+		if err := f.InstallTo(sh); err != nil {
+			policy.PolicyShadowDrop()
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := sh.Apply(); err != nil {
+			policy.PolicyShadowDrop()
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		policy.PolicyShadowReset()
+		writeHeader(w, http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !s.begin(w, r) {
+			return
+		}
+		defer s.Unlock()
+
+		policy.PolicyShadowDrop()
+		writeHeader(w, http.StatusNoContent)
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (s *Server) promote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+
+	if !s.begin(w, r) {
+		return
+	}
+	defer s.Unlock()
+
+	if err := policy.PolicyPromote(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeHeader(w, http.StatusNoContent)
+}
+
+// reloadStatus serves GET /v1/reload, the last good generation and the last
+// error of the policy files, and POST /v1/reload loading them now.
+func (s *Server) reloadStatus(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no policy files to reload"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, s.reload.Status())
+
+	case http.MethodPost:
+		if err := s.reload.Load(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJson(w, http.StatusOK, s.reload.Status())
+
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"l7/pkg/policy"
+	"l7/pkg/spec"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type client struct {
+	t   *testing.T
+	url string
+}
+
+// do sends v as json and decodes the answer into out if not nil, it returns
+// the status and the generation header.
+func (c *client) do(method, path string, v, out interface{}, header ...string) (int, string) {
+	c.t.Helper()
+
+	var body bytes.Buffer
+	if v != nil {
+		json.NewEncoder(&body).Encode(v)
+	}
+	req, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode, resp.Header.Get(HEADER_GENERATION)
+}
+
+func TestApi(t *testing.T) {
+	policy.PolicyDeleteAll()
+	defer policy.PolicyDeleteAll()
+
+	ts := httptest.NewServer(New(nil))
+	defer ts.Close()
+	c := &client{t: t, url: ts.URL}
+
+	var add addBody
+	rule := spec.Rule{Cidr: "10.0.0.0/8", Dir: "ingress", Port: 80, Path: "/a", Action: "drop"}
+	if st, _ := c.do(http.MethodPost, "/v1/rules", &rule, &add); st != http.StatusCreated || add.Id == 0 {
+		t.Fatalf("add: %d %+v", st, add)
+	}
+	if st, _ := c.do(http.MethodPost, "/v1/rules", &spec.Rule{Action: "nope"}, nil); st != http.StatusBadRequest {
+		t.Fatalf("invalid rule: %d", st)
+	}
+
+	var got spec.Rule
+	if st, _ := c.do(http.MethodGet, fmt.Sprintf("/v1/rules/%d", add.Id), nil, &got); st != http.StatusOK || got.Path != "/a" {
+		t.Fatalf("get: %d %+v", st, got)
+	}
+
+	// a stale generation is refused, the current one goes through
+	stale := fmt.Sprint(add.Generation - 1)
+	if st, _ := c.do(http.MethodPost, "/v1/apply", nil, nil, "If-Match", stale); st != http.StatusPreconditionFailed {
+		t.Fatalf("apply at %s: %d", stale, st)
+	}
+	if st, _ := c.do(http.MethodPost, "/v1/apply", nil, nil, "If-Match", fmt.Sprint(add.Generation)); st != http.StatusNoContent {
+		t.Fatalf("apply: %d", st)
+	}
+
+	var es []spec.Explanation
+	req := spec.Request{Ip: "10.1.1.1", Dir: "ingress", Method: "GET", Port: 80, Path: "/a/b"}
+	if st, _ := c.do(http.MethodPost, "/v1/explain", &req, &es); st != http.StatusOK || len(es) != 1 || es[0].Action != "drop" {
+		t.Fatalf("explain: %d %+v", st, es)
+	}
+
+	var stats spec.Stats
+	id := fmt.Sprint(add.Id)
+	if st, _ := c.do(http.MethodGet, "/v1/stats/"+id, nil, &stats); st != http.StatusOK {
+		t.Fatalf("stats: %d", st)
+	}
+	if st, _ := c.do(http.MethodPost, "/v1/stats/"+id+"/reset", nil, nil); st != http.StatusNoContent {
+		t.Fatalf("stats reset: %d", st)
+	}
+	if st, _ := c.do(http.MethodGet, "/v1/stats/"+id+"/reset", nil, nil); st != http.StatusMethodNotAllowed {
+		t.Fatalf("stats reset by GET: %d", st)
+	}
+	// only a reset path loses its suffix
+	if st, _ := c.do(http.MethodGet, "/v1/stats/"+id+"reset", nil, nil); st != http.StatusBadRequest {
+		t.Fatalf("stats %sreset: %d", id, st)
+	}
+	// a reset is a change like the others
+	if st, _ := c.do(http.MethodPost, "/v1/stats/reset", nil, nil, "If-Match", stale); st != http.StatusPreconditionFailed {
+		t.Fatalf("stats reset at %s: %d", stale, st)
+	}
+
+	// an update keeps the id and the stats of the rule
+	if err := policy.PolicyAddBytes(add.Id, 10); err != nil {
+		t.Fatal(err)
+	}
+	rule.Path, rule.Action = "/b", "pass"
+	var upd addBody
+	if st, _ := c.do(http.MethodPut, "/v1/rules/"+id, &rule, &upd); st != http.StatusOK || upd.Id != add.Id {
+		t.Fatalf("update: %d %+v", st, upd)
+	}
+	if st, _ := c.do(http.MethodGet, "/v1/rules/"+id, nil, &got); st != http.StatusOK || got.Path != "/b" || got.Action != "pass" {
+		t.Fatalf("get updated: %d %+v", st, got)
+	}
+	if st, _ := c.do(http.MethodGet, "/v1/stats/"+id, nil, &stats); st != http.StatusOK || stats.Bytes != 10 {
+		t.Fatalf("stats updated: %d %+v", st, stats)
+	}
+	if st, _ := c.do(http.MethodPut, "/v1/rules/"+id, &rule, nil, "If-Match", stale); st != http.StatusPreconditionFailed {
+		t.Fatalf("update at %s: %d", stale, st)
+	}
+	if st, _ := c.do(http.MethodPut, "/v1/rules/"+fmt.Sprint(add.Id+100), &rule, nil); st != http.StatusNotFound {
+		t.Fatalf("update missing: %d", st)
+	}
+	if st, _ := c.do(http.MethodPut, "/v1/rules/"+id, &spec.Rule{Action: "nope"}, nil); st != http.StatusBadRequest {
+		t.Fatalf("update invalid: %d", st)
+	}
+
+	if st, _ := c.do(http.MethodDelete, "/v1/rules/"+id, nil, nil); st != http.StatusNoContent {
+		t.Fatalf("delete: %d", st)
+	}
+	if st, _ := c.do(http.MethodGet, "/v1/rules/"+id, nil, nil); st != http.StatusNotFound {
+		t.Fatalf("get deleted: %d", st)
+	}
+	if st, _ := c.do(http.MethodGet, "/v1/reload", nil, nil); st != http.StatusNotFound {
+		t.Fatalf("reload without files: %d", st)
+	}
+}
@@ -0,0 +1,295 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"l7/pkg/tenant"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const ERROR_BODY_LIMIT = 64 << 10
+
+// ErrorOf makes an error of an unexpected answer of the apis, with the
+// message of its json error body if any.
+func ErrorOf(resp *http.Response) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LIMIT))
+	if json.Unmarshal(b, &e) == nil && e.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+
+	return fmt.Errorf("%s", resp.Status)
+}
+
+type Stats struct {
+	Id       uint64     `json:"id"`
+	Hits     uint64     `json:"hits"`
+	FirstHit *time.Time `json:"first_hit,omitempty"`
+	LastHit  *time.Time `json:"last_hit,omitempty"`
+	Any      uint64     `json:"any"`
+	Ingress  uint64     `json:"ingress"`
+	Egress   uint64     `json:"egress"`
+	Bytes    uint64     `json:"bytes"`
+
+	Actions map[string]uint64 `json:"actions,omitempty"` // decisions by final action
+}
+
+func FromStats(id uint64, s *policy.RuleStats) Stats {
+	v := Stats{
+		Id:      id,
+		Hits:    s.Hits,
+		Any:     s.DirHits[base.L7_ANY],
+		Ingress: s.DirHits[base.L7_INGRESS],
+		Egress:  s.DirHits[base.L7_EGRESS],
+		Bytes:   s.Bytes,
+	}
+	for i, n := range s.Actions {
+		if n == 0 {
+			continue
+		}
+		if v.Actions == nil {
+			v.Actions = make(map[string]uint64)
+		}
+		v.Actions[policy.Action(i).String()] = n
+	}
+	if s.FirstHit != 0 {
+		t := time.Unix(0, s.FirstHit).UTC()
+		v.FirstHit = &t
+	}
+	if s.LastHit != 0 {
+		t := time.Unix(0, s.LastHit).UTC()
+		v.LastHit = &t
+	}
+
+	return v
+}
+
+type Chain struct {
+	Table string `json:"table"` // l3 or l7
+	Prio  uint16 `json:"prio"`
+	Rules int    `json:"rules"`
+	Hits  uint64 `json:"hits"`
+}
+
+func FromChain(c *policy.Chain) Chain {
+	v := Chain{
+		Table: "l7",
+		Prio:  c.Prio,
+		Rules: c.Rules,
+		Hits:  c.Hits,
+	}
+	if c.L3 {
+		v.Table = "l3"
+	}
+
+	return v
+}
+
+// Request describes a request to decide, as taken by explain and lookup.
+type Request struct {
+	Tenant   uint64 `json:"tenant,omitempty"`
+	Ip       string `json:"ip"`
+	Workload uint64 `json:"workload,omitempty"`
+	Role     uint64 `json:"role,omitempty"`
+	Group    Group  `json:"group,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	Path     string `json:"path"`
+	Dst      *Peer  `json:"dst,omitempty"`
+}
+
+// Peer is the destination of a request.
+type Peer struct {
+	Ip       string `json:"ip,omitempty"`
+	Workload uint64 `json:"workload,omitempty"`
+	Role     uint64 `json:"role,omitempty"`
+	Group    Group  `json:"group,omitempty"`
+}
+
+type Explanation struct {
+	Pattern string `json:"pattern"`
+	Uri     uint   `json:"uri"`
+	Default bool   `json:"default,omitempty"`
+	Action  string `json:"action"`
+	Rule    *Rule  `json:"rule,omitempty"`
+	Final   bool   `json:"final,omitempty"` // the decision of the request
+
+	Excepted []uint64 `json:"excepted,omitempty"` // rules skipped by their excepts
+}
+
+func (r *Request) Client() (*base.Client, error) {
+	ip, err := netip.ParseAddr(r.Ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %q", r.Ip)
+	}
+
+	c := &base.Client{
+		Tenant:   base.TenantId(r.Tenant),
+		Ip:       ip,
+		Workload: base.WorkloadId(r.Workload),
+		Role:     base.WorkRole(r.Role),
+		Group:    base.WorkGroup{App: r.Group.App, Loc: r.Group.Loc, Env: r.Group.Env},
+	}
+	if d := r.Dst; d != nil {
+		if d.Ip != "" {
+			if c.Dst.Ip, err = netip.ParseAddr(d.Ip); err != nil {
+				return nil, fmt.Errorf("invalid dst ip %q", d.Ip)
+			}
+		}
+		c.Dst.Workload, c.Dst.Role = base.WorkloadId(d.Workload), base.WorkRole(d.Role)
+		c.Dst.Group = base.WorkGroup{App: d.Group.App, Loc: d.Group.Loc, Env: d.Group.Env}
+	}
+
+	return c, nil
+}
+
+func (r *Request) decode() (*base.Client, base.Direction, base.Method, uint8, uint8, error) {
+	c, err := r.Client()
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	dir, err := base.ParseDirection(r.Dir)
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	method, err := base.ParseMethod(r.Method)
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	l7type, err := ParseType(r.Type)
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	proto, err := ParseProto(r.Proto)
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+
+	return c, dir, method, l7type, proto, nil
+}
+
+// Explain runs policy.PolicyExplain for r in the engine of its tenant.
+func (r *Request) Explain() ([]Explanation, error) {
+	e, ok := tenant.TenantGet(base.TenantId(r.Tenant))
+	if !ok {
+		return nil, fmt.Errorf("tenant %d not found", r.Tenant)
+	}
+
+	return r.ExplainIn(e)
+}
+
+// ExplainIn is Explain against a policy engine.
+func (r *Request) ExplainIn(e *policy.Engine) ([]Explanation, error) {
+	c, dir, method, l7type, proto, err := r.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := e.Explain(c, dir, method, l7type, proto, r.Port, r.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return explanations(es, func(id uint64) (policy.Rule, bool) {
+		v, err := e.Get(id)
+		return v, err == nil
+	}), nil
+}
+
+func explanations(es []policy.Explanation, get func(id uint64) (policy.Rule, bool)) []Explanation {
+	v := make([]Explanation, 0, len(es))
+	for _, e := range es {
+		x := Explanation{
+			Pattern: e.Pattern,
+			Uri:     uint(e.Api.Uri),
+			Default: e.Result.Kind == policy.POLICY_RESULT_OF_DEFAULT,
+			Action:  e.Result.Action.String(),
+			Final:   e.Final,
+
+			Excepted: e.Result.Excepted,
+		}
+		if e.Result.Rule != nil {
+			if pr, ok := get(e.Result.Rule.Id); ok {
+				sr := FromPolicy(&pr)
+				x.Rule = &sr
+			}
+		}
+		v = append(v, x)
+	}
+
+	return v
+}
+
+type Decision struct {
+	Action  string `json:"action"`
+	Default bool   `json:"default,omitempty"`
+	Rule    uint64 `json:"rule,omitempty"`
+}
+
+type Mismatch struct {
+	Time     time.Time `json:"time"`
+	Ip       string    `json:"ip"`
+	Workload uint64    `json:"workload,omitempty"`
+	Role     uint64    `json:"role,omitempty"`
+	Dir      string    `json:"dir"`
+	Method   string    `json:"method"`
+	Pattern  string    `json:"pattern"`
+	Path     string    `json:"path,omitempty"`
+	Live     Decision  `json:"live"`
+	Shadow   Decision  `json:"shadow"`
+}
+
+type ShadowReport struct {
+	Lookups    uint64     `json:"lookups"`
+	Diffs      uint64     `json:"diffs"`
+	Rate       float64    `json:"rate"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+func fromResult(r *policy.Result) Decision {
+	d := Decision{
+		Action:  r.Action.String(),
+		Default: r.Kind == policy.POLICY_RESULT_OF_DEFAULT,
+	}
+	if r.Rule != nil {
+		d.Rule = r.Rule.Id
+	}
+
+	return d
+}
+
+func FromShadowReport(r *policy.ShadowReport) ShadowReport {
+	v := ShadowReport{
+		Lookups:    r.Lookups,
+		Diffs:      r.Diffs,
+		Rate:       r.Rate(),
+		Mismatches: make([]Mismatch, 0, len(r.Mismatches)),
+	}
+	for i := range r.Mismatches {
+		m := &r.Mismatches[i]
+		v.Mismatches = append(v.Mismatches, Mismatch{
+			Time:     time.Unix(0, m.Time).UTC(),
+			Ip:       m.Client.Ip.String(),
+			Workload: uint64(m.Client.Workload),
+			Role:     uint64(m.Client.Role),
+			Dir:      m.Dir.String(),
+			Method:   m.Method.String(),
+			Pattern:  m.Pattern,
+			Path:     m.Path,
+			Live:     fromResult(&m.Live),
+			Shadow:   fromResult(&m.Shadow),
+		})
+	}
+
+	return v
+}
@@ -0,0 +1,834 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"l7/pkg/base"
+	"l7/pkg/net"
+	"l7/pkg/policy"
+	"l7/pkg/ratelimit"
+	"l7/pkg/schedule"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var typeNames = map[string]uint8{
+	"http": base.SERVICE_OF_HTTP,
+}
+
+var protoNames = map[string]uint8{
+	"any": base.PROTO_OF_ANY,
+	"tcp": 6,
+	"udp": 17,
+}
+
+var rlKeyNames = [ratelimit.RATELIMIT_KEY_OF_MAX]string{"ip", "workload", "role"}
+
+type Group struct {
+	App uint64 `json:"app,omitempty"`
+	Loc uint64 `json:"loc,omitempty"`
+	Env uint64 `json:"env,omitempty"`
+}
+
+// Dst is the destination of a rule, empty fields match any.
+type Dst struct {
+	Cidr     string `json:"cidr,omitempty"`
+	Workload uint64 `json:"workload,omitempty"`
+	Role     uint64 `json:"role,omitempty"`
+	Group    Group  `json:"group,omitempty"` // matches as a whole
+}
+
+// Except lists what a rule doesn't match although its key does.
+type Except struct {
+	Cidrs     []string `json:"cidrs,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+	Paths     []string `json:"paths,omitempty"` // uri regexes
+	Workloads []uint64 `json:"workloads,omitempty"`
+	Roles     []uint64 `json:"roles,omitempty"`
+	Groups    []Group  `json:"groups,omitempty"` // empty fields match any
+}
+
+// NamedGroup is a named object rules reference, its members are those of
+// its kind.
+type NamedGroup struct {
+	Kind     string    `json:"kind"` // addr, uri or service
+	Name     string    `json:"name"`
+	Cidrs    []string  `json:"cidrs,omitempty"`
+	Paths    []string  `json:"paths,omitempty"` // uri regexes
+	Services []Service `json:"services,omitempty"`
+}
+
+// Service is a member of a service group.
+type Service struct {
+	Type  string `json:"type,omitempty"`  // http if empty
+	Proto string `json:"proto,omitempty"` // tcp if empty, or any
+	Port  uint16 `json:"port,omitempty"`
+	Ports string `json:"ports,omitempty"` // lo-hi or any, instead of port
+}
+
+type Reject struct {
+	Status uint16 `json:"status"`
+	Body   string `json:"body,omitempty"`
+}
+
+type Redirect struct {
+	Status   uint16 `json:"status,omitempty"`
+	Location string `json:"location"`
+}
+
+type RateLimit struct {
+	Rate  uint32 `json:"rate"`
+	Burst uint32 `json:"burst,omitempty"`
+	Key   string `json:"key,omitempty"` // ip, workload or role
+}
+
+type Schedule struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Tz        string     `json:"tz,omitempty"`
+	Windows   []string   `json:"windows,omitempty"` // see schedule.ParseWindow
+}
+
+// Rule is the human readable form of a rule, as used by files and the
+// management api. A rule naming cidrs, methods, paths or groups is a set
+// rule, one rule for every combination of them.
+type Rule struct {
+	Id       uint64   `json:"id,omitempty"`    // set by the policy or l7ctl, ignored on add
+	Prio     uint16   `json:"prio,omitempty"`  // chain, 0 is looked up first
+	Cidr     string   `json:"cidr,omitempty"`  // with an identity, 0.0.0.0/0 for any address
+	Cidrs    []string `json:"cidrs,omitempty"` // instead of cidr
+	Workload uint64   `json:"workload,omitempty"`
+	Role     uint64   `json:"role,omitempty"`
+	Group    Group    `json:"group,omitempty"`
+	Dir      string   `json:"dir,omitempty"`     // any, ingress or egress
+	Method   string   `json:"method,omitempty"`  // http method, empty for any
+	Methods  []string `json:"methods,omitempty"` // instead of method
+	Type     string   `json:"type,omitempty"`    // http if empty
+	Proto    string   `json:"proto,omitempty"`   // tcp if empty, or any
+	Port     uint16   `json:"port,omitempty"`
+	Ports    string   `json:"ports,omitempty"` // lo-hi or any, instead of port
+	Path     string   `json:"path,omitempty"`  // uri regex
+	Paths    []string `json:"paths,omitempty"` // instead of path
+	Action   string   `json:"action"`
+	Dst      *Dst     `json:"dst,omitempty"`
+	Except   *Except  `json:"except,omitempty"`
+
+	AddrGroup    string `json:"addr_group,omitempty"`    // instead of cidr
+	UriGroup     string `json:"uri_group,omitempty"`     // instead of path
+	ServiceGroup string `json:"service_group,omitempty"` // instead of type, proto and port
+
+	Reject    *Reject    `json:"reject,omitempty"`
+	Redirect  *Redirect  `json:"redirect,omitempty"`
+	RateLimit *RateLimit `json:"ratelimit,omitempty"`
+	Schedule  *Schedule  `json:"schedule,omitempty"`
+}
+
+type Default struct {
+	Workload uint64 `json:"workload,omitempty"`
+	Role     uint64 `json:"role,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	Action   string `json:"action"`
+}
+
+type File struct {
+	Groups   []NamedGroup `json:"groups,omitempty"`
+	Defaults []Default    `json:"defaults,omitempty"`
+	Rules    []Rule       `json:"rules"`
+}
+
+func ParseType(s string) (uint8, error) {
+	if s == "" {
+		return base.SERVICE_OF_HTTP, nil
+	}
+	if v, ok := typeNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown service type %q", s)
+}
+
+func ParseProto(s string) (uint8, error) {
+	if s == "" {
+		return protoNames["tcp"], nil
+	}
+	if v, ok := protoNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown protocol %q", s)
+}
+
+// ParsePorts parses a port range, lo-hi, one port or any.
+func ParsePorts(s string) (uint16, uint16, error) {
+	if strings.ToLower(s) == "any" {
+		return 0, math.MaxUint16, nil
+	}
+
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	a, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ports %q", s)
+	}
+	b, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || b < a {
+		return 0, 0, fmt.Errorf("invalid ports %q", s)
+	}
+
+	return uint16(a), uint16(b), nil
+}
+
+func portsName(lo, hi uint16) string {
+	if lo == 0 && hi == math.MaxUint16 {
+		return "any"
+	}
+
+	return fmt.Sprintf("%d-%d", lo, hi)
+}
+
+func typeName(v uint8) string {
+	for k, t := range typeNames {
+		if t == v {
+			return k
+		}
+	}
+
+	return fmt.Sprintf("%d", v)
+}
+
+func protoName(v uint8) string {
+	for k, t := range protoNames {
+		if t == v {
+			return k
+		}
+	}
+
+	return fmt.Sprintf("%d", v)
+}
+
+// RuleKey is what a rule matches on, the cidrs, methods and paths of its
+// cells sorted and joined.
+type RuleKey struct {
+	policy.PolicyOpPara
+	Cidrs   string
+	Methods string
+	Paths   string
+	Groups  [3]string // addr, uri and service
+}
+
+// Key is what r matches on, two rules with the same key replace each other
+// in the policy.
+func (r *Rule) Key() (RuleKey, error) {
+	set, _, err := r.Policy()
+	if err != nil {
+		return RuleKey{}, err
+	}
+
+	k := RuleKey{PolicyOpPara: set.PolicyOpPara}
+	if k.Dst.Cidr != "" {
+		k.Dst.Cidr = masked(k.Dst.Cidr)
+	}
+
+	k.Groups = [3]string{set.AddrGroup, set.UriGroup, set.SvcGroup}
+
+	var ss []string
+	if set.AddrGroup == "" {
+		cidrs := set.Cidrs
+		if len(cidrs) == 0 {
+			cidrs = []string{set.Cidr}
+		}
+		for _, v := range cidrs {
+			ss = append(ss, masked(v))
+		}
+		k.Cidrs = joinSorted(ss)
+	}
+
+	ss = nil
+	if len(set.Methods) == 0 {
+		ss = append(ss, set.Method.String())
+	}
+	for _, v := range set.Methods {
+		ss = append(ss, v.String())
+	}
+	k.Methods = joinSorted(ss)
+
+	if len(set.Httpaths) != 0 {
+		k.Paths = joinSorted(append([]string(nil), set.Httpaths...))
+	} else if set.UriGroup == "" {
+		k.Paths = set.Httpath
+	}
+	k.Cidr, k.Method, k.Httpath = "", 0, ""
+
+	return k, nil
+}
+
+// joinSorted joins the distinct strings of ss.
+func joinSorted(ss []string) string {
+	sort.Strings(ss)
+
+	var r []string
+	for i, v := range ss {
+		if i == 0 || v != ss[i-1] {
+			r = append(r, v)
+		}
+	}
+
+	return strings.Join(r, "\n")
+}
+
+func masked(cidr string) string {
+	ip, ml, _ := net.ParseCidr(cidr)
+
+	return netip.PrefixFrom(ip, int(ml)).Masked().String()
+}
+
+// Policy validates r and converts it for policy.PolicyAddSet.
+func (r *Rule) Policy() (*policy.PolicyOpSet, *policy.RuleAttr, error) {
+	var (
+		set policy.PolicyOpSet
+		ra  policy.RuleAttr
+		err error
+	)
+	arg := &set.PolicyOpPara
+
+	if len(r.Cidrs) != 0 && r.Cidr != "" {
+		return nil, nil, fmt.Errorf("cidr and cidrs are exclusive")
+	}
+	if len(r.Methods) != 0 && r.Method != "" {
+		return nil, nil, fmt.Errorf("method and methods are exclusive")
+	}
+	if len(r.Paths) != 0 && r.Path != "" {
+		return nil, nil, fmt.Errorf("path and paths are exclusive")
+	}
+	if r.AddrGroup != "" && (r.Cidr != "" || len(r.Cidrs) != 0) {
+		return nil, nil, fmt.Errorf("addr_group excludes cidr and cidrs")
+	}
+	if r.UriGroup != "" && (r.Path != "" || len(r.Paths) != 0) {
+		return nil, nil, fmt.Errorf("uri_group excludes path and paths")
+	}
+	if r.ServiceGroup != "" && (r.Type != "" || r.Proto != "" || r.Port != 0 || r.Ports != "") {
+		return nil, nil, fmt.Errorf("service_group excludes type, proto, port and ports")
+	}
+	set.AddrGroup, set.UriGroup, set.SvcGroup = r.AddrGroup, r.UriGroup, r.ServiceGroup
+
+	cidrs := r.Cidrs
+	if len(cidrs) == 0 && r.AddrGroup == "" {
+		cidrs = []string{r.Cidr}
+	}
+	for _, v := range cidrs {
+		if _, _, err = net.ParseCidr(v); err != nil {
+			return nil, nil, fmt.Errorf("invalid cidr %q, %v", v, err)
+		}
+	}
+	for _, v := range r.Methods {
+		m, err := base.ParseMethod(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		set.Methods = append(set.Methods, m)
+	}
+	set.Cidrs = append(set.Cidrs, r.Cidrs...)
+	set.Httpaths = append(set.Httpaths, r.Paths...)
+	arg.Prio, arg.Cidr, arg.Httpath = r.Prio, r.Cidr, r.Path
+	arg.Workload, arg.Role = base.WorkloadId(r.Workload), base.WorkRole(r.Role)
+	arg.Group = base.WorkGroup{App: r.Group.App, Loc: r.Group.Loc, Env: r.Group.Env}
+	if d := r.Dst; d != nil {
+		if d.Cidr != "" {
+			if _, _, err = net.ParseCidr(d.Cidr); err != nil {
+				return nil, nil, fmt.Errorf("invalid dst cidr %q, %v", d.Cidr, err)
+			}
+		}
+		arg.Dst = policy.PolicyOpDst{
+			Cidr:     d.Cidr,
+			Workload: base.WorkloadId(d.Workload),
+			Role:     base.WorkRole(d.Role),
+			Group:    base.WorkGroup{App: d.Group.App, Loc: d.Group.Loc, Env: d.Group.Env},
+		}
+	}
+
+	if arg.Dir, err = base.ParseDirection(r.Dir); err != nil {
+		return nil, nil, err
+	}
+	if arg.Method, err = base.ParseMethod(r.Method); err != nil {
+		return nil, nil, err
+	}
+	if r.ServiceGroup == "" {
+		sv := Service{Type: r.Type, Proto: r.Proto, Port: r.Port, Ports: r.Ports}
+		s, err := sv.service()
+		if err != nil {
+			return nil, nil, err
+		}
+		arg.Type, arg.Proto, arg.Port, arg.PortMax = s.Type, s.Proto, s.Port, s.PortMax
+	}
+
+	if ra.Action, err = policy.ParseAction(r.Action); err != nil {
+		return nil, nil, err
+	}
+	if r.Reject != nil {
+		ra.Reject = &policy.RejectPara{Status: r.Reject.Status, Body: r.Reject.Body}
+	}
+	if r.Redirect != nil {
+		ra.Redirect = &policy.RedirectPara{Status: r.Redirect.Status, Location: r.Redirect.Location}
+	}
+	if r.RateLimit != nil {
+		ra.RateLimit = &policy.RateLimitPara{Rate: r.RateLimit.Rate, Burst: r.RateLimit.Burst}
+		if ra.RateLimit.Key, err = parseRlKey(r.RateLimit.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.Schedule != nil {
+		if ra.Schedule, err = r.Schedule.schedule(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.Except != nil {
+		if ra.Except, err = r.Except.except(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &set, &ra, nil
+}
+
+// service validates s, a one port range of a protocol is the port itself.
+func (s *Service) service() (base.ApiService, error) {
+	var (
+		v   base.ApiService
+		err error
+	)
+
+	if v.Type, err = ParseType(s.Type); err != nil {
+		return v, err
+	}
+	if v.Proto, err = ParseProto(s.Proto); err != nil {
+		return v, err
+	}
+	v.Port = s.Port
+	if s.Ports != "" {
+		if s.Port != 0 {
+			return v, fmt.Errorf("port and ports are exclusive")
+		}
+		if v.Port, v.PortMax, err = ParsePorts(s.Ports); err != nil {
+			return v, err
+		}
+	}
+	if err := policy.NormalizePorts(&v); err != nil {
+		return v, err
+	}
+
+	return v, nil
+}
+
+func fromService(s *base.ApiService) Service {
+	v := Service{Type: typeName(s.Type), Proto: protoName(s.Proto), Port: s.Port}
+	if lo, hi := s.Port, s.PortMax; hi != 0 && (lo != hi || s.Proto != base.PROTO_OF_ANY) {
+		v.Port, v.Ports = 0, portsName(lo, hi)
+	}
+
+	return v
+}
+
+// Policy validates g and converts it for policy.PolicyGroupSet.
+func (g *NamedGroup) Policy() (*policy.Group, error) {
+	if g.Name == "" {
+		return nil, fmt.Errorf("group without a name")
+	}
+	kind, err := policy.ParseGroupKind(g.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &policy.Group{Kind: kind, Name: g.Name}
+	switch kind {
+	case policy.GROUP_OF_ADDR:
+		for _, c := range g.Cidrs {
+			if _, _, err := net.ParseCidr(c); err != nil {
+				return nil, fmt.Errorf("invalid cidr %q, %v", c, err)
+			}
+		}
+		v.Cidrs = g.Cidrs
+	case policy.GROUP_OF_URI:
+		v.Uris = g.Paths
+	case policy.GROUP_OF_SERVICE:
+		for i := range g.Services {
+			s, err := g.Services[i].service()
+			if err != nil {
+				return nil, err
+			}
+			v.Services = append(v.Services, s)
+		}
+	}
+	if len(v.Cidrs)+len(v.Uris)+len(v.Services) == 0 {
+		return nil, fmt.Errorf("%s group %q has no members", g.Kind, g.Name)
+	}
+
+	return v, nil
+}
+
+func FromGroup(g *policy.Group) NamedGroup {
+	v := NamedGroup{
+		Kind:  policy.GroupName(g.Kind),
+		Name:  g.Name,
+		Cidrs: g.Cidrs,
+		Paths: g.Uris,
+	}
+	for i := range g.Services {
+		v.Services = append(v.Services, fromService(&g.Services[i]))
+	}
+
+	return v
+}
+
+func parseRlKey(s string) (uint8, error) {
+	if s == "" {
+		return ratelimit.RATELIMIT_KEY_OF_IP, nil
+	}
+	for i, v := range rlKeyNames {
+		if v == s {
+			return uint8(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown ratelimit key %q", s)
+}
+
+func (e *Except) except() (*policy.Except, error) {
+	r := &policy.Except{Uris: e.Paths}
+
+	for _, v := range e.Cidrs {
+		ip, ml, err := net.ParseCidr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid except cidr %q, %v", v, err)
+		}
+		r.Cidrs = append(r.Cidrs, netip.PrefixFrom(ip, int(ml)).Masked())
+	}
+	for _, v := range e.Methods {
+		m, err := base.ParseMethod(v)
+		if err != nil {
+			return nil, err
+		}
+		r.Methods = append(r.Methods, m)
+	}
+	for _, v := range e.Workloads {
+		r.Workloads = append(r.Workloads, base.WorkloadId(v))
+	}
+	for _, v := range e.Roles {
+		r.Roles = append(r.Roles, base.WorkRole(v))
+	}
+	for _, v := range e.Groups {
+		r.Groups = append(r.Groups, base.WorkGroup{App: v.App, Loc: v.Loc, Env: v.Env})
+	}
+
+	return r, nil
+}
+
+func fromExcept(e *policy.Except) *Except {
+	r := &Except{Paths: e.Uris}
+
+	for _, v := range e.Cidrs {
+		r.Cidrs = append(r.Cidrs, v.String())
+	}
+	for _, v := range e.Methods {
+		r.Methods = append(r.Methods, v.String())
+	}
+	for _, v := range e.Workloads {
+		r.Workloads = append(r.Workloads, uint64(v))
+	}
+	for _, v := range e.Roles {
+		r.Roles = append(r.Roles, uint64(v))
+	}
+	for _, v := range e.Groups {
+		r.Groups = append(r.Groups, Group{App: v.App, Loc: v.Loc, Env: v.Env})
+	}
+
+	return r
+}
+
+func (s *Schedule) schedule() (*schedule.Schedule, error) {
+	var r schedule.Schedule
+
+	if s.NotBefore != nil {
+		r.NotBefore = *s.NotBefore
+	}
+	if s.NotAfter != nil {
+		r.NotAfter = *s.NotAfter
+	}
+	if s.Tz != "" {
+		loc, err := time.LoadLocation(s.Tz)
+		if err != nil {
+			return nil, err
+		}
+		r.Loc = loc
+	}
+	for _, v := range s.Windows {
+		w, err := schedule.ParseWindow(v)
+		if err != nil {
+			return nil, err
+		}
+		r.Windows = append(r.Windows, w)
+	}
+
+	return &r, nil
+}
+
+// FromPolicy converts a dumped rule back to its readable form.
+func FromPolicy(r *policy.Rule) Rule {
+	sv := fromService(&base.ApiService{Type: r.Para.Type, Proto: r.Para.Proto, Port: r.Para.Port, PortMax: r.Para.PortMax})
+	v := Rule{
+		Id:       r.Id,
+		Prio:     r.Para.Prio,
+		Cidr:     r.Para.Cidr,
+		Workload: uint64(r.Para.Workload),
+		Role:     uint64(r.Para.Role),
+		Group:    Group{App: r.Para.Group.App, Loc: r.Para.Group.Loc, Env: r.Para.Group.Env},
+		Dir:      r.Para.Dir.String(),
+		Type:     sv.Type,
+		Proto:    sv.Proto,
+		Port:     sv.Port,
+		Ports:    sv.Ports,
+		Path:     r.Para.Httpath,
+		Action:   r.Attr.Action.String(),
+	}
+	if r.Para.Method != 0 {
+		v.Method = r.Para.Method.String()
+	}
+	if p := r.Set; p != nil {
+		if len(p.Cidrs) != 0 {
+			v.Cidr, v.Cidrs = "", append([]string(nil), p.Cidrs...)
+		}
+		if len(p.Methods) != 0 {
+			v.Method = ""
+			for _, m := range p.Methods {
+				v.Methods = append(v.Methods, m.String())
+			}
+		}
+		if len(p.Httpaths) != 0 {
+			v.Path, v.Paths = "", append([]string(nil), p.Httpaths...)
+		}
+		if p.AddrGroup != "" {
+			v.Cidr, v.AddrGroup = "", p.AddrGroup
+		}
+		if p.UriGroup != "" {
+			v.Path, v.UriGroup = "", p.UriGroup
+		}
+		if p.SvcGroup != "" {
+			v.Type, v.Proto, v.Port, v.Ports, v.ServiceGroup = "", "", 0, "", p.SvcGroup
+		}
+	}
+	if d := r.Para.Dst; d != (policy.PolicyOpDst{}) {
+		v.Dst = &Dst{
+			Cidr:     d.Cidr,
+			Workload: uint64(d.Workload),
+			Role:     uint64(d.Role),
+			Group:    Group{App: d.Group.App, Loc: d.Group.Loc, Env: d.Group.Env},
+		}
+	}
+
+	if p := r.Attr.Reject; p != nil {
+		v.Reject = &Reject{Status: p.Status, Body: p.Body}
+	}
+	if p := r.Attr.Redirect; p != nil {
+		v.Redirect = &Redirect{Status: p.Status, Location: p.Location}
+	}
+	if p := r.Attr.RateLimit; p != nil {
+		v.RateLimit = &RateLimit{Rate: p.Rate, Burst: p.Burst, Key: rlKeyNames[p.Key]}
+	}
+	if p := r.Attr.Schedule; p != nil {
+		s := &Schedule{}
+		if !p.NotBefore.IsZero() {
+			t := p.NotBefore
+			s.NotBefore = &t
+		}
+		if !p.NotAfter.IsZero() {
+			t := p.NotAfter
+			s.NotAfter = &t
+		}
+		if p.Loc != nil {
+			s.Tz = p.Loc.String()
+		}
+		for _, w := range p.Windows {
+			s.Windows = append(s.Windows, w.String())
+		}
+		v.Schedule = s
+	}
+	if p := r.Attr.Except; p != nil {
+		v.Except = fromExcept(p)
+	}
+
+	return v
+}
+
+func (d *Default) Policy() (*policy.DefaultKey, policy.Action, error) {
+	dir, err := base.ParseDirection(d.Dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	a, err := policy.ParseAction(d.Action)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &policy.DefaultKey{
+		Workload: base.WorkloadId(d.Workload),
+		Role:     base.WorkRole(d.Role),
+		Dir:      dir,
+	}, a, nil
+}
+
+func Parse(r io.Reader) (*File, error) {
+	var f File
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func Load(path string) (*File, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return Parse(fp)
+}
+
+func (f *File) Save(path string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Validate checks every entry of f without touching the policy.
+func (f *File) Validate() error {
+	for i := range f.Groups {
+		if _, err := f.Groups[i].Policy(); err != nil {
+			return fmt.Errorf("group %d: %v", i, err)
+		}
+	}
+	for i := range f.Defaults {
+		if _, _, err := f.Defaults[i].Policy(); err != nil {
+			return fmt.Errorf("default %d: %v", i, err)
+		}
+	}
+	for i := range f.Rules {
+		if _, _, err := f.Rules[i].Policy(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// InstallTo adds the groups, defaults and rules of f to a policy engine, the
+// caller applies them.
+func (f *File) InstallTo(e *policy.Engine) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	for i := range f.Groups {
+		g, _ := f.Groups[i].Policy()
+		if err := e.SetGroup(g); err != nil {
+			return fmt.Errorf("group %d: %v", i, err)
+		}
+	}
+	for i := range f.Defaults {
+		k, a, _ := f.Defaults[i].Policy()
+		e.SetDefault(k, a)
+	}
+	for i := range f.Rules {
+		set, ra, _ := f.Rules[i].Policy()
+		if err := e.AddSet(set, ra); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Swap builds f whole in a new engine and replaces the rule set of e with
+// it, holding lock if not nil. A rule set that fails half way never shows
+// and the lookups don't wait on the build. The rules that stay keep their
+// ids, stats and rate limit buckets, see policy.Engine.Next.
+func (f *File) Swap(e *policy.Engine, lock sync.Locker) error {
+	n := e.Next()
+	if err := f.InstallTo(n); err != nil {
+		return err
+	}
+	if err := n.Apply(); err != nil {
+		return err
+	}
+
+	if lock != nil {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	e.Replace(n)
+
+	return nil
+}
+
+// Install adds the defaults and rules of f to the policy and applies them.
+func (f *File) Install() error {
+	if err := f.InstallTo(policy.Default()); err != nil {
+		return err
+	}
+
+	return policy.ApplyRules()
+}
+
+func FromDefault(k *policy.DefaultKey, a policy.Action) Default {
+	return Default{
+		Workload: uint64(k.Workload),
+		Role:     uint64(k.Role),
+		Dir:      k.Dir.String(),
+		Action:   a.String(),
+	}
+}
+
+// Dump returns the installed groups, defaults and rules as a file.
+func Dump() *File {
+	f := &File{Rules: []Rule{}}
+
+	for _, g := range policy.PolicyGroups() {
+		f.Groups = append(f.Groups, FromGroup(&g))
+	}
+
+	for k, a := range policy.PolicyDefaults() {
+		f.Defaults = append(f.Defaults, FromDefault(&k, a))
+	}
+	sort.Slice(f.Defaults, func(i, j int) bool {
+		a, b := &f.Defaults[i], &f.Defaults[j]
+		if a.Workload != b.Workload {
+			return a.Workload < b.Workload
+		}
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		return a.Dir < b.Dir
+	})
+
+	for _, r := range policy.PolicyDump() {
+		f.Rules = append(f.Rules, FromPolicy(&r))
+	}
+
+	return f
+}
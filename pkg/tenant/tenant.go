@@ -0,0 +1,144 @@
+package tenant
+
+import (
+	"fmt"
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"sort"
+	"sync"
+)
+
+// DEFAULT_TENANT is served by policy.Default() and can't be deleted.
+const DEFAULT_TENANT base.TenantId = 0
+
+var tenants Tenants
+
+func init() {
+	tenants.Init()
+	policy.SetTenants(tenants.Get)
+}
+
+// Tenants maps every tenant to its own policy engine, so rules, address and
+// uri objects, counters and the compiled patterns are never shared.
+type Tenants struct {
+	sync.RWMutex
+	db map[base.TenantId]*policy.Engine
+}
+
+func (t *Tenants) Init() {
+	t.db = map[base.TenantId]*policy.Engine{
+		DEFAULT_TENANT: policy.Default(),
+	}
+}
+
+func (t *Tenants) Add(id base.TenantId, q *policy.Quota) (*policy.Engine, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.db[id]; ok {
+		return nil, fmt.Errorf("tenant %d exists", id)
+	}
+
+	e := policy.NewEngine()
+	if q != nil {
+		e.SetQuota(q)
+	}
+	t.db[id] = e
+
+	return e, nil
+}
+
+func (t *Tenants) Del(id base.TenantId) error {
+	if id == DEFAULT_TENANT {
+		return fmt.Errorf("default tenant can't be deleted")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	e, ok := t.db[id]
+	if !ok {
+		return fmt.Errorf("tenant %d not found", id)
+	}
+	delete(t.db, id)
+	e.DeleteAll()
+
+	return nil
+}
+
+func (t *Tenants) Get(id base.TenantId) (*policy.Engine, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	e, ok := t.db[id]
+	return e, ok
+}
+
+// Ids returns the tenants in ascending order.
+func (t *Tenants) Ids() []base.TenantId {
+	t.RLock()
+	defer t.RUnlock()
+
+	ids := make([]base.TenantId, 0, len(t.db))
+	for id := range t.db {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// Decide scans httpath in the engine of c.Tenant and returns its one
+// decision, see policy.Engine.Evaluate.
+func (t *Tenants) Decide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	l7type, proto uint8,
+	port uint16,
+	httpath string) (*policy.Result, error) {
+	e, ok := t.Get(c.Tenant)
+	if !ok {
+		return nil, fmt.Errorf("tenant %d not found", c.Tenant)
+	}
+
+	return e.Evaluate(c, dir, method, &base.ApiService{Type: l7type, Proto: proto, Port: port}, httpath)
+}
+
+// Apply compiles the uri patterns of one tenant only.
+func (t *Tenants) Apply(id base.TenantId) error {
+	e, ok := t.Get(id)
+	if !ok {
+		return fmt.Errorf("tenant %d not found", id)
+	}
+
+	return e.Apply()
+}
+
+func TenantAdd(id base.TenantId, q *policy.Quota) (*policy.Engine, error) {
+	return tenants.Add(id, q)
+}
+
+func TenantDel(id base.TenantId) error {
+	return tenants.Del(id)
+}
+
+func TenantGet(id base.TenantId) (*policy.Engine, bool) {
+	return tenants.Get(id)
+}
+
+func TenantIds() []base.TenantId {
+	return tenants.Ids()
+}
+
+func TenantDecide(c *base.Client,
+	dir base.Direction,
+	method base.Method,
+	l7type, proto uint8,
+	port uint16,
+	httpath string) (*policy.Result, error) {
+	return tenants.Decide(c, dir, method, l7type, proto, port, httpath)
+}
+
+func TenantApply(id base.TenantId) error {
+	return tenants.Apply(id)
+}
@@ -0,0 +1,123 @@
+package tenant
+
+import (
+	"l7/pkg/base"
+	"l7/pkg/policy"
+	"net/netip"
+	"testing"
+)
+
+func rule(path string) *policy.PolicyOpPara {
+	return &policy.PolicyOpPara{
+		Cidr:    "10.0.0.0/8",
+		Dir:     base.L7_INGRESS,
+		Type:    base.SERVICE_OF_HTTP,
+		Proto:   6,
+		Port:    80,
+		Httpath: path,
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	e, err := TenantAdd(7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer TenantDel(7)
+	if err := e.Add(rule("^/a"), policy.Action(policy.POLICY_ACTION_OF_DROP)); err != nil {
+		t.Fatal(err)
+	}
+	if err := TenantApply(7); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &base.Client{Ip: netip.MustParseAddr("10.1.2.3"), Tenant: 7}
+	other := *c
+	other.Tenant = DEFAULT_TENANT
+	s := &base.ApiService{Type: base.SERVICE_OF_HTTP, Proto: 6, Port: 80}
+
+	// the package level lookups route by tenant
+	if r, err := policy.Evaluate(c, base.L7_INGRESS, base.HTTP_GET, s, "/a"); err != nil || r.Rule == nil {
+		t.Fatalf("tenant 7: result %+v, %v", r, err)
+	}
+	if r, err := policy.Evaluate(&other, base.L7_INGRESS, base.HTTP_GET, s, "/a"); err != nil || r.Rule != nil {
+		t.Fatalf("default tenant: result %+v, %v", r, err)
+	}
+
+	as, err := policy.ApiServiceBuilderOf(7, base.SERVICE_OF_HTTP, 6, 80, "/a")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("services %v, %v", as, err)
+	}
+	if r, _ := policy.PolicyLookup(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r == nil {
+		t.Error("tenant 7: lookup missed")
+	}
+	if r, _ := policy.PolicyLookup(&other, base.L7_INGRESS, base.HTTP_GET, &as[0]); r != nil {
+		t.Errorf("default tenant: lookup matched rule %d of tenant 7", r.Id)
+	}
+	if r := policy.PolicyDecide(c, base.L7_INGRESS, base.HTTP_GET, &as[0]); r.Kind != policy.POLICY_RESULT_OF_MATCH {
+		t.Errorf("tenant 7: decision %+v", r)
+	}
+
+	// the patterns of a tenant aren't compiled in the default engine
+	if n, m := policy.Default().Patterns(), e.Patterns(); n != m-1 {
+		t.Errorf("default tenant has %d patterns, tenant 7 %d", n, m)
+	}
+
+	// one decision for the tenant
+	if r, err := TenantDecide(c, base.L7_INGRESS, base.HTTP_GET, base.SERVICE_OF_HTTP, 6, 80, "/a"); err != nil ||
+		uint8(r.Action) != policy.POLICY_ACTION_OF_DROP {
+		t.Errorf("tenant decide %+v, %v", r, err)
+	}
+
+	// an unknown tenant matches nothing and is dropped
+	unknown := *c
+	unknown.Tenant = 9
+	if r, _ := policy.PolicyLookup(&unknown, base.L7_INGRESS, base.HTTP_GET, &as[0]); r != nil {
+		t.Errorf("unknown tenant: lookup matched rule %d", r.Id)
+	}
+	if r := policy.PolicyDecide(&unknown, base.L7_INGRESS, base.HTTP_GET, &as[0]); uint8(r.Action) != policy.POLICY_ACTION_OF_DROP {
+		t.Errorf("unknown tenant: decision %+v", r)
+	}
+	if _, err := policy.Evaluate(&unknown, base.L7_INGRESS, base.HTTP_GET, s, "/a"); err == nil {
+		t.Error("unknown tenant evaluated")
+	}
+	if _, err := TenantDecide(&unknown, base.L7_INGRESS, base.HTTP_GET, base.SERVICE_OF_HTTP, 6, 80, "/a"); err == nil {
+		t.Error("unknown tenant decided")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	e, err := TenantAdd(8, &policy.Quota{Rules: 2, Patterns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer TenantDel(8)
+
+	if err := e.Add(rule("^/a"), policy.Action(policy.POLICY_ACTION_OF_DROP)); err != nil {
+		t.Fatal(err)
+	}
+	// a second pattern is over the quota, a rule on the same one is not
+	if err := e.Add(rule("^/b"), policy.Action(policy.POLICY_ACTION_OF_DROP)); err == nil {
+		t.Error("pattern quota exceeded")
+	}
+	p := rule("^/a")
+	p.Method = base.HTTP_GET
+	if err := e.Add(p, policy.Action(policy.POLICY_ACTION_OF_PASS)); err != nil {
+		t.Fatal(err)
+	}
+	p.Method = base.HTTP_POST
+	if err := e.Add(p, policy.Action(policy.POLICY_ACTION_OF_PASS)); err == nil {
+		t.Error("rule quota exceeded")
+	}
+	if n := len(e.Dump()); n != 2 {
+		t.Errorf("%d rules, want 2", n)
+	}
+
+	// the quota of a tenant doesn't bound another one
+	if _, err := TenantAdd(8, nil); err == nil {
+		t.Error("tenant 8 added twice")
+	}
+	if q := policy.Default().Quota(); q != (policy.Quota{}) {
+		t.Errorf("default quota %+v", q)
+	}
+}
@@ -26,6 +26,7 @@ func init() {
 type UriObjCbs struct {
 	sync.RWMutex
 	Um    map[string]uint // uri:id map
+	Iu    map[uint]string // id:uri map
 	Flags []string
 	Rse   *ReSearchEngine //working rse
 	Id    uint
@@ -46,6 +47,7 @@ func (uoc *UriObjCbs) Init(flag string, size uint) {
 	}
 
 	uoc.Um = make(map[string]uint, size)
+	uoc.Iu = make(map[uint]string, size)
 }
 
 func (uoc *UriObjCbs) AddUri(uri string) uint {
@@ -59,6 +61,7 @@ func (uoc *UriObjCbs) AddUri(uri string) uint {
 	uoc.Id += 1
 	v := uoc.Id
 	uoc.Um[uri] = v
+	uoc.Iu[v] = uri
 
 	return v
 }
@@ -74,10 +77,18 @@ func (uoc *UriObjCbs) FindUri(uri string) uint {
 	return 0
 }
 
+func (uoc *UriObjCbs) GetUri(id uint) string {
+	uoc.RLock()
+	defer uoc.RUnlock()
+
+	return uoc.Iu[id]
+}
+
 func (uoc *UriObjCbs) DelUri(uri string) {
 	uoc.Lock()
 	defer uoc.Unlock()
 
+	delete(uoc.Iu, uoc.Um[uri])
 	delete(uoc.Um, uri)
 }
 
@@ -86,6 +97,7 @@ func (uoc *UriObjCbs) DeleteAllUri() {
 	defer uoc.Unlock()
 
 	uoc.Um = make(map[string]uint, 0)
+	uoc.Iu = make(map[uint]string, 0)
 }
 
 func (uoc *UriObjCbs) ReGenerateRse() error {
@@ -190,8 +202,8 @@ type MatchResult struct {
 	To   uint64
 }
 
-func Apply() {
-	uoc.ReGenerateRse()
+func Apply() error {
+	return uoc.ReGenerateRse()
 }
 
 func Scan(data []byte) ([]MatchResult, error) {
@@ -206,6 +218,10 @@ func FindUri(uri string) uint {
 	return uoc.FindUri(uri)
 }
 
+func GetUri(id uint) string {
+	return uoc.GetUri(id)
+}
+
 func DelUri(uri string) {
 	uoc.DelUri(uri)
 }